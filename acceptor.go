@@ -2,14 +2,37 @@ package pusher
 
 import (
 	"http"
+	"strings"
 )
 
 // Acceptor is a pre-flight mechanism for a) authenticating incoming
 // subscriber/publisher request and b) extracting a channel id from a request.
 // The channel id is gIf an acceptor decides that the request should NOT be
-// allowed to publish/subscribe, then it must return an empty string.
+// allowed to publish/subscribe, then it must return an empty string, or the
+// result of Redirect to send the client elsewhere.
 type Acceptor func(req *http.Request) string
 
+// RedirectPrefix marks the channel ids returned by Redirect. As it starts with a NUL byte, it
+// can not be mistaken for a channel id taken from a URL.
+const redirectPrefix = "\x00redirect:"
+
+// Redirect is returned by an acceptor to deny a request and redirect the client to location
+// instead, e.g. to a login page. Subscribers are answered with a 302 pointing at location.
+// Publishers are servers rather than browsers with a login session, so to them the request is
+// denied with a 404 as if the acceptor had returned an empty string.
+func Redirect(location string) string {
+	return redirectPrefix + location
+}
+
+// RedirectLocation returns the location of a denial made with Redirect, or an empty string
+// if cid is not one.
+func redirectLocation(cid string) string {
+	if strings.HasPrefix(cid, redirectPrefix) {
+		return cid[len(redirectPrefix):]
+	}
+	return ""
+}
+
 // StaticAcceptor accepts all requests and uses always an static channel id.
 func StaticAcceptor(cid string) Acceptor {
 	return func(req *http.Request) string {
@@ -24,3 +47,16 @@ func QueryParameterAcceptor(parameterName string) Acceptor {
 		return req.FormValue(parameterName)
 	}
 }
+
+// NormalizingAcceptor accepts the requests accepted by inner and rewrites their channel ids
+// using fn, e.g. strings.ToLower makes /sub/Room42 and /sub/room42 the same channel. If fn
+// returns an empty string, the request is denied. Redirects are passed on untouched.
+func NormalizingAcceptor(inner Acceptor, fn func(string) string) Acceptor {
+	return func(req *http.Request) string {
+		cid := inner(req)
+		if cid == "" || redirectLocation(cid) != "" {
+			return cid
+		}
+		return fn(cid)
+	}
+}
@@ -1,52 +1,112 @@
 package pusher
 
 import (
+	"bytes"
 	"container/list"
 	"fmt"
 	"http"
+	"json"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Stats holds information about a channel.
 type Stats struct {
-	Created       int64 // The time the channel was created.
-	Delivered     int64 // The amonut of messages delivered.
-	LastPublished int64 // The time the last message was published.
-	LastRequested int64 // The time the last message was requested.
-	Published     int64 // The amount of messages published.
-	Subscribers   int   // The amount of active subscribers.
-	Queued        int   // The amount of messages queued.
+	BytesDelivered  int64 // The amount of payload bytes delivered.
+	BytesPublished  int64 // The amount of payload bytes published.
+	Coalesced       int64 // The amount of messages collapsed into the last message, see CoalesceWindow.
+	Created         int64 // The time the channel was created.
+	Delivered       int64 // The amount of messages handed to subscribers, once per subscriber, live or from the queue.
+	FirstRequested  int64 // The time the first subscriber arrived.
+	LastPublished   int64 // The time the last message was published.
+	LastRequested   int64 // The time the last message was requested.
+	PeakSubscribers int   // The highest amount of concurrently active subscribers.
+	Published       int64 // The amount of messages published.
+	Subscribers     int   // The amount of active subscribers.
+	Queued          int   // The amount of messages queued.
+	QueuedBytes     int64 // The payload bytes of the messages queued.
 }
 
-// ChannelSlice provides sort.Interface to sort by channel activities in ascending order
-// i.e. where least active channel is first.
-type channelSlice []*channel
+// Uptime returns the amount of seconds the channel has existed.
+func (s Stats) Uptime() int64 {
+	return time.Seconds() - s.Created
+}
+
+// A stampedChannel is a channel along with its activity stamp at a given moment.
+type stampedChannel struct {
+	c     *channel
+	stamp int64
+}
+
+// ChannelHeap provides heap.Interface to order channels by their activities in
+// ascending order i.e. where the least active channel is on top. The stamps are
+// taken once, so that they can not change while the heap is in use.
+type channelHeap []stampedChannel
+
+func (h channelHeap) Len() int {
+	return len(h)
+}
+
+func (h channelHeap) Less(i, j int) bool {
+	return h[i].stamp < h[j].stamp
+}
 
-func (cs channelSlice) Len() int {
-	return len(cs)
+func (h channelHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
 }
 
-func (cs channelSlice) Less(i, j int) bool {
-	return cs[i].stamp() < cs[j].stamp()
+func (h *channelHeap) Push(x interface{}) {
+	*h = append(*h, x.(stampedChannel))
 }
 
-func (cs channelSlice) Swap(i, j int) {
-	cs[i], cs[j] = cs[i], cs[j]
+func (h *channelHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
 }
 
+// DedupWindow is the amount of recent message ids remembered by a channel in order to
+// drop duplicates.
+const dedupWindow = 16
+
 // Channel represents a gateway for messages to pass from publishers to
 // subscribers.
 type channel struct {
 	subscribers *list.List     // The active subscribers to this channel.
 	config      *Configuration // The configuration options.
 	lock        sync.RWMutex   // Protects the state.
-	lastMessage *Message       // The most recent message that delivered.
+	statsLock   sync.Mutex     // Protects the stats along with lock, see Stats.
+	lastMessage *Message       // The most recent message with a 200 status that was delivered.
 	stats       Stats          // The statistics of the channel
 	id          string         // The name of the channel.
-	queue       []*Message     // The messages, oldest first.
+	queue       ring           // The messages, oldest first.
+	recent      []*Message     // The most recent messages carrying an id, oldest first.
+	tokens      float64        // The publish tokens available (see MaxPublishRate).
+	refilled    int64          // The time the tokens were last refilled in ns.
+	seq         int64          // The sequence number of the most recent message.
+	etag        int            // The etag of the most recent message.
+	etagSecond  int64          // The second the most recent message was published.
+	capacity    int            // The capacity of the queue, see SetCapacity.
+	contentType string         // The content-type of published messages, see SetContentType.
+
+	presence     *channel   // The presence channel (nil=none, see PresenceChannels).
+	presenceLock sync.Mutex // Serializes the announcements to the presence channel.
+	announced    int        // The amount of subscribers last announced.
+	owned        bool       // Whether this is the presence channel of another channel.
+
+	gone   *Message     // The message the channel was closed with (nil=open), see close.
+	memory *queueMemory // Accounts the queued bytes of the pusher (nil=none), see MaxTotalQueuedBytes.
+	parked *int32       // Counts the parked subscribers of the pusher (nil=none), see MaxConcurrentSubscribers.
+
+	saveLock    sync.Mutex // Serializes the saves of the queue, see save.
+	saving      bool       // Whether a save of the queue is scheduled, see persist.
+	unpersisted bool       // Whether the stored queue has been deleted for good, see unpersist.
 }
 
 // NewChannel creates a new channel.
@@ -56,47 +116,287 @@ func newChannel(id string, config *Configuration) (c *channel) {
 		config:      config,
 		stats:       Stats{Created: time.Seconds()},
 		id:          id,
-		queue:       make([]*Message, 0),
+		queue:       newRing(config.ChannelCapacity),
+		capacity:    config.ChannelCapacity,
+	}
+	if config.Persister != nil {
+		msgs, err := config.Persister.Load(id)
+		if err != nil {
+			config.Logger.Printf("Persist: Loading channel %q failed: %s", id, err)
+		}
+		c.restore(msgs)
 	}
 	return
 }
 
-// Stamp return the time of the last activity on this channel.
-func (c *channel) stamp() int64 {
-	if c.stats.LastRequested == 0 && c.stats.LastPublished == 0 {
-		return c.stats.Created
-	} else if c.stats.LastRequested > c.stats.LastPublished {
-		return c.stats.LastRequested
+// Restore replaces the queue with the given messages (oldest first), as if they
+// were published to this channel, without delivering them to anyone.
+func (c *channel) restore(msgs []*Message) {
+	if n := len(msgs) - c.capacity; n > 0 {
+		msgs = msgs[n:]
 	}
-	return c.stats.LastPublished
+	if len(msgs) == 0 {
+		return
+	}
+
+	last := msgs[len(msgs)-1]
+	for _, m := range msgs {
+		c.queue.Push(m)
+	}
+	c.lastMessage = last
+	c.advance(last)
+	c.setQueued()
 }
 
-// WriteStats writes statistics about this channel straight to rw. It
-// will determine the encoding of the stats based on the request's Accept-header.
-func (c *channel) writeStats(rw http.ResponseWriter, req *http.Request) os.Error {
-	var typ, subtype string
+// Export returns the serializable form of the channel, see pusher.Export.
+func (c *channel) export() exportedChannel {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-	// Valid Accept-types are {text | application} / {statFormats...}.
-	// If these conditions are not met, we will revert to text/plain.
-	accept := strings.SplitN(strings.ToLower(req.Header.Get("Accept")), "/", 2)
-	if len(accept) != 2 || (accept[0] != "text" && accept[0] != "application") {
-		typ, subtype = "text", "plain"
-	} else {
-		typ, subtype = accept[0], accept[1]
+	e := exportedChannel{Id: c.id, Capacity: c.capacity, ContentType: c.contentType, Stats: c.Stats()}
+	if m := c.lastMessage; m != nil && !m.synthetic() {
+		pm := persistMessage(m)
+		e.Last = &pm
+	}
+	e.Messages = make([]persistedMessage, c.queue.Len())
+	for i := range e.Messages {
+		e.Messages[i] = persistMessage(c.queue.At(i))
 	}
+	return e
+}
 
-	format := statFormats[subtype]
-	if format == "" {
-		subtype = "plain"
-		format = statFormats["plain"]
+// Load replaces the capacity, content-type, queue and stats of the channel with the exported ones,
+// see Import. The subscribers are left as they are.
+func (c *channel) load(e exportedChannel) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.statsLock.Lock()
+	stats := e.Stats
+	// the queue is accounted by setQueued
+	stats.Subscribers, stats.Queued, stats.QueuedBytes = c.stats.Subscribers, c.stats.Queued, c.stats.QueuedBytes
+	c.stats = stats
+	c.statsLock.Unlock()
+
+	msgs := make([]*Message, len(e.Messages))
+	for i, pm := range e.Messages {
+		msgs[i] = pm.message()
+	}
+	c.capacity, c.contentType = e.Capacity, e.ContentType
+	c.queue = newRing(e.Capacity)
+	c.restore(msgs)
+	if e.Last != nil {
+		c.lastMessage = e.Last.message()
+		c.advance(c.lastMessage)
+	}
+	c.setQueued()
+	c.persist()
+}
+
+// SetCapacity overrides the ChannelCapacity configuration option for this channel. If
+// the queue holds more than n messages, the oldest ones are dropped.
+func (c *channel) SetCapacity(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	msgs := c.queue.Slice()
+	if k := len(msgs) - n; k > 0 {
+		msgs = msgs[k:]
 	}
+	c.capacity = n
+	c.queue = newRing(n)
+	for _, m := range msgs {
+		c.queue.Push(m)
+	}
+	c.setQueued()
+	c.persist()
+}
+
+// SetContentType overrides the ContentType configuration option for the messages published
+// to this channel through the publisher locations. An empty ctype clears the override.
+func (c *channel) SetContentType(ctype string) {
+	c.lock.Lock()
+	c.contentType = ctype
+	c.lock.Unlock()
+}
 
+// ContentType returns the content-type set with SetContentType ("" if there is none).
+func (c *channel) ContentType() string {
 	c.lock.RLock()
-	stats := c.stats
-	c.lock.RUnlock()
+	defer c.lock.RUnlock()
+	return c.contentType
+}
+
+// Persist schedules a save of the queue using the Persister configuration option, unless
+// one is already scheduled. The caller must hold the write lock, so the queue is saved on a
+// goroutine of its own once the lock is released, see save.
+func (c *channel) persist() {
+	if c.config.Persister != nil && !c.saving {
+		c.saving = true
+		go c.save()
+	}
+}
+
+// Save saves the queue using the Persister configuration option, unless it has been deleted
+// with unpersist. The queue is copied under the lock of the channel, but written without it.
+func (c *channel) save() {
+	c.saveLock.Lock()
+	defer c.saveLock.Unlock()
+
+	c.lock.Lock()
+	msgs := c.queue.Slice()
+	c.saving = false
+	unpersisted := c.unpersisted
+	c.lock.Unlock()
+
+	if unpersisted {
+		return
+	}
+	if err := c.config.Persister.Save(c.id, msgs); err != nil {
+		c.config.Logger.Printf("Persist: Saving channel %q failed: %s", c.id, err)
+	}
+}
+
+// Unpersist deletes the stored queue using the Persister configuration option, once the
+// channel has been deleted or garbage collected, so that a channel created with the same
+// id later starts out empty. The queue is never saved again afterwards.
+func (c *channel) unpersist() {
+	if c.config.Persister == nil {
+		return
+	}
+	c.saveLock.Lock()
+	defer c.saveLock.Unlock()
+
+	c.lock.Lock()
+	c.unpersisted = true
+	c.lock.Unlock()
+
+	if err := c.config.Persister.Delete(c.id); err != nil {
+		c.config.Logger.Printf("Persist: Deleting channel %q failed: %s", c.id, err)
+	}
+}
+
+// Stamp return the time of the last activity on this channel. Like Stats, it only takes
+// statsLock, so it does not wait for a publish.
+func (c *channel) stamp() int64 {
+	s := c.Stats()
+	if s.LastRequested == 0 && s.LastPublished == 0 {
+		return s.Created
+	} else if s.LastRequested > s.LastPublished {
+		return s.LastRequested
+	}
+	return s.LastPublished
+}
+
+// A mediaRange is a single entry of an Accept-header.
+type mediaRange struct {
+	typ, subtype string  // The type and subtype, possibly wildcards.
+	q            float64 // The quality value.
+	index        int     // The position in the header.
+}
+
+// MediaRanges provides sort.Interface to sort media ranges by their quality values
+// in descending order, keeping the order of the header for equal quality values.
+type mediaRanges []mediaRange
+
+func (mr mediaRanges) Len() int {
+	return len(mr)
+}
+
+func (mr mediaRanges) Less(i, j int) bool {
+	if mr[i].q == mr[j].q {
+		return mr[i].index < mr[j].index
+	}
+	return mr[i].q > mr[j].q
+}
+
+func (mr mediaRanges) Swap(i, j int) {
+	mr[i], mr[j] = mr[j], mr[i]
+}
+
+// ParseAccept parses an Accept-header into media ranges ordered by preference.
+// Malformed media ranges and those with a zero quality value are dropped.
+func parseAccept(accept string) mediaRanges {
+	var ranges mediaRanges
+	for i, entry := range strings.Split(strings.ToLower(accept), ",") {
+		params := strings.Split(entry, ";")
+		types := strings.SplitN(strings.TrimSpace(params[0]), "/", 2)
+		if len(types) != 2 || types[0] == "" || types[1] == "" {
+			continue
+		}
+
+		r := mediaRange{typ: types[0], subtype: types[1], q: 1, index: i}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.Atof64(kv[1]); err == nil {
+					r.q = q
+				}
+			}
+		}
+		if r.q > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.Sort(ranges)
+	return ranges
+}
+
+// AcceptedStatType negotiates the type and subtype of stats from the request's
+// Accept-header. The media ranges are tried in order of preference and the first
+// one with a type of text or application and a subtype for which available
+// returns true is used. Wildcard subtypes select plain for text and json for
+// application, and */* selects text/plain. If nothing matches, text/plain is used.
+func acceptedStatType(req *http.Request, available func(subtype string) bool) (typ, subtype string) {
+	for _, r := range parseAccept(req.Header.Get("Accept")) {
+		switch {
+		case r.typ == "*" && r.subtype == "*", r.typ == "text" && r.subtype == "*":
+			return "text", "plain"
+		case r.typ == "application" && r.subtype == "*":
+			return "application", "json"
+		case (r.typ == "text" || r.typ == "application") && available(r.subtype):
+			return r.typ, r.subtype
+		}
+	}
+	return "text", "plain"
+}
+
+// IsStatType tells whether stats can be written using the given subtype.
+func isStatType(subtype string) bool {
+	return statEncoders[subtype] != nil || statFormats[subtype] != ""
+}
+
+// AcceptsStats tells whether the request asks for stats, i.e. the Accept-header is
+// absent or one of its media ranges would be selected by acceptedStatType.
+func acceptsStats(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, r := range parseAccept(accept) {
+		if r.typ == "*" && r.subtype == "*" ||
+			(r.typ == "text" || r.typ == "application") && (r.subtype == "*" || isStatType(r.subtype)) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteStats writes statistics about this channel straight to rw. It
+// will determine the encoding of the stats based on the request's Accept-header.
+func (c *channel) writeStats(rw http.ResponseWriter, req *http.Request) os.Error {
+	typ, subtype := acceptedStatType(req, isStatType)
+	encoder := statEncoders[subtype]
+	format := statFormats[subtype]
+
+	stats := c.Stats()
 
 	rw.Header().Set("Content-Type", typ+"/"+subtype)
 
+	if encoder != nil {
+		return encoder(rw, stats)
+	}
+
 	// format plain mode stamps to ago
 	if subtype == "plain" {
 		if stats.LastRequested > 0 {
@@ -107,123 +407,723 @@ func (c *channel) writeStats(rw http.ResponseWriter, req *http.Request) os.Error
 		if stats.LastPublished > 0 {
 			stats.LastPublished = time.Seconds() - stats.LastPublished
 		} else {
-			stats.LastRequested = -1
+			stats.LastPublished = -1
+		}
+		if stats.FirstRequested > 0 {
+			stats.FirstRequested = time.Seconds() - stats.FirstRequested
+		} else {
+			stats.FirstRequested = -1
 		}
 	}
 	_, err := fmt.Fprintf(rw, format, stats.Queued, stats.LastRequested, stats.LastPublished,
-		stats.Subscribers, stats.Published, stats.Delivered)
+		stats.Subscribers, stats.Published, stats.Delivered, stats.BytesPublished, stats.BytesDelivered,
+		stats.PeakSubscribers, stats.FirstRequested, stats.Coalesced, stats.Uptime())
 	return err
 }
 
 // Stats returns a snapshot of the current statistics.
+//
+// The stats are written while holding both the lock of the channel and statsLock, so
+// they may be read while holding either of them. Stats only takes statsLock, which is
+// held briefly, so reading the stats does not wait for a publish delivering to many
+// subscribers or a subscriber being parked.
 func (c *channel) Stats() (stats Stats) {
-	c.lock.RLock()
+	c.statsLock.Lock()
 	stats = c.stats
-	c.lock.RUnlock()
+	c.statsLock.Unlock()
+	return
+}
+
+// SetQueued updates the stats to the current length and size of the queue and accounts
+// the change of size to the pusher, unless the channel is closed. The caller must hold
+// the write lock.
+func (c *channel) setQueued() {
+	c.statsLock.Lock()
+	delta := c.queue.Bytes() - c.stats.QueuedBytes
+	c.stats.Queued = c.queue.Len()
+	c.stats.QueuedBytes = c.queue.Bytes()
+	c.statsLock.Unlock()
+	if c.gone == nil {
+		c.memory.add(delta)
+	}
+}
+
+// EvictOldest drops the oldest queued messages until at least bytes payload bytes are
+// freed or the queue is empty. It returns the amount of bytes freed.
+func (c *channel) evictOldest(bytes int64) (freed int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	k := 0
+	for ; k < c.queue.Len() && freed < bytes; k++ {
+		freed += int64(len(c.queue.At(k).Payload))
+	}
+	if k > 0 {
+		c.queue.Drop(k)
+		c.setQueued()
+		c.persist()
+	}
 	return
 }
 
 // Publish takes the given message and sends it to all active subscribers. It
-// can also queue the message for future requests.
+// can also queue the message for future requests. A message carrying the id of
+// a recent message is dropped.
 func (c *channel) Publish(m *Message, queue bool) (n int) {
-	c.lock.Lock()
-	n = c.publish(m, queue)
-	c.lock.Unlock()
+	n, _, _ = c.publishOnce(m, queue)
 	return
 }
 
+// ErrQueueFull is returned when a message is rejected by a full queue, see
+// QueuePolicyRejectWhenFull.
+var ErrQueueFull = os.NewError("pusher: queue full")
+
+// PublishOnce works like Publish, but drops m if one of the recent messages (see
+// dedupWindow) has the same id or if m is identical to the last message (see
+// CoalesceWindow). In that case the earlier message is returned. If the queue is
+// full and the RejectWhenFull queue policy is used, m is dropped as well and
+// ErrQueueFull is returned.
+func (c *channel) publishOnce(m *Message, queue bool) (n int, original *Message, err os.Error) {
+	return c.publishIf(m, queue, "")
+}
+
+// ErrPreconditionFailed is returned when a conditional publish finds the channel
+// changed, see publishIf.
+var ErrPreconditionFailed = os.NewError("pusher: precondition failed")
+
+// Coalesce returns the last message of the channel if m, published now (in ns), is identical
+// to it and the last message was published within the CoalesceWindow configuration option,
+// nil otherwise.
+func (c *channel) coalesce(m *Message, now int64) *Message {
+	last := c.lastMessage
+	if c.config.CoalesceWindow <= 0 || last == nil || last.Status != http.StatusOK {
+		return nil
+	}
+	if now-last.time >= c.config.CoalesceWindow {
+		return nil
+	}
+	if m.Status != last.Status || m.ContentType != last.ContentType || m.Priority != last.Priority ||
+		!bytes.Equal(m.Payload, last.Payload) {
+		return nil
+	}
+	return last
+}
+
+// PublishIf works like publishOnce, but publishes m only if match names the etag of
+// the last message of the channel, which makes the channel usable as a compare-and-set
+// register. A match of "*" is satisfied by any last message and an empty match by
+// anything. Otherwise m is dropped and ErrPreconditionFailed is returned. The check
+// and the publish happen under the same lock, so concurrent publishers cannot clobber
+// each other.
+func (c *channel) publishIf(m *Message, queue bool, match string) (n int, original *Message, err os.Error) {
+	defer c.announce()
+	// the caller may hold the lock of a shard, which reclaim would need
+	defer c.memory.reclaimLater()
+	// the clock is read before taking the lock, under it the time is only clamped, see publishTime
+	now := time.Nanoseconds()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if original = c.published(m.Id); original != nil {
+		return 0, original, nil
+	}
+	if original = c.coalesce(m, now); original != nil {
+		c.statsLock.Lock()
+		c.stats.Coalesced++
+		c.statsLock.Unlock()
+		return 0, original, nil
+	}
+	if match != "" && !c.matches(match) {
+		return 0, nil, ErrPreconditionFailed
+	}
+	if queue && c.config.QueuePolicy == QueuePolicyRejectWhenFull && c.full() {
+		return 0, nil, ErrQueueFull
+	}
+	return c.publish(m, queue, now), nil, nil
+}
+
+// Matches reports whether match (an If-Match header) names the etag of the last message
+// of the channel. Synthetic messages such as conflicts are not considered.
+func (c *channel) matches(match string) bool {
+	last := c.lastMessage
+	if last == nil || last.Status != http.StatusOK {
+		return false
+	}
+	if match == "*" {
+		return true
+	}
+	etag := strconv.Itoa(last.etag)
+	for _, tag := range strings.Split(match, ",") {
+		if strings.Trim(strings.TrimSpace(tag), `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Full reports whether the queue is full. Expired messages are pruned first, since
+// they do not take up room.
+func (c *channel) full() bool {
+	if c.capacity <= 0 {
+		return false
+	}
+	c.prune()
+	return c.queue.Len() >= c.capacity
+}
+
+// Published returns the recent message with the given id, or nil if there is none.
+func (c *channel) published(id string) *Message {
+	if id == "" {
+		return nil
+	}
+	for i := len(c.recent) - 1; i >= 0; i-- {
+		if c.recent[i].Id == id {
+			return c.recent[i]
+		}
+	}
+	return nil
+}
+
+// PublishChunk publishes and queues m, a chunk of a streamed body, without checking for
+// duplicates, coalescing or the RejectWhenFull queue policy, which would tear the stream.
+// A full queue under RejectWhenFull only keeps the chunk from being queued.
+func (c *channel) publishChunk(m *Message) int {
+	defer c.announce()
+	defer c.memory.reclaimLater()
+	now := time.Nanoseconds()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.publish(m, true, now)
+}
+
 // PublishString takes the given string and sends it to all active subscribers along
 // with a text/plain content-type and a 200 status. It can also queue the message for
 // future requests.
 func (c *channel) PublishString(s string, queue bool) int {
-	m := &Message{Status: http.StatusOK, ContentType: "text/plain", Payload: []byte(s)}
-	return c.Publish(m, queue)
+	return c.Publish(NewMessage("text/plain", []byte(s)), queue)
 }
 
-func (c *channel) publish(m *Message, queue bool) (n int) {
-	m.time = time.Seconds()
-	m.etag = 0
+// PublishJSON works like Publish, but sends v marshalled as JSON along with an
+// application/json content-type and a 200 status. Nothing is published if v cannot
+// be marshalled, in which case the error is returned.
+func (c *channel) PublishJSON(v interface{}, queue bool) (int, os.Error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return c.Publish(NewMessage("application/json", payload), queue), nil
+}
 
-	if c.lastMessage != nil && c.lastMessage.time == m.time {
-		m.etag = c.lastMessage.etag + 1
+// Publish sequences m, published now (in ns), and delivers it, see deliver. Synthetic
+// messages are delivered as they are, so they neither advance the sequence numbers and etags
+// of the channel nor are they modified, as they may be shared.
+func (c *channel) publish(m *Message, queue bool, now int64) int {
+	if m.synthetic() {
+		return c.deliver(m, false, now)
+	}
+	m.time = c.publishTime(m.Time, now)
+	m.seq, m.etag = c.next(m.time)
+	c.advance(m)
+	return c.deliver(m, queue, now)
+}
+
+// PublishTime returns the time (in ns) a message is published at: t if it is non-zero,
+// now otherwise. The time is never earlier than the second of the previous message, so
+// that If-Modified-Since keeps following the order of publishing even if supplied times
+// arrive out of order or the clock goes back. Such messages get the second of the previous
+// message instead and are told apart by their etags. As the clock is read by the caller,
+// typically before taking the lock, now may be earlier than the previous message, too.
+func (c *channel) publishTime(t, now int64) int64 {
+	if t == 0 {
+		t = now
+	}
+	if t/1e9 < c.etagSecond {
+		t = c.etagSecond * 1e9
 	}
+	return t
+}
+
+// Next returns the sequence number and etag the next message published at the
+// given time (in ns) would get. Messages published within the same second are
+// told apart by their etags.
+func (c *channel) next(now int64) (seq int64, etag int) {
+	if now/1e9 == c.etagSecond {
+		etag = c.etag + 1
+	}
+	return c.seq + 1, etag
+}
 
-	c.lastMessage = m
+// Last returns the most recent message published to this channel, or nil if
+// there is none. Synthetic messages such as conflicts are not considered.
+func (c *channel) last() *Message {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.lastMessage == nil || c.lastMessage.Status != http.StatusOK {
+		return nil
+	}
+	return c.lastMessage
+}
+
+// Peek returns a copy of the most recent message published to this channel, or nil
+// if there is none, see last. It neither touches the stats nor the queue.
+func (c *channel) Peek() *Message {
+	m := c.last()
+	if m == nil {
+		return nil
+	}
+	peeked := *m
+	return &peeked
+}
+
+// Advance records m as the most recently sequenced message, so that following
+// messages get greater sequence numbers and etags.
+func (c *channel) advance(m *Message) {
+	c.seq = m.seq
+	c.etag, c.etagSecond = m.etag, m.time/1e9
+}
+
+// Deliver sends the already sequenced m, published now (in ns), to all active subscribers
+// and queues it if requested. Finally the OnPublish configuration option is called. It
+// returns the amount of subscribers m was delivered to.
+func (c *channel) deliver(m *Message, queue bool, now int64) (n int) {
+	// synthetic messages such as conflicts must not replace the last message, see last
+	if m.Status == http.StatusOK {
+		c.lastMessage = m
+	}
+	if m.Id != "" {
+		if len(c.recent) >= dedupWindow {
+			c.recent = c.recent[1:]
+		}
+		c.recent = append(c.recent, m)
+	}
+	c.statsLock.Lock()
 	c.stats.Published++
-	c.stats.LastPublished = time.Seconds()
+	c.stats.BytesPublished += int64(len(m.Payload))
+	c.stats.LastPublished = now / 1e9
+	c.statsLock.Unlock()
+	if c.config.Metrics != nil {
+		c.config.Metrics.IncPublished(c.id)
+	}
 
-	for e := c.subscribers.Front(); e != nil; e = e.Next() {
-		client := e.Value.(chan *Message)
-		select {
-		case client <- m:
-			n++
-		default:
+	if c.config.ConcurrencyMode == ConcurrencyModeExclusive && m.Status == http.StatusOK {
+		// only the oldest ready subscriber receives the message, the next one takes over
+		for e := c.subscribers.Front(); e != nil && n == 0; e = c.subscribers.Front() {
+			n = c.send(e, m)
+			c.subscribers.Remove(e)
 		}
-		close(client)
+	} else {
+		for e := c.subscribers.Front(); e != nil; e = e.Next() {
+			n += c.send(e, m)
+		}
+		c.subscribers.Init()
 	}
-	c.subscribers.Init()
-	c.stats.Subscribers = 0
+	c.unpark(c.stats.Subscribers - c.subscribers.Len())
+	c.statsLock.Lock()
+	c.stats.Subscribers = c.subscribers.Len()
 	c.stats.Delivered += int64(n)
+	c.stats.BytesDelivered += int64(n * len(m.Payload))
+	c.statsLock.Unlock()
+	c.countDelivered(n)
+	c.countSubscribers()
 
-	if queue && c.config.ChannelCapacity > 0 {
-		if len(c.queue) >= c.config.ChannelCapacity {
-			c.queue = c.queue[1:]
-		} else {
-			c.stats.Queued++
+	if queue && c.capacity > 0 && (c.config.QueuePolicy == QueuePolicyDropOldest || !c.full()) {
+		c.queue.Push(m)
+		c.setQueued()
+		c.persist()
+	}
+
+	if c.config.OnPublish != nil {
+		c.config.OnPublish(c.id, m, n)
+	}
+	return
+}
+
+// Send passes m to the subscriber e without blocking and releases the subscriber. It
+// returns 1 if the subscriber received m, 0 if it was not ready.
+func (c *channel) send(e *list.Element, m *Message) int {
+	client := e.Value.(chan *Message)
+	defer close(client)
+	select {
+	case client <- m:
+		return 1
+	default:
+	}
+	return 0
+}
+
+// Allow reports whether a message may be published to this channel without
+// exceeding the MaxPublishRate configuration option. The rate is enforced using
+// a token bucket holding at most MaxPublishRate tokens, which is refilled
+// continuously at MaxPublishRate tokens per second. A token is consumed on
+// every allowed publish.
+func (c *channel) Allow() bool {
+	rate := float64(c.config.MaxPublishRate)
+	if rate <= 0 {
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Nanoseconds()
+	if c.refilled == 0 {
+		c.tokens = rate
+	} else {
+		c.tokens += rate * float64(now-c.refilled) / 1e9
+		if c.tokens > rate {
+			c.tokens = rate
 		}
-		c.queue = append(c.queue, m)
 	}
+	c.refilled = now
 
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// Prune drops the queued messages that have outlived the MessageTTL
+// configuration option.
+func (c *channel) Prune() {
+	c.lock.Lock()
+	c.prune()
+	c.lock.Unlock()
+}
+
+func (c *channel) prune() {
+	if c.config.MessageTTL <= 0 {
+		return
+	}
+
+	// the queue is oldest first, so the expired messages are at the front
+	limit := time.Nanoseconds() - c.config.MessageTTL
+	i := 0
+	for i < c.queue.Len() && c.queue.At(i).time < limit {
+		i++
+	}
+	if i > 0 {
+		c.queue.Drop(i)
+		c.setQueued()
+		c.persist()
+	}
+}
+
+// QueuedAfter returns the queued messages following the position given by since, etag and
+// seq (see Subscribe), except those in served (see find), up to the first message with a
+// non-200 status. They are accounted as delivered.
+func (c *channel) queuedAfter(since int64, etag int, seq int64, served []int64) (msgs []*Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i := 0; i < c.queue.Len(); i++ {
+		m := c.queue.At(i)
+		if !m.follows(since, etag, seq) || isServed(served, m.seq) {
+			continue
+		}
+		if m.Status != http.StatusOK {
+			break
+		}
+		c.statsLock.Lock()
+		c.stats.Delivered++
+		c.stats.BytesDelivered += int64(len(m.Payload))
+		c.statsLock.Unlock()
+		c.countDelivered(1)
+		msgs = append(msgs, m)
+	}
 	return
 }
 
-// Unsubscribe removes the given subscriber from subscribers.
+// SubscriberCount returns the amount of active subscribers.
+func (c *channel) SubscriberCount() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.subscribers.Len()
+}
+
+// Clear drops all queued messages. The last message and the active subscribers
+// are left intact.
+func (c *channel) Clear() {
+	c.lock.Lock()
+	c.queue.Clear()
+	c.setQueued()
+	c.persist()
+	c.lock.Unlock()
+}
+
+// Unsubscribe removes the given subscriber from subscribers. Subscribers already
+// released by a published message are left alone.
 func (c *channel) Unsubscribe(elem *list.Element) {
+	defer c.announce()
 	c.lock.Lock()
-	close(elem.Value.(chan *Message))
-	c.subscribers.Remove(elem)
-	c.stats.Subscribers = c.subscribers.Len()
+	defer c.lock.Unlock()
+	for e := c.subscribers.Front(); e != nil; e = e.Next() {
+		if e == elem {
+			close(elem.Value.(chan *Message))
+			c.subscribers.Remove(elem)
+			c.unpark(1)
+			c.statsLock.Lock()
+			c.stats.Subscribers = c.subscribers.Len()
+			c.statsLock.Unlock()
+			c.countSubscribers()
+			return
+		}
+	}
+}
+
+// ErrCanceled is returned by Receive when the wait was canceled.
+var ErrCanceled = os.NewError("pusher: receive canceled")
+
+// Receive returns the message requested by the If-Modified-Since (in ns) and Etag
+// arguments, waiting until one is published if none is available, regardless of the
+// polling mechanism. Closing cancel (or sending to it) gives up the wait, in which case
+// ErrCanceled is returned and the subscription is removed. A nil cancel waits forever.
+//
+// Like for subscribers of the handlers, the returned message might be a 409 Conflict,
+// 410 Gone or 503 Service Unavailable message depending on the configuration options.
+func (c *channel) Receive(since int64, etag int, cancel <-chan struct{}) (*Message, os.Error) {
+	for {
+		sub, message := c.subscribe(since, etag, 0, nil, true)
+		if sub != nil {
+			select {
+			case message = <-sub.Value.(chan *Message):
+			case <-cancel:
+				c.Unsubscribe(sub)
+				return nil, ErrCanceled
+			}
+		}
+		if message != nil {
+			return message, nil
+		}
+		// the subscriber was not ready when the message was published, try again
+	}
+	panic("unreachable")
+}
+
+// Close releases the active subscribers with gone, a 410 Gone message. Every later
+// subscriber receives it immediately instead of being parked, so that nobody can be left
+// waiting in a channel that has been deleted, garbage collected or whose pusher has been
+// closed, even if it was looked up before.
+func (c *channel) close(gone *Message) {
+	defer c.announce()
+	now := time.Nanoseconds()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gone = gone
+	// the queue is gone along with the channel as far as the pusher is concerned
+	c.memory.add(-c.stats.QueuedBytes)
+	c.publish(gone, false, now)
+}
+
+// Find returns the queued message requested by the arguments (see Subscribe), or nil if
+// there is none. Of the messages published after the requested position, except those in
+// served, the one with the highest priority is returned and ties are broken by time, oldest
+// first. So without priorities, it is the oldest message after the position. The skipped
+// messages of lower priority stay after the position of the subscriber, see position.
+func (c *channel) find(since int64, etag int, seq int64, served []int64) (found *Message) {
+	for i := 0; i < c.queue.Len(); i++ {
+		m := c.queue.At(i)
+		if m.follows(since, etag, seq) && !isServed(served, m.seq) {
+			if found == nil || m.Priority > found.Priority {
+				found = m
+			}
+		}
+	}
+	return
+}
+
+// IsServed reports whether seq is one of served.
+func isServed(served []int64, seq int64) bool {
+	for _, s := range served {
+		if s == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// Position returns the position a subscriber moves on to once it has received m along with
+// the messages in served, all of which follow the position given by since, etag and seq (see
+// Subscribe). It is the newest message up to which the subscriber has received every queued
+// message, or nil if an older message of lower priority is still to be received, in which
+// case the position stays the same. The sequence numbers in served beyond the position are
+// returned as well, see find.
+func (c *channel) position(since int64, etag int, seq int64, served []int64, m *Message) (pos *Message, rest []int64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	caughtUp := true
+	for i := 0; i < c.queue.Len(); i++ {
+		q := c.queue.At(i)
+		if !q.follows(since, etag, seq) {
+			continue
+		}
+		if !isServed(served, q.seq) {
+			caughtUp = false
+			break
+		}
+		pos = q
+	}
+	// m may not have been queued
+	if caughtUp && (pos == nil || m.seq > pos.seq) {
+		pos = m
+	}
+
+	for _, s := range served {
+		if pos == nil || s > pos.seq {
+			rest = append(rest, s)
+		}
+	}
+	return
+}
+
+// Available works like available, but skips none of the queued messages.
+func (c *channel) Available(since int64, etag int, seq int64) *Message {
+	return c.available(since, etag, seq, nil)
+}
+
+// Available returns the message a subscriber with the given arguments (see subscribe)
+// would be served immediately, or nil if there is none. The messages in served are
+// skipped, see find. Unlike subscribe, it neither registers a subscriber nor counts
+// the message as delivered.
+func (c *channel) available(since int64, etag int, seq int64, served []int64) *Message {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.statsLock.Lock()
+	c.stats.LastRequested = time.Seconds()
+	if c.stats.FirstRequested == 0 {
+		c.stats.FirstRequested = c.stats.LastRequested
+	}
+	c.statsLock.Unlock()
+	c.prune()
+	return c.find(since, etag, seq, served)
+}
+
+// Recall takes back the delivery of m to a subscriber, which received it but gave it up
+// without handing it on, so that m is not counted twice once it is served again.
+func (c *channel) recall(m *Message) {
+	c.lock.Lock()
+	c.statsLock.Lock()
+	c.stats.Delivered--
+	c.stats.BytesDelivered -= int64(len(m.Payload))
+	c.statsLock.Unlock()
+	c.countDelivered(-1)
 	c.lock.Unlock()
 }
 
-// Subscribe registers a new subscriber. It takes If-Modified-Since and Etag
-// arguments to determine the requested message. If a suitable message is
-// immediately available (or a conflict has occured), only the message will be
-// returned. If the interval polling mechanism is used, it will return
-// immediately but with zero'd return values. Otherwise a list.Element is
-// returned, whose value is a channel of *Message type, that might eventually
-// receive the desired message.
-func (c *channel) Subscribe(since int64, etag int) (*list.Element, *Message) {
+// Subscribe works like subscribe, but skips none of the queued messages and parks the
+// subscriber only if the long-polling mechanism is used. With the interval polling
+// mechanism it returns immediately, but with zero'd return values if no suitable message
+// is available.
+func (c *channel) Subscribe(since int64, etag int, seq int64) (*list.Element, *Message) {
+	return c.subscribe(since, etag, seq, nil, c.config.PollingMechanism == PollingMechanismLong)
+}
+
+// Subscribe registers a new subscriber. It takes If-Modified-Since (in ns) and Etag
+// arguments to determine the requested message. Alternatively a non-zero sequence number
+// can be given, in which case the oldest message published after the message with that
+// sequence number is requested, regardless of since and etag. The messages in served are
+// skipped and queued messages of a higher priority are preferred, see find.
+//
+// If a suitable message is immediately available (or a conflict has occured, or the
+// channel already has MaxSubscribersPerChannel subscribers, or the pusher already has
+// MaxConcurrentSubscribers parked subscribers), only the message will be returned.
+// Otherwise, if park is set, a list.Element is returned, whose value is a channel of
+// *Message type, that might eventually receive the desired message.
+//
+// The OnSubscribe configuration option is called before returning, while still holding
+// the lock. The subscription is immediate unless the subscriber was parked.
+func (c *channel) subscribe(since int64, etag int, seq int64, served []int64, park bool) (elem *list.Element, message *Message) {
+	defer c.announce()
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	if c.config.OnSubscribe != nil {
+		defer func() {
+			c.config.OnSubscribe(c.id, elem == nil)
+		}()
+	}
 
+	if c.gone != nil {
+		return nil, c.gone
+	}
+
+	c.statsLock.Lock()
 	c.stats.LastRequested = time.Seconds()
+	if c.stats.FirstRequested == 0 {
+		c.stats.FirstRequested = c.stats.LastRequested
+	}
+	c.statsLock.Unlock()
+	c.prune()
 
 	switch c.config.ConcurrencyMode {
 	case ConcurrencyModeLIFO:
-		c.publish(conflictMessage, false)
+		c.publish(c.config.synthetic(conflictMessage), false, time.Nanoseconds())
 	case ConcurrencyModeFILO:
 		if c.stats.Subscribers > 0 {
-			return nil, conflictMessage
+			return nil, c.config.synthetic(occupiedMessage)
 		}
 	}
 
-	for _, m := range c.queue {
-		if m.time >= since {
-			if m.time == since && m.etag <= etag {
-				continue
-			}
+	// waiting subscribers of exclusive channels are not served from the queue
+	if c.config.ConcurrencyMode != ConcurrencyModeExclusive || c.subscribers.Len() == 0 {
+		if m := c.find(since, etag, seq, served); m != nil {
+			c.statsLock.Lock()
 			c.stats.Delivered++
+			c.stats.BytesDelivered += int64(len(m.Payload))
+			c.statsLock.Unlock()
+			c.countDelivered(1)
 			return nil, m
 		}
 	}
 
-	if c.config.PollingMechanism == PollingMechanismInterval {
+	if !park {
 		return nil, nil
 	}
 
+	if max := c.config.MaxSubscribersPerChannel; max > 0 && c.stats.Subscribers >= max {
+		return nil, unavailableMessage
+	}
+	if c.parked != nil {
+		// the slot is taken first, so that concurrent subscribers can not exceed the limit
+		n := atomic.AddInt32(c.parked, 1)
+		if max := c.config.MaxConcurrentSubscribers; max > 0 && n > int32(max) {
+			atomic.AddInt32(c.parked, -1)
+			return nil, overloadedMessage
+		}
+	}
+
 	ch := make(chan *Message, 0)
-	elem := c.subscribers.PushBack((chan *Message)(ch))
+	elem = c.subscribers.PushBack((chan *Message)(ch))
+	c.statsLock.Lock()
 	c.stats.Subscribers++
+	if c.stats.Subscribers > c.stats.PeakSubscribers {
+		c.stats.PeakSubscribers = c.stats.Subscribers
+	}
+	c.statsLock.Unlock()
+	c.countSubscribers()
 	return elem, nil
 }
+
+// Unpark releases the slots of n subscribers that are no longer parked, see
+// MaxConcurrentSubscribers. The caller must hold the write lock.
+func (c *channel) unpark(n int) {
+	if c.parked != nil && n != 0 {
+		atomic.AddInt32(c.parked, int32(-n))
+	}
+}
+
+// CountDelivered reports n deliveries (or n recalled ones if negative) to the Metrics
+// configuration option, if set. The caller must hold the write lock.
+func (c *channel) countDelivered(n int) {
+	if c.config.Metrics != nil && n != 0 {
+		c.config.Metrics.IncDelivered(c.id, n)
+	}
+}
+
+// CountSubscribers reports the amount of active subscribers to the Metrics configuration
+// option, if set. The caller must hold the write lock.
+func (c *channel) countSubscribers() {
+	if c.config.Metrics != nil {
+		c.config.Metrics.SetSubscribers(c.id, c.subscribers.Len())
+	}
+}
@@ -1,8 +1,18 @@
 package pusher
 
 import (
+	"fmt"
+	"http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+	"xml"
 )
 
 var intervalConf = Configuration{
@@ -18,12 +28,12 @@ var longConf = Configuration{
 // Empty channel tests
 func TestEmptyChannel(t *testing.T) {
 	channel := newChannel("test", &intervalConf)
-	if e, m := channel.Subscribe(0, 0); e != nil || m != nil {
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != nil {
 		t.Error("Expected nothing (1)")
 	}
 	tm1 := &Message{Status: 1, ContentType: "tm1.ctype", Payload: []byte("tm1.payload")}
 	channel.Publish(tm1, false)
-	if e, m := channel.Subscribe(0, 0); e != nil || m != nil {
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != nil {
 		t.Error("Expected nothing (2)")
 	}
 
@@ -41,10 +51,10 @@ func TestSimpleChannel(t *testing.T) {
 	channel := newChannel("test", &intervalConf)
 	tm1 := &Message{Status: 1, ContentType: "tm1.ctype", Payload: []byte("tm1.payload")}
 	channel.Publish(tm1, true)
-	if e, m := channel.Subscribe(0, 0); e != nil || m != tm1 {
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != tm1 {
 		t.Error("Expected tm1 (1)")
 	}
-	if e, m := channel.Subscribe(0, 0); e != nil || m != tm1 {
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != tm1 {
 		t.Error("Expected tm1 (2)")
 	}
 	if tm1.etag != 0 || tm1.time == 0 {
@@ -60,15 +70,15 @@ func TestMediumChannel(t *testing.T) {
 
 	channel.Publish(tm1, true)
 	channel.Publish(tm2, true)
-	if e, m := channel.Subscribe(0, 0); e != nil || m != tm1 {
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != tm1 {
 		t.Error("Expected tm1 (1)")
 	}
-	if e, m := channel.Subscribe(tm1.time, tm1.etag); e != nil || m != tm2 {
+	if e, m := channel.Subscribe(tm1.time, tm1.etag, 0); e != nil || m != tm2 {
 		t.Error("Expected tm2 (1)")
 	}
 
 	// drained
-	if e, m := channel.Subscribe(tm2.time, tm2.etag); e != nil || m != nil {
+	if e, m := channel.Subscribe(tm2.time, tm2.etag, 0); e != nil || m != nil {
 		t.Error("Expected nothing")
 	}
 
@@ -79,15 +89,15 @@ func TestMediumChannel(t *testing.T) {
 	tm2 = &Message{Status: 2, ContentType: "tm2.ctype", Payload: []byte("tm2.payload")}
 	channel.Publish(tm1, true)
 	channel.Publish(tm2, true)
-	if e, m := channel.Subscribe(time, etag); e != nil || m != tm1 {
+	if e, m := channel.Subscribe(time, etag, 0); e != nil || m != tm1 {
 		t.Errorf("Expected tm1 (2) %#v", m)
 	}
-	if e, m := channel.Subscribe(tm1.time, tm1.etag); e != nil || m != tm2 {
+	if e, m := channel.Subscribe(tm1.time, tm1.etag, 0); e != nil || m != tm2 {
 		t.Error("Expected tm2 (2)")
 	}
 
 	// drained
-	if e, m := channel.Subscribe(tm2.time, tm2.etag); e != nil || m != nil {
+	if e, m := channel.Subscribe(tm2.time, tm2.etag, 0); e != nil || m != nil {
 		t.Error("Expected nothing")
 	}
 }
@@ -104,21 +114,21 @@ func TestFullChannel(t *testing.T) {
 	channel.Publish(tm2, true)
 	channel.Publish(tm3, true)
 	channel.Publish(tm4, true)
-	if e, m := channel.Subscribe(0, 0); e != nil || m != tm2 {
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != tm2 {
 		t.Error("Expected tm2 (1)")
 	}
-	if e, m := channel.Subscribe(tm2.time, tm2.etag); e != nil || m != tm3 {
+	if e, m := channel.Subscribe(tm2.time, tm2.etag, 0); e != nil || m != tm3 {
 		t.Error("Expected tm3 (1)")
 	}
-	if e, m := channel.Subscribe(tm3.time, tm3.etag); e != nil || m != tm4 {
+	if e, m := channel.Subscribe(tm3.time, tm3.etag, 0); e != nil || m != tm4 {
 		t.Error("Expected tm3 (1)")
 	}
-	if e, m := channel.Subscribe(tm3.time, tm3.etag); e != nil || m != tm4 {
+	if e, m := channel.Subscribe(tm3.time, tm3.etag, 0); e != nil || m != tm4 {
 		t.Error("Expected tm3 (2)")
 	}
 
 	// drained
-	if e, m := channel.Subscribe(tm4.time, tm4.etag); e != nil || m != nil {
+	if e, m := channel.Subscribe(tm4.time, tm4.etag, 0); e != nil || m != nil {
 		t.Error("Expected nothing")
 	}
 
@@ -139,7 +149,7 @@ func TestLongSimpleChannel(t *testing.T) {
 		time.Sleep(1e9 / 2)
 		channel.Publish(tm1, true)
 	}()
-	if e, m := channel.Subscribe(0, 0); e == nil || m != nil {
+	if e, m := channel.Subscribe(0, 0, 0); e == nil || m != nil {
 		t.Error("Expected channel")
 	} else {
 		m = <-e.Value.(chan *Message)
@@ -147,7 +157,7 @@ func TestLongSimpleChannel(t *testing.T) {
 			t.Error("Expected tm1 (1)")
 		}
 	}
-	if e, m := channel.Subscribe(0, 0); e != nil || m != tm1 {
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != tm1 {
 		t.Error("Expected tm1 (2)")
 	}
 }
@@ -168,7 +178,7 @@ func TestLongMediumChannel(t *testing.T) {
 		channel.Publish(tm2, true)
 	}()
 
-	if e, m := channel.Subscribe(0, 0); e == nil || m != nil {
+	if e, m := channel.Subscribe(0, 0, 0); e == nil || m != nil {
 		t.Error("Expected channel")
 	} else {
 		m = <-e.Value.(chan *Message)
@@ -176,11 +186,11 @@ func TestLongMediumChannel(t *testing.T) {
 			t.Error("Expected tm1 (1)")
 		}
 	}
-	if e, m := channel.Subscribe(0, 0); e != nil || m != tm1 {
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != tm1 {
 		t.Error("Expected tm1 (2)")
 	}
 
-	if e, m := channel.Subscribe(tm1.time, tm1.etag); e == nil || m != nil {
+	if e, m := channel.Subscribe(tm1.time, tm1.etag, 0); e == nil || m != nil {
 		t.Error("Expected channel")
 	} else {
 		m = <-e.Value.(chan *Message)
@@ -188,7 +198,7 @@ func TestLongMediumChannel(t *testing.T) {
 			t.Error("Expected tm2 (1)")
 		}
 	}
-	if e, m := channel.Subscribe(tm1.time, tm1.etag); e != nil || m != tm2 {
+	if e, m := channel.Subscribe(tm1.time, tm1.etag, 0); e != nil || m != tm2 {
 		t.Error("Expected tm2 (2)")
 	}
 
@@ -205,3 +215,922 @@ func TestLongMediumChannel(t *testing.T) {
 		t.Errorf("Invalid counters %#v", s)
 	}
 }
+
+// sequence number tests
+func TestSequenceChannel(t *testing.T) {
+	channel := newChannel("test", &intervalConf)
+	tm1 := &Message{Status: 1, ContentType: "tm1.ctype", Payload: []byte("tm1.payload")}
+	tm2 := &Message{Status: 2, ContentType: "tm2.ctype", Payload: []byte("tm2.payload")}
+	tm3 := &Message{Status: 3, ContentType: "tm3.ctype", Payload: []byte("tm3.payload")}
+	tm4 := &Message{Status: 4, ContentType: "tm4.ctype", Payload: []byte("tm4.payload")}
+	tm5 := &Message{Status: 5, ContentType: "tm5.ctype", Payload: []byte("tm5.payload")}
+
+	channel.Publish(tm1, true)
+	channel.Publish(tm2, true)
+	channel.Publish(tm3, true)
+	if tm1.seq != 1 || tm2.seq != 2 || tm3.seq != 3 {
+		t.Errorf("Invalid sequence numbers %d, %d, %d", tm1.seq, tm2.seq, tm3.seq)
+	}
+
+	// since and etag are ignored
+	if e, m := channel.Subscribe(tm3.time, tm3.etag, tm1.seq); e != nil || m != tm2 {
+		t.Error("Expected tm2")
+	}
+	if e, m := channel.Subscribe(0, 0, tm2.seq); e != nil || m != tm3 {
+		t.Error("Expected tm3")
+	}
+	if e, m := channel.Subscribe(0, 0, tm3.seq); e != nil || m != nil {
+		t.Error("Expected nothing")
+	}
+
+	// replay after a gap, tm1 and tm2 were evicted
+	channel.Publish(tm4, true)
+	channel.Publish(tm5, true)
+	if e, m := channel.Subscribe(0, 0, tm1.seq); e != nil || m != tm3 {
+		t.Error("Expected tm3 after a gap")
+	}
+	if e, m := channel.Subscribe(0, 0, tm3.seq); e != nil || m != tm4 {
+		t.Error("Expected tm4 after a gap")
+	}
+	if e, m := channel.Subscribe(0, 0, tm4.seq); e != nil || m != tm5 {
+		t.Error("Expected tm5 after a gap")
+	}
+}
+
+// same second tests
+func TestSameSecondChannel(t *testing.T) {
+	channel := newChannel("test", &intervalConf)
+	tm1 := &Message{Status: 1, ContentType: "tm1.ctype", Payload: []byte("tm1.payload")}
+	tm2 := &Message{Status: 2, ContentType: "tm2.ctype", Payload: []byte("tm2.payload")}
+	tm3 := &Message{Status: 3, ContentType: "tm3.ctype", Payload: []byte("tm3.payload")}
+
+	// start at the beginning of a second
+	time.Sleep(1e9 - time.Nanoseconds()%1e9)
+	channel.Publish(tm1, true)
+	channel.Publish(conflictMessage, false)
+	channel.Publish(tm2, true)
+	channel.Publish(tm3, true)
+	if tm1.time/1e9 != tm3.time/1e9 || tm1.time >= tm2.time || tm2.time >= tm3.time {
+		t.Fatalf("Invalid times %d, %d, %d", tm1.time, tm2.time, tm3.time)
+	}
+	// the conflict is not sequenced, so it takes no etag
+	if tm1.etag != 0 || tm2.etag != 1 || tm3.etag != 2 {
+		t.Errorf("Invalid etags %d, %d, %d", tm1.etag, tm2.etag, tm3.etag)
+	}
+
+	// If-Modified-Since has a resolution of a second
+	since := tm1.time / 1e9 * 1e9
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != tm1 {
+		t.Error("Expected tm1")
+	}
+	if e, m := channel.Subscribe(since, tm1.etag, 0); e != nil || m != tm2 {
+		t.Error("Expected tm2")
+	}
+	if e, m := channel.Subscribe(since, tm2.etag, 0); e != nil || m != tm3 {
+		t.Error("Expected tm3")
+	}
+	if e, m := channel.Subscribe(since, tm3.etag, 0); e != nil || m != nil {
+		t.Error("Expected nothing")
+	}
+}
+
+// plain stats tests
+func TestPlainStats(t *testing.T) {
+	channel := newChannel("test", &intervalConf)
+	channel.Subscribe(0, 0, 0)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/pub", nil)
+	if err := channel.writeStats(rw, req); err != nil {
+		t.Fatal(err)
+	}
+	body := rw.Body.String()
+	if !strings.Contains(body, "last requested: 0 sec. ago") {
+		t.Errorf("Invalid last requested in %q", body)
+	}
+	if !strings.Contains(body, "last published: -1 sec. ago") {
+		t.Errorf("Invalid last published in %q", body)
+	}
+}
+
+// xml stats tests
+func TestXMLStats(t *testing.T) {
+	channel := newChannel("test", &intervalConf)
+	channel.PublishString("hello", true)
+	channel.PublishString("world", true)
+	channel.Subscribe(0, 0, 0)
+
+	for _, accept := range []string{"application/xml", "text/xml"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/pub", nil)
+		req.Header.Set("Accept", accept)
+		if err := channel.writeStats(rw, req); err != nil {
+			t.Fatal(err)
+		}
+		if ctype := rw.HeaderMap.Get("Content-Type"); ctype != accept {
+			t.Errorf("Invalid content-type %q", ctype)
+		}
+
+		var stats struct {
+			Queued        int
+			LastRequested int64
+			LastPublished int64
+			Subscribers   int
+			Published     int64
+			Delivered     int64
+		}
+		if err := xml.Unmarshal(rw.Body, &stats); err != nil {
+			t.Fatalf("Invalid xml %q: %s", rw.Body.String(), err)
+		}
+		s := channel.Stats()
+		if stats.Queued != 2 || stats.Published != 2 || stats.Delivered != 1 || stats.Subscribers != 0 ||
+			stats.LastRequested != s.LastRequested || stats.LastPublished != s.LastPublished {
+			t.Errorf("Invalid stats %#v", stats)
+		}
+	}
+}
+
+// custom stat encoder tests
+func TestStatEncoder(t *testing.T) {
+	RegisterStatEncoder("x-custom", func(w io.Writer, stats Stats) os.Error {
+		_, err := fmt.Fprintf(w, "published=%d", stats.Published)
+		return err
+	})
+	defer func() {
+		statEncoders["x-custom"] = nil, false
+	}()
+
+	channel := newChannel("test", &intervalConf)
+	channel.PublishString("hello", true)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/pub", nil)
+	req.Header.Set("Accept", "application/x-custom")
+	if err := channel.writeStats(rw, req); err != nil {
+		t.Fatal(err)
+	}
+	if ctype := rw.HeaderMap.Get("Content-Type"); ctype != "application/x-custom" {
+		t.Errorf("Invalid content-type %q", ctype)
+	}
+	if body := rw.Body.String(); body != "published=1" {
+		t.Errorf("Invalid body %q", body)
+	}
+
+	// the built-in formats are still available
+	rw = httptest.NewRecorder()
+	req.Header.Set("Accept", "application/json")
+	channel.writeStats(rw, req)
+	if body := rw.Body.String(); !strings.HasPrefix(body, `{"queued":1,`) {
+		t.Errorf("Invalid json body %q", body)
+	}
+}
+
+// byte counter tests
+func TestBytesStats(t *testing.T) {
+	channel := newChannel("test", &longConf)
+	done := make(chan bool)
+	go func() {
+		e, _ := channel.Subscribe(0, 0, 0)
+		<-e.Value.(chan *Message)
+		done <- true
+	}()
+	time.Sleep(1e9 / 4)
+
+	channel.PublishString("12345", true) // delivered live
+	<-done
+	channel.PublishString("1234567890", true)
+	channel.PublishString("", true)
+	channel.Subscribe(0, 0, 0) // delivers the first from the queue
+
+	s := channel.Stats()
+	if s.BytesPublished != 15 || s.BytesDelivered != 10 || s.Delivered != 2 {
+		t.Errorf("Invalid byte counters %#v", s)
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/pub", nil)
+	req.Header.Set("Accept", "application/json")
+	channel.writeStats(rw, req)
+	if body := rw.Body.String(); !strings.Contains(body, `"bytesPublished":15,"bytesDelivered":10,`) {
+		t.Errorf("Invalid json body %q", body)
+	}
+}
+
+// accept negotiation tests
+func TestAcceptedStatType(t *testing.T) {
+	available := func(subtype string) bool {
+		return statFormats[subtype] != ""
+	}
+	tests := []struct {
+		accept, expected string
+	}{
+		{"", "text/plain"},
+		{"application/json", "application/json"},
+		{"text/xml", "text/xml"},
+		{"application/json;q=0.9, text/plain;q=0.1", "application/json"},
+		{"text/plain;q=0.1, application/json;q=0.9", "application/json"},
+		{"image/png, application/x-unknown, text/xml;q=0.5", "text/xml"},
+		{"application/xml, application/json", "application/xml"},
+		{"application/json;q=0, application/xml;q=0.2", "application/xml"},
+		{"text/html, application/*;q=0.8", "application/json"},
+		{"text/html, */*;q=0.1", "text/plain"},
+		{"text/*", "text/plain"},
+		{"garbage", "text/plain"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "http://localhost/pub", nil)
+		req.Header.Set("Accept", test.accept)
+		if typ, subtype := acceptedStatType(req, available); typ+"/"+subtype != test.expected {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.accept, typ+"/"+subtype)
+		}
+	}
+}
+
+// timestamped json stats tests
+func TestTimestampedStats(t *testing.T) {
+	channel := newChannel("test", &intervalConf)
+	channel.PublishString("hello", true)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost/pub", nil)
+	req.Header.Set("Accept", "application/vnd.pusher+json")
+	if err := channel.writeStats(rw, req); err != nil {
+		t.Fatal(err)
+	}
+	if ctype := rw.HeaderMap.Get("Content-Type"); ctype != "application/vnd.pusher+json" {
+		t.Errorf("Invalid content-type %q", ctype)
+	}
+
+	var stats map[string]interface{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Invalid json %q: %s", rw.Body.String(), err)
+	}
+	for _, field := range []string{"created", "lastPublished"} {
+		stamp, _ := stats[field].(string)
+		if _, err := time.Parse(time.RFC3339, stamp); err != nil {
+			t.Errorf("Invalid %s %q: %s", field, stamp, err)
+		}
+	}
+	if stats["lastRequested"] != "" {
+		t.Errorf("Expected empty lastRequested, got %#v", stats["lastRequested"])
+	}
+	if stats["published"] != float64(1) || stats["queued"] != float64(1) {
+		t.Errorf("Invalid counters %#v", stats)
+	}
+}
+
+// peak subscribers tests
+func TestPeakSubscribers(t *testing.T) {
+	channel := newChannel("test", &longConf)
+	e1, _ := channel.Subscribe(0, 0, 0)
+	e2, _ := channel.Subscribe(0, 0, 0)
+	e3, _ := channel.Subscribe(0, 0, 0)
+	channel.Unsubscribe(e1)
+	channel.Unsubscribe(e2)
+	e4, _ := channel.Subscribe(0, 0, 0)
+	channel.Unsubscribe(e3)
+	channel.Unsubscribe(e4)
+
+	if s := channel.Stats(); s.Subscribers != 0 || s.PeakSubscribers != 3 {
+		t.Errorf("Invalid subscriber counters %#v", s)
+	}
+}
+
+// message ttl tests
+func TestMessageTTL(t *testing.T) {
+	channel := newChannel("test", &Configuration{ChannelCapacity: 3, MessageTTL: 1e8})
+	tm1 := &Message{Status: 1, ContentType: "tm1.ctype", Payload: []byte("tm1.payload")}
+	tm2 := &Message{Status: 2, ContentType: "tm2.ctype", Payload: []byte("tm2.payload")}
+
+	channel.Publish(tm1, true)
+	time.Sleep(2e8)
+	channel.Publish(tm2, true)
+
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != tm2 {
+		t.Error("Expected tm2")
+	}
+	time.Sleep(2e8)
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m != nil {
+		t.Error("Expected nothing")
+	}
+
+	if s := channel.Stats(); s.Queued != 0 || s.Delivered != 1 || s.Published != 2 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+}
+
+// persistence tests
+func TestPersistedChannel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := Configuration{ChannelCapacity: 3, PollingMechanism: PollingMechanismInterval, Persister: NewFilePersister(dir)}
+	channel := newChannel("test/../channel", &conf)
+	tm1 := &Message{Status: 1, ContentType: "tm1.ctype", Payload: []byte("tm1.payload")}
+	tm2 := &Message{Status: 2, ContentType: "tm2.ctype", Payload: []byte("tm2.payload")}
+	channel.Publish(tm1, true)
+	channel.Publish(tm2, true)
+	channel.save()
+
+	// round-trip
+	msgs, err := conf.Persister.Load("test/../channel")
+	if err != nil || len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	for i, m := range []*Message{tm1, tm2} {
+		if string(msgs[i].Payload) != string(m.Payload) || msgs[i].ContentType != m.ContentType ||
+			msgs[i].Status != m.Status || msgs[i].time != m.time || msgs[i].etag != m.etag || msgs[i].seq != m.seq {
+			t.Errorf("Invalid message %d %#v", i, msgs[i])
+		}
+	}
+
+	// a reloaded channel replays the messages
+	channel = newChannel("test/../channel", &conf)
+	if e, m := channel.Subscribe(0, 0, 0); e != nil || m == nil || string(m.Payload) != "tm1.payload" {
+		t.Error("Expected tm1")
+	}
+	if e, m := channel.Subscribe(tm1.time, tm1.etag, 0); e != nil || m == nil || string(m.Payload) != "tm2.payload" {
+		t.Error("Expected tm2")
+	}
+	tm3 := &Message{Status: 3, ContentType: "tm3.ctype", Payload: []byte("tm3.payload")}
+	channel.Publish(tm3, true)
+	if tm3.seq != tm2.seq+1 {
+		t.Errorf("Invalid sequence number %d", tm3.seq)
+	}
+	if s := channel.Stats(); s.Queued != 3 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+
+	// unknown channels have nothing stored
+	if msgs, err := conf.Persister.Load("unknown"); err != nil || msgs != nil {
+		t.Errorf("Expected nothing, got %#v %v", msgs, err)
+	}
+
+	// deleted channels have nothing stored either
+	channel.unpersist()
+	channel.Publish(tm3, true)
+	channel.save()
+	if msgs, err := conf.Persister.Load("test/../channel"); err != nil || msgs != nil {
+		t.Errorf("Expected nothing, got %#v %v", msgs, err)
+	}
+}
+
+// publish and subscribe hook tests
+func TestPublishSubscribeHooks(t *testing.T) {
+	var delivered []int
+	var immediate []bool
+	conf := longConf
+	conf.OnPublish = func(cid string, m *Message, n int) {
+		if cid != "test" || m == nil {
+			t.Errorf("Invalid publish %q %v", cid, m)
+		}
+		delivered = append(delivered, n)
+	}
+	conf.OnSubscribe = func(cid string, i bool) {
+		immediate = append(immediate, i)
+	}
+	channel := newChannel("test", &conf)
+
+	channel.PublishString("first", true)
+
+	sub, _ := channel.Subscribe(time.Seconds()*1e9+1e9, 0, 0)
+	done := make(chan bool)
+	go func() {
+		<-sub.Value.(chan *Message)
+		done <- true
+	}()
+	time.Sleep(1e9 / 10)
+	channel.PublishString("second", true)
+	<-done
+
+	channel.Subscribe(0, 0, 0)
+
+	if len(delivered) != 2 || delivered[0] != 0 || delivered[1] != 1 {
+		t.Errorf("Invalid delivery counts %v", delivered)
+	}
+	if len(immediate) != 2 || immediate[0] || !immediate[1] {
+		t.Errorf("Invalid subscriptions %v", immediate)
+	}
+}
+
+// clear tests
+func TestClearChannel(t *testing.T) {
+	channel := newChannel("test", &intervalConf)
+	channel.PublishString("first", true)
+	channel.PublishString("second", true)
+	last := channel.lastMessage
+
+	channel.Clear()
+	if s := channel.Stats(); s.Queued != 0 || s.Published != 2 || channel.lastMessage != last {
+		t.Errorf("Invalid counters %#v", s)
+	}
+	if _, m := channel.Subscribe(0, 0, 0); m != nil {
+		t.Errorf("Expected nothing, got %q", m.Payload)
+	}
+
+	channel.PublishString("third", true)
+	if _, m := channel.Subscribe(0, 0, 0); m == nil || string(m.Payload) != "third" {
+		t.Errorf("Expected third, got %v", m)
+	}
+}
+
+// ring tests
+func TestRing(t *testing.T) {
+	r := newRing(3)
+	msgs := make([]*Message, 5)
+	for i := range msgs {
+		msgs[i] = &Message{Payload: []byte{byte('a' + i)}}
+	}
+
+	for i, m := range msgs {
+		if evicted := r.Push(m); evicted != (i >= 3) {
+			t.Errorf("Invalid eviction when pushing %d", i)
+		}
+	}
+	if r.Len() != 3 || r.At(0) != msgs[2] || r.At(2) != msgs[4] {
+		t.Errorf("Invalid ring %v", r.Slice())
+	}
+
+	r.Drop(2)
+	if r.Len() != 1 || r.At(0) != msgs[4] {
+		t.Errorf("Invalid ring %v", r.Slice())
+	}
+	r.Push(msgs[0])
+	if s := r.Slice(); len(s) != 2 || s[0] != msgs[4] || s[1] != msgs[0] {
+		t.Errorf("Invalid ring %v", s)
+	}
+
+	r.Clear()
+	if r.Len() != 0 || len(r.Slice()) != 0 {
+		t.Errorf("Invalid ring %v", r.Slice())
+	}
+
+	r = newRing(0)
+	if r.Push(msgs[0]) || r.Len() != 0 {
+		t.Errorf("A ring without capacity accepted a message")
+	}
+}
+
+// exclusive mode tests
+func TestExclusiveTakeover(t *testing.T) {
+	channel := newChannel("test", &Configuration{ConcurrencyMode: ConcurrencyModeExclusive, ChannelCapacity: 3})
+	active, _ := channel.Subscribe(0, 0, 0)
+	waiter, _ := channel.Subscribe(0, 0, 0)
+	if active == nil || waiter == nil {
+		t.Fatalf("Expected both subscribers to be parked")
+	}
+
+	received := make(chan *Message)
+	go func() {
+		received <- <-waiter.Value.(chan *Message)
+	}()
+
+	channel.Unsubscribe(active)
+	if n := channel.SubscriberCount(); n != 1 {
+		t.Errorf("Expected 1 subscriber after takeover, got %d", n)
+	}
+
+	time.Sleep(1e7)
+	m := &Message{Status: http.StatusOK, Payload: []byte("hello")}
+	if n := channel.Publish(m, true); n != 1 {
+		t.Errorf("Expected delivery to 1 subscriber, got %d", n)
+	}
+	if got := <-received; got != m {
+		t.Errorf("Expected the waiter to take over, got %v", got)
+	}
+}
+
+func TestExclusiveOrder(t *testing.T) {
+	channel := newChannel("test", &Configuration{ConcurrencyMode: ConcurrencyModeExclusive, ChannelCapacity: 3})
+	received := make(chan string)
+	for i := 0; i < 3; i++ {
+		sub, message := channel.Subscribe(0, 0, 0)
+		if sub == nil || message != nil {
+			t.Fatalf("Expected subscriber %d to be parked", i)
+		}
+		name := fmt.Sprintf("sub%d", i)
+		go func() {
+			if m := <-sub.Value.(chan *Message); m != nil {
+				received <- name + ":" + string(m.Payload)
+			}
+		}()
+	}
+
+	for i, expected := range []string{"sub0:m0", "sub1:m1", "sub2:m2"} {
+		time.Sleep(1e7)
+		channel.PublishString(fmt.Sprintf("m%d", i), true)
+		if got := <-received; got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+		if n, left := channel.SubscriberCount(), 2-i; n != left {
+			t.Errorf("Expected %d waiting subscribers, got %d", left, n)
+		}
+	}
+
+	// the queue is only served to subscribers without predecessors
+	if sub, message := channel.Subscribe(0, 0, 0); sub != nil || message == nil {
+		t.Errorf("Expected an immediate message from the queue")
+	}
+}
+
+func TestExclusiveNotReady(t *testing.T) {
+	channel := newChannel("test", &Configuration{ConcurrencyMode: ConcurrencyModeExclusive, ChannelCapacity: 3})
+	idle, _ := channel.Subscribe(0, 0, 0)
+	ready, _ := channel.Subscribe(0, 0, 0)
+	if idle == nil || ready == nil {
+		t.Fatalf("Expected both subscribers to be parked")
+	}
+
+	received := make(chan *Message)
+	go func() {
+		received <- <-ready.Value.(chan *Message)
+	}()
+	time.Sleep(1e7)
+
+	// the next waiter receives the message the oldest one was not ready for
+	m := &Message{Status: http.StatusOK, Payload: []byte("hello")}
+	if n := channel.Publish(m, false); n != 1 {
+		t.Errorf("Expected delivery to 1 subscriber, got %d", n)
+	}
+	if got := <-received; got != m {
+		t.Errorf("Expected the ready waiter to receive the message, got %v", got)
+	}
+
+	// a message no waiter was ready for is undelivered and only queued if asked to
+	if idle, _ = channel.Subscribe(0, 0, 0); idle == nil {
+		t.Fatalf("Expected the subscriber to be parked")
+	}
+	if n := channel.Publish(&Message{Status: http.StatusOK, Payload: []byte("dropped")}, false); n != 0 {
+		t.Errorf("Expected no delivery, got %d", n)
+	}
+	if s := channel.Stats(); s.Queued != 0 || s.Delivered != 1 {
+		t.Errorf("Expected the message to be dropped, got %#v", s)
+	}
+	if idle, _ = channel.Subscribe(0, 0, 0); idle == nil {
+		t.Fatalf("Expected the subscriber to be parked")
+	}
+	if n := channel.Publish(&Message{Status: http.StatusOK, Payload: []byte("queued")}, true); n != 0 {
+		t.Errorf("Expected no delivery, got %d", n)
+	}
+	if sub, message := channel.Subscribe(0, 0, 0); sub != nil || message == nil || string(message.Payload) != "queued" {
+		t.Errorf("Expected the queued message, got %v", message)
+	}
+}
+
+// receive tests
+func TestReceive(t *testing.T) {
+	channel := newChannel("test", &Configuration{ChannelCapacity: 3})
+	m := &Message{Status: http.StatusOK, Payload: []byte("hello")}
+	go func() {
+		time.Sleep(1e7)
+		channel.Publish(m, true)
+	}()
+
+	if message, err := channel.Receive(0, 0, nil); err != nil || message != m {
+		t.Errorf("Expected the published message, got %v, %v", message, err)
+	}
+	if n := channel.SubscriberCount(); n != 0 {
+		t.Errorf("Expected no subscribers, got %d", n)
+	}
+}
+
+func TestReceiveQueued(t *testing.T) {
+	channel := newChannel("test", &intervalConf)
+	m := &Message{Status: http.StatusOK, Payload: []byte("hello")}
+	channel.Publish(m, true)
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if message, err := channel.Receive(0, 0, cancel); err != nil || message != m {
+		t.Errorf("Expected the queued message, got %v, %v", message, err)
+	}
+}
+
+func TestReceiveCancel(t *testing.T) {
+	channel := newChannel("test", &Configuration{ChannelCapacity: 3})
+	cancel := make(chan struct{})
+	go func() {
+		time.Sleep(1e7)
+		close(cancel)
+	}()
+
+	if message, err := channel.Receive(0, 0, cancel); err != ErrCanceled || message != nil {
+		t.Errorf("Expected ErrCanceled, got %v, %v", message, err)
+	}
+	if n := channel.SubscriberCount(); n != 0 {
+		t.Errorf("Expected the subscription to be removed, got %d subscribers", n)
+	}
+	if n := channel.PublishString("hello", true); n != 0 {
+		t.Errorf("Expected no deliveries after cancel, got %d", n)
+	}
+}
+
+// queue policy tests
+func TestQueuePolicy(t *testing.T) {
+	tests := []struct {
+		policy    int
+		delivered int
+		queued    []string
+	}{
+		{QueuePolicyDropOldest, 1, []string{"m1", "m2"}},
+		{QueuePolicyDropNewest, 1, []string{"m0", "m1"}},
+		{QueuePolicyRejectWhenFull, 0, []string{"m0", "m1"}},
+	}
+	for _, test := range tests {
+		channel := newChannel("test", &Configuration{ChannelCapacity: 2, QueuePolicy: test.policy})
+		channel.PublishString("m0", true)
+		channel.PublishString("m1", true)
+
+		received := make(chan *Message)
+		sub, _ := channel.Subscribe(1<<62, 0, 0)
+		go func() {
+			received <- <-sub.Value.(chan *Message)
+		}()
+		time.Sleep(1e7)
+
+		n, _, err := channel.publishOnce(NewMessage("text/plain", []byte("m2")), true)
+		if n != test.delivered {
+			t.Errorf("Expected %d deliveries with policy %d, got %d", test.delivered, test.policy, n)
+		}
+		if rejected := test.policy == QueuePolicyRejectWhenFull; rejected != (err == ErrQueueFull) {
+			t.Errorf("Unexpected error with policy %d: %v", test.policy, err)
+		}
+		if n == 0 {
+			channel.Unsubscribe(sub)
+		}
+		<-received
+
+		var queued []string
+		for _, m := range channel.queue.Slice() {
+			queued = append(queued, string(m.Payload))
+		}
+		if len(queued) != 2 || queued[0] != test.queued[0] || queued[1] != test.queued[1] {
+			t.Errorf("Expected %q queued with policy %d, got %q", test.queued, test.policy, queued)
+		}
+	}
+}
+
+// delivered count tests
+func TestDeliveredCount(t *testing.T) {
+	channel := newChannel("test", &Configuration{ChannelCapacity: 3})
+	m1 := &Message{Status: http.StatusOK, Payload: []byte("m1")}
+	channel.Publish(m1, true)
+
+	// served from the queue
+	if _, m := channel.Subscribe(0, 0, 0); m != m1 {
+		t.Fatalf("Expected m1, got %v", m)
+	}
+	// only peeked at
+	if m := channel.Available(0, 0, 0); m != m1 {
+		t.Fatalf("Expected m1, got %v", m)
+	}
+
+	// delivered live to two subscribers, one of them not ready
+	received := make(chan *Message)
+	ready, _ := channel.Subscribe(1<<62, 0, 0)
+	channel.Subscribe(1<<62, 0, 0)
+	go func() {
+		received <- <-ready.Value.(chan *Message)
+	}()
+	time.Sleep(1e7)
+	m2 := &Message{Status: http.StatusOK, Payload: []byte("m2")}
+	channel.Publish(m2, true)
+	<-received
+
+	// the subscriber that missed m2 gets it from the queue
+	if _, m := channel.Subscribe(m1.time, m1.etag, 0); m != m2 {
+		t.Fatalf("Expected m2, got %v", m)
+	}
+
+	if s := channel.Stats(); s.Delivered != 3 || s.BytesDelivered != 6 {
+		t.Errorf("Expected 3 deliveries of 6 bytes, got %d of %d", s.Delivered, s.BytesDelivered)
+	}
+
+	channel.recall(m2)
+	if s := channel.Stats(); s.Delivered != 2 || s.BytesDelivered != 4 {
+		t.Errorf("Expected 2 deliveries of 4 bytes, got %d of %d", s.Delivered, s.BytesDelivered)
+	}
+}
+
+// priority tests
+func TestPriority(t *testing.T) {
+	channel := newChannel("test", &Configuration{ChannelCapacity: 5})
+	m0 := &Message{Status: http.StatusOK, Payload: []byte("m0")}
+	low := &Message{Status: http.StatusOK, Payload: []byte("low")}
+	high := &Message{Status: http.StatusOK, Payload: []byte("high"), Priority: 1}
+	later := &Message{Status: http.StatusOK, Payload: []byte("later"), Priority: 1}
+	for _, m := range []*Message{m0, low, high, later} {
+		channel.Publish(m, true)
+	}
+
+	// subscribers catch up urgent messages first, however they give their position
+	if _, m := channel.Subscribe(0, 0, m0.seq); m != high {
+		t.Errorf("Expected the high priority message, got %v", m)
+	}
+	if _, m := channel.Subscribe(m0.time, m0.etag, 0); m != high {
+		t.Errorf("Expected the high priority message, got %v", m)
+	}
+	if _, m := channel.Subscribe(0, 0, 0); m != high {
+		t.Errorf("Expected the high priority message, got %v", m)
+	}
+
+	// the position does not move past the skipped message of lower priority
+	pos, rest := channel.position(m0.time, m0.etag, 0, []int64{high.seq}, high)
+	if pos != nil || len(rest) != 1 || rest[0] != high.seq {
+		t.Errorf("Expected the position to stay, got %v %v", pos, rest)
+	}
+	if _, m := channel.subscribe(m0.time, m0.etag, 0, rest, false); m != later {
+		t.Errorf("Expected the later message, got %v", m)
+	}
+	if _, m := channel.subscribe(m0.time, m0.etag, 0, []int64{high.seq, later.seq}, false); m != low {
+		t.Errorf("Expected the low priority message, got %v", m)
+	}
+	pos, rest = channel.position(m0.time, m0.etag, 0, []int64{high.seq, later.seq, low.seq}, low)
+	if pos != later || len(rest) != 0 {
+		t.Errorf("Expected the position of the later message, got %v %v", pos, rest)
+	}
+	// equal priorities are served oldest first, seen messages never
+	if _, m := channel.Subscribe(0, 0, high.seq); m != later {
+		t.Errorf("Expected the later message, got %v", m)
+	}
+	if _, m := channel.Subscribe(0, 0, later.seq); m != nil {
+		t.Errorf("Expected nothing, got %v", m)
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	b.StopTimer()
+	conf := Configuration{ChannelCapacity: 1000}
+	channel := newChannel("test", &conf)
+	m := &Message{Status: http.StatusOK, Payload: []byte("hello")}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		channel.Publish(m, true)
+	}
+}
+
+// coalescing tests
+func TestCoalesce(t *testing.T) {
+	for _, window := range []int64{0, 1e9} {
+		channel := newChannel("test", &Configuration{ChannelCapacity: 5, CoalesceWindow: window})
+		channel.PublishString("same", true)
+		channel.PublishString("same", true)
+		channel.PublishString("other", true)
+
+		queued, coalesced := 3, int64(0)
+		if window > 0 {
+			queued, coalesced = 2, 1
+		}
+		if s := channel.Stats(); s.Queued != queued || s.Published != 3-coalesced || s.Coalesced != coalesced {
+			t.Errorf("Invalid stats with window %d: %#v", window, s)
+		}
+	}
+
+	// every stat format reports the coalesced messages
+	channel := newChannel("test", &Configuration{ChannelCapacity: 5, CoalesceWindow: 1e9})
+	channel.PublishString("same", true)
+	channel.PublishString("same", true)
+	for accept, expected := range map[string]string{
+		"text/plain":                  "total coalesced: 1\n",
+		"application/json":            `"coalesced":1,`,
+		"application/xml":             "<coalesced>1</coalesced>",
+		"application/vnd.pusher+json": `"coalesced":1,`,
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://localhost/pub", nil)
+		req.Header.Set("Accept", accept)
+		channel.writeStats(rw, req)
+		if body := rw.Body.String(); !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in the %s stats, got %q", expected, accept, body)
+		}
+	}
+
+	channel = newChannel("test", &Configuration{ChannelCapacity: 5, CoalesceWindow: 1e7})
+	channel.PublishString("same", true)
+	time.Sleep(2e7)
+	channel.PublishString("same", true)
+	if s := channel.Stats(); s.Queued != 2 {
+		t.Errorf("Expected messages outside the window to be queued, got %d", s.Queued)
+	}
+}
+
+// synthetic last message tests
+func TestSyntheticLast(t *testing.T) {
+	channel := newChannel("test", &Configuration{ChannelCapacity: 5, CoalesceWindow: 1e9})
+	channel.PublishString("same", true)
+	first := channel.last()
+	channel.Publish(conflictMessage, false)
+
+	// the conflict neither replaces the last message nor breaks coalescing
+	if m := channel.Peek(); m == nil || string(m.Payload) != "same" {
+		t.Errorf("Expected the last message, got %v", m)
+	}
+	if !channel.matches(strconv.Itoa(first.etag)) {
+		t.Errorf("Expected the etag of the last message to match")
+	}
+	channel.PublishString("same", true)
+	if s := channel.Stats(); s.Coalesced != 1 {
+		t.Errorf("Expected the message to be coalesced, got %#v", s)
+	}
+}
+
+// first requested tests
+func TestFirstRequested(t *testing.T) {
+	channel := newChannel("test", &intervalConf)
+	if s := channel.Stats(); s.FirstRequested != 0 {
+		t.Errorf("Expected no first request yet, got %d", s.FirstRequested)
+	}
+
+	before := time.Seconds()
+	channel.Subscribe(0, 0, 0)
+	s := channel.Stats()
+	if s.FirstRequested < before || s.FirstRequested > time.Seconds() || s.FirstRequested != s.LastRequested {
+		t.Errorf("Expected the time of the first subscribe, got %d", s.FirstRequested)
+	}
+
+	channel.lock.Lock()
+	channel.stats.FirstRequested -= 10
+	channel.lock.Unlock()
+	channel.Subscribe(0, 0, 0)
+	if later := channel.Stats(); later.FirstRequested != s.FirstRequested-10 {
+		t.Errorf("Expected later subscribes to leave the first request alone, got %d", later.FirstRequested)
+	}
+
+	// a request for the available message counts as well
+	channel = newChannel("test", &intervalConf)
+	channel.Available(0, 0, 0)
+	if s = channel.Stats(); s.FirstRequested < before || s.FirstRequested != s.LastRequested {
+		t.Errorf("Expected the time of the first request, got %d", s.FirstRequested)
+	}
+}
+
+func BenchmarkStatsWhilePublishing(b *testing.B) {
+	b.StopTimer()
+	conf := Configuration{ChannelCapacity: 1000, PollingMechanism: PollingMechanismLong}
+	channel := newChannel("test", &conf)
+	m := &Message{Status: http.StatusOK, Payload: []byte("hello")}
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// every publish releases the parked subscribers
+			for i := 0; i < 100; i++ {
+				channel.Subscribe(1<<62, 0, 0)
+			}
+			channel.Publish(m, true)
+		}
+	}()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		channel.Stats()
+	}
+	b.StopTimer()
+	done <- true
+}
+
+// supplied time tests
+func TestMessageTime(t *testing.T) {
+	channel := newChannel("test", &Configuration{ChannelCapacity: 5, PollingMechanism: PollingMechanismInterval})
+	times := []int64{1000e9, 1000e9 + 5e8, 2000e9, 1500e9}
+	for i, tm := range times {
+		channel.Publish(&Message{Status: http.StatusOK, Payload: []byte{byte('a' + i)}, Time: tm}, true)
+	}
+
+	var since int64
+	var etag int
+	var got string
+	var stamps []int64
+	for {
+		_, m := channel.Subscribe(since, etag, 0)
+		if m == nil {
+			break
+		}
+		got += string(m.Payload)
+		stamps = append(stamps, m.time)
+		since, etag = m.time, m.etag
+	}
+
+	// the out-of-order time is moved to the second of the previous message
+	if got != "abcd" {
+		t.Errorf("Expected to subscribe through abcd, got %q", got)
+	}
+	if expected := []int64{1000e9, 1000e9 + 5e8, 2000e9, 2000e9}; len(stamps) != 4 ||
+		stamps[0] != expected[0] || stamps[1] != expected[1] || stamps[2] != expected[2] || stamps[3] != expected[3] {
+		t.Errorf("Expected times %v, got %v", expected, stamps)
+	}
+
+	channel.PublishString("now", true)
+	if m := channel.Peek(); m.time/1e9 < time.Seconds()-1 {
+		t.Errorf("Expected a message without a time to be published now, got %d", m.time)
+	}
+}
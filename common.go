@@ -1,19 +1,43 @@
 package pusher
 
 import (
+	"fmt"
 	"http"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 // Concurrency mode defines the behaviour of channels when there are
 // multiple subscribers. If conflicts occur in FILO and LIFO modes, a
 // 409 Conflict message will be broadcasted to the clients that were kicked
-// out.
+// out (LIFO) or returned to the newcomer (FILO). Its payload explains the
+// conflict and its X-Conflict-Reason header is either replaced (LIFO) or
+// already-subscribed (FILO). In Exclusive mode only the oldest parked
+// subscriber ready to receive a message does, the following ones wait in
+// first-in, first-out order and take over one at a time once their
+// predecessors have received a message or left. Waiting subscribers are not
+// served from the queue, they receive the messages published after they have
+// taken over. A message none of them was ready for is undelivered, so it is
+// only left to the next subscriber if it was published to be queued.
 const (
 	ConcurrencyModeBroadcast = iota // Broadcasting
 	ConcurrencyModeFILO             // First-in, last-out
 	ConcurrencyModeLIFO             // Last-in, first-out
+	ConcurrencyModeExclusive        // First-in, first-out, one at a time
+)
+
+// Queue policy defines the behaviour of channels whose queue is full (see ChannelCapacity).
+// By default the oldest message is dropped to make room for the published one. In DropNewest
+// mode the published message is delivered to the active subscribers, but not queued. In
+// RejectWhenFull mode the message is not published at all, unless it is published to several
+// channels at once (see PublishMulti), in which case it behaves like DropNewest.
+const (
+	QueuePolicyDropOldest     = iota // Drop the oldest queued message
+	QueuePolicyDropNewest            // Do not queue the published message
+	QueuePolicyRejectWhenFull        // Reject the published message
 )
 
 // Polling mechanism defines the behaviour of response-cycles.
@@ -22,20 +46,75 @@ const (
 	PollingMechanismInterval        // Interval-polling
 )
 
-// Logger is the logging facility used by Pusher
+// Logger is the logging facility used by Pusher, unless overridden using the Logger
+// configuration option.
 var Logger = log.New(os.Stderr, "", log.LstdFlags)
 
+// Log is the interface of logging facilities. It is satisfied by *log.Logger.
+type Log interface {
+	Print(v ...interface{})
+	Printf(format string, v ...interface{})
+}
+
+// NopLog is a Log discarding everything without formatting it. Setting it as the Logger
+// configuration option disables logging of a pusher altogether.
+var NopLog Log = nopLog{}
+
+type nopLog struct{}
+
+func (nopLog) Print(v ...interface{}) {}
+
+func (nopLog) Printf(format string, v ...interface{}) {}
+
 // Configuration holds various parameters for the server.
+//
+// The OnPublish and OnSubscribe hooks are called while holding the lock of the channel,
+// so they must not call back into the channel.
 type Configuration struct {
-	AllowChannelCreation bool   // Can channels be created through subscriber locations.
-	ChannelCapacity      int    // The capacity of the channels (queue length, 0=unlimited).
-	ConcurrencyMode      int    // The behaviour of channels under concurrent subscribers
-	ContentType          string // Override outgoing Content-Type headers.
-	GCInterval           int64  // The interval between collecting stale channels (0=disable).
-	MaxChannels          int    // Maximum amount of channels (0=unlimited).
-	MaxChannelIdleTime   int64  // Maximum idle time for a channel (0=unlimited).
-	PollingMechanism     int    // The behaviour of response-cycles.
-	PollingTimeout       int64  // Maximum time for a long-polling connection (0=unlimited).
+	AllowChannelCreation       bool                                        // Can channels be created through subscriber locations.
+	AllowOrigin                string                                      // The origin allowed to use the locations cross-origin (""=disable, "*"=any).
+	CaseInsensitiveChannels    bool                                        // Channel ids differing only in case name the same channel, known by the lower case id.
+	ChannelCapacity            int                                         // The capacity of the channels (queue length, 0=unlimited).
+	CoalesceWindow             int64                                       // Identical messages published within this time (in ns) collapse into one (0=disable).
+	DrainTimeout               int64                                       // Maximum time Close waits for parked subscribers to finish (0=no waiting), see Drain.
+	ConcurrencyMode            int                                         // The behaviour of channels under concurrent subscribers
+	ConflictMessage            *Message                                    // The payload and content-type of 409s (nil=built-in), see Configuration.synthetic.
+	ContentType                string                                      // Override outgoing Content-Type headers.
+	EmptyResponseStatus        int                                         // The status responded when no message is available (0=304 Not Modified).
+	GCInterval                 int64                                       // The interval between collecting stale channels (0=disable).
+	GCRetryAfter               int                                         // The Retry-After (in seconds) of subscribers released by GC (0=disable).
+	GoneMessage                *Message                                    // The payload and content-type of 410s (nil=built-in), see Configuration.synthetic.
+	GzipMinSize                int                                         // Minimum payload size compressed for subscribers accepting gzip (0=disable).
+	HeartbeatInterval          int64                                       // The interval between keepalives to waiting subscribers (0=disable).
+	IntervalMinWait            int64                                       // The time interval-polling subscribers wait for a message (0=respond at once).
+	JSONPCallback              string                                      // Query parameter naming a JSONP callback for subscribers (""=disable).
+	Logger                     Log                                         // The logging facility of the pusher (nil=the package-level Logger, NopLog=disable).
+	MaxChannels                int                                         // Maximum amount of channels (0=unlimited).
+	MaxChannelIdLength         int                                         // Maximum length of a channel id in bytes (0=unlimited).
+	MaxChannelIdleTime         int64                                       // Maximum idle time for a channel (0=unlimited).
+	MaxConcurrentSubscribers   int                                         // Maximum amount of parked subscribers across all channels (0=unlimited).
+	MaxMessageSize             int64                                       // Maximum size of a published message in bytes (0=unlimited).
+	MaxPublishRate             int                                         // Maximum messages per second per channel (0=unlimited).
+	MaxSubscribersPerChannel   int                                         // Maximum amount of active subscribers per channel (0=unlimited).
+	MaxTotalQueuedBytes        int64                                       // Maximum payload bytes queued by all channels, oldest evicted first (0=unlimited).
+	MessageTTL                 int64                                       // Maximum time a message stays queued (0=unlimited).
+	Metrics                    Metrics                                     // Receives the counters of the channels as they change (nil=none).
+	OnChannelCreated           func(cid string)                            // Called for every created channel (nil=disable).
+	OnChannelDestroyed         func(cid string)                            // Called for every deleted or garbage collected channel (nil=disable).
+	OnChannelGC                func(cid string, stats Stats)               // Called for every garbage collected channel (nil=disable).
+	OnDeliveryError            func(cid string, err os.Error)              // Called when writing a message to a subscriber fails (nil=disable).
+	OnPublish                  func(cid string, m *Message, delivered int) // Called for every published message (nil=disable).
+	OnSubscribe                func(cid string, immediate bool)            // Called for every subscription (nil=disable).
+	OnSubscribeComplete        func(cid string, waited int64, status int)  // Called once a subscriber has been responded, waited in ns (nil=disable).
+	PatternSubscriptions       bool                                        // Subscriptions to glob patterns cover every matching channel (see path.Match).
+	PerChannelMetrics          bool                                        // Include per-channel metrics labeled by channel id in MetricsHandler.
+	Persister                  Persister                                   // Stores the queues of channels across restarts (nil=disable).
+	PollingMechanism           int                                         // The behaviour of response-cycles.
+	PollingTimeout             int64                                       // Maximum time for a long-polling connection (0=unlimited).
+	PresenceChannels           bool                                        // Announce joining and leaving subscribers in companion channels (see PresenceSuffix).
+	QueuePolicy                int                                         // The behaviour of channels whose queue is full.
+	StreamWriteTimeout         int64                                       // Maximum time for a write to a streaming subscriber before it is evicted (0=unlimited).
+	SubscriberLocationTemplate string                                      // The subscriber URL of a channel given to publishers, a single %s=the escaped id (""=none).
 }
 
 // DefaultConfiguration holds some sensible defaults.
@@ -51,23 +130,178 @@ var DefaultConfiguration = Configuration{
 // a HTTP status code to use when delivering it.
 type Message struct {
 	ContentType string // HTTP content-type to use
+	Id          string // Publisher supplied id, recently published ids are dropped (""=none)
 	Payload     []byte // the body to use
+	Priority    int    // Queued messages of higher priority are served first (0=normal)
 	Status      int    // HTTP status code to use
+	Time        int64  // The time to publish the message at in ns, e.g. when replaying (0=now)
 	etag        int    // HTTP Etag to use
-	time        int64  // HTTP Last-Modified e.g. the time the message was created
+	reason      string // Why a synthetic message was sent, see reasonHeaders (""=none)
+	synthesized bool   // Whether the message was made up by Configuration.synthetic
+	seq         int64  // The sequence number of the message within its channel
+	time        int64  // HTTP Last-Modified e.g. the time the message was created in ns
+}
+
+// NewMessage returns a message carrying payload with the given content-type and a
+// 200 status.
+func NewMessage(contentType string, payload []byte) *Message {
+	return &Message{Status: http.StatusOK, ContentType: contentType, Payload: payload}
+}
+
+// After reports whether m was published after the message identified by the
+// given If-Modified-Since time (in ns) and Etag. As HTTP dates have a resolution
+// of a second, messages published within the same second are ordered by their
+// etags.
+func (m *Message) after(since int64, etag int) bool {
+	second, sinceSecond := m.time/1e9, since/1e9
+	return second > sinceSecond || second == sinceSecond && m.etag > etag
+}
+
+// Follows reports whether m was published after the position given by the sequence number
+// seq, or by since and etag (see after) if seq is zero.
+func (m *Message) follows(since int64, etag int, seq int64) bool {
+	if seq > 0 {
+		return m.seq > seq
+	}
+	return m.after(since, etag)
+}
+
+// LastModified returns the time m was created formatted as a HTTP date.
+func (m *Message) lastModified() string {
+	return time.SecondsToUTC(m.time / 1e9).Format(http.TimeFormat)
+}
+
+// Synthetic reports whether m was made up by the pusher, such as a conflict or a gone
+// message, rather than published by a publisher. Synthetic messages are neither sequenced
+// nor queued, so they carry no etag, time or sequence number.
+func (m *Message) synthetic() bool {
+	return m.reason != "" || m.synthesized || m == goneMessage || m == unavailableMessage || m == overloadedMessage
+}
+
+// Synthetic returns a fresh copy of the synthetic message m as sent by a pusher using this
+// configuration, so the shared messages are never modified. If the GoneMessage or
+// ConflictMessage configuration option is set for the status of m, the copy carries the
+// content-type and payload of the option along with the status and reason of m.
+func (c *Configuration) synthetic(m *Message) *Message {
+	custom := m
+	switch {
+	case m.Status == http.StatusGone && c.GoneMessage != nil:
+		custom = c.GoneMessage
+	case m.Status == http.StatusConflict && c.ConflictMessage != nil:
+		custom = c.ConflictMessage
+	}
+	return &Message{Status: m.Status, ContentType: custom.ContentType, Payload: custom.Payload,
+		reason: m.reason, synthesized: true}
 }
 
+// StatusTooManyRequests is returned to publishers exceeding MaxPublishRate.
+const StatusTooManyRequests = 429
+
+// StatusInsufficientStorage is returned to publishers of channels whose queue is full, if
+// the RejectWhenFull queue policy is used.
+const StatusInsufficientStorage = 507
+
 var (
-	conflictMessage = &Message{Status: http.StatusConflict}
-	goneMessage     = &Message{Status: http.StatusGone}
+	// The conflict messages tell subscribers why they were displaced, see ConcurrencyModeLIFO
+	// and ConcurrencyModeFILO.
+	conflictMessage = &Message{Status: http.StatusConflict, ContentType: "text/plain",
+		Payload: []byte("Replaced by a newer subscriber."), reason: "replaced"}
+	occupiedMessage = &Message{Status: http.StatusConflict, ContentType: "text/plain",
+		Payload: []byte("The channel already has a subscriber."), reason: "already-subscribed"}
 
+	// The gone messages tell subscribers whether their channel was deleted or garbage
+	// collected. The plain one is sent when the pusher is closed.
+	goneMessage    = &Message{Status: http.StatusGone}
+	deletedMessage = &Message{Status: http.StatusGone, ContentType: "text/plain",
+		Payload: []byte("The channel was deleted."), reason: "deleted"}
+	collectedMessage = &Message{Status: http.StatusGone, ContentType: "text/plain",
+		Payload: []byte("The channel was garbage collected."), reason: "collected"}
+
+	// The unavailable messages reject subscribers beyond MaxSubscribersPerChannel and
+	// MaxConcurrentSubscribers respectively.
+	unavailableMessage = &Message{Status: http.StatusServiceUnavailable}
+	overloadedMessage  = &Message{Status: http.StatusServiceUnavailable}
+
+	// ReasonHeaders name the response headers carrying the reasons of synthetic messages,
+	// keyed by the status of the messages.
+	reasonHeaders = map[int]string{
+		http.StatusConflict: "X-Conflict-Reason",
+		http.StatusGone:     "X-Gone-Reason",
+	}
+
+	heartbeatPayload = []byte(" ")
+
+	// The stat formats are keyed by their MIME subtype. They only interpolate
+	// integers, so the values never need to be escaped. The arguments are
+	// passed in the order queued, lastRequested, lastPublished, subscribers,
+	// published, delivered, bytesPublished, bytesDelivered, peakSubscribers,
+	// firstRequested, coalesced and uptime.
 	statFormats = map[string]string{
 		"plain": `queued messages: %d
 last requested: %d sec. ago (-1=never)
 last published: %d sec. ago (-1=never)
 active subscribers: %d
 total published: %d
-total delivered: %d`,
-		"json": `{"queued":%d,"lastRequested":%d,"lastPublished":%d,"subscribers":%d,"published":%d,"delivered":%d}`,
+total delivered: %d
+total bytes published: %d
+total bytes delivered: %d
+peak subscribers: %d
+first requested: %d sec. ago (-1=never)
+total coalesced: %d
+uptime: %d sec.`,
+		"json": `{"queued":%d,"lastRequested":%d,"lastPublished":%d,"subscribers":%d,"published":%d,"delivered":%d,"bytesPublished":%d,"bytesDelivered":%d,"peakSubscribers":%d,"firstRequested":%d,"coalesced":%d,"uptime":%d}`,
+		"xml": `<?xml version="1.0" encoding="UTF-8"?>
+<stats><queued>%d</queued><lastRequested>%d</lastRequested><lastPublished>%d</lastPublished><subscribers>%d</subscribers><published>%d</published><delivered>%d</delivered><bytesPublished>%d</bytesPublished><bytesDelivered>%d</bytesDelivered><peakSubscribers>%d</peakSubscribers><firstRequested>%d</firstRequested><coalesced>%d</coalesced><uptime>%d</uptime></stats>`,
+	}
+
+	// The global stat formats are passed the arguments in the order channels,
+	// subscribers, queued, published, delivered, bytesPublished and bytesDelivered.
+	globalStatFormats = map[string]string{
+		"plain": `channels: %d
+active subscribers: %d
+queued messages: %d
+total published: %d
+total delivered: %d
+total bytes published: %d
+total bytes delivered: %d`,
+		"json": `{"channels":%d,"subscribers":%d,"queued":%d,"published":%d,"delivered":%d,"bytesPublished":%d,"bytesDelivered":%d}`,
+		"xml": `<?xml version="1.0" encoding="UTF-8"?>
+<stats><channels>%d</channels><subscribers>%d</subscribers><queued>%d</queued><published>%d</published><delivered>%d</delivered><bytesPublished>%d</bytesPublished><bytesDelivered>%d</bytesDelivered></stats>`,
 	}
 )
+
+// A StatEncoder writes the statistics of a channel to w in a custom format.
+type StatEncoder func(w io.Writer, stats Stats) os.Error
+
+// StatEncoders holds the registered stat encoders keyed by their MIME subtype.
+var statEncoders = map[string]StatEncoder{
+	"vnd.pusher+json": encodeTimestampedStats,
+}
+
+// RegisterStatEncoder registers encoder for stats requested with an Accept-header
+// of text/subtype or application/subtype. Registered encoders take precedence over
+// the built-in plain, json and xml formats. RegisterStatEncoder is meant to be
+// called during initialization and is not safe for concurrent use with the handlers.
+func RegisterStatEncoder(subtype string, encoder StatEncoder) {
+	statEncoders[strings.ToLower(subtype)] = encoder
+}
+
+// EncodeTimestampedStats encodes stats as JSON like the json stat format, but the
+// created, firstRequested, lastRequested and lastPublished fields are RFC 3339
+// timestamps (or empty strings for never).
+func encodeTimestampedStats(w io.Writer, stats Stats) os.Error {
+	_, err := fmt.Fprintf(w, `{"created":%q,"firstRequested":%q,"lastRequested":%q,"lastPublished":%q,"queued":%d,"subscribers":%d,"published":%d,"delivered":%d,"bytesPublished":%d,"bytesDelivered":%d,"peakSubscribers":%d,"coalesced":%d,"uptime":%d}`,
+		formatStamp(stats.Created), formatStamp(stats.FirstRequested), formatStamp(stats.LastRequested), formatStamp(stats.LastPublished),
+		stats.Queued, stats.Subscribers, stats.Published, stats.Delivered, stats.BytesPublished, stats.BytesDelivered,
+		stats.PeakSubscribers, stats.Coalesced, stats.Uptime())
+	return err
+}
+
+// FormatStamp formats a time in seconds as a RFC 3339 timestamp. A zero time
+// is formatted as an empty string.
+func formatStamp(t int64) string {
+	if t == 0 {
+		return ""
+	}
+	return time.SecondsToUTC(t).Format(time.RFC3339)
+}
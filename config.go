@@ -0,0 +1,176 @@
+package pusher
+
+import (
+	"fmt"
+	"http"
+	"os"
+	"strings"
+)
+
+// An Option sets one or more related configuration options, see NewConfig.
+type Option func(c *Configuration)
+
+// NewConfig creates a configuration starting from DefaultConfiguration and applying the given
+// options in order. Options given later override the earlier ones.
+func NewConfig(opts ...Option) Configuration {
+	c := DefaultConfiguration
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// WithLongPolling selects long-polling with the given timeout (in ns, 0=unlimited).
+func WithLongPolling(timeout int64) Option {
+	return func(c *Configuration) {
+		c.PollingMechanism = PollingMechanismLong
+		c.PollingTimeout = timeout
+	}
+}
+
+// WithIntervalPolling selects interval-polling. As subscribers are never parked, the polling
+// timeout is cleared.
+func WithIntervalPolling() Option {
+	return func(c *Configuration) {
+		c.PollingMechanism = PollingMechanismInterval
+		c.PollingTimeout = 0
+	}
+}
+
+// WithCapacity sets the capacity of the channels (0=unlimited).
+func WithCapacity(n int) Option {
+	return func(c *Configuration) {
+		c.ChannelCapacity = n
+	}
+}
+
+// WithConcurrencyMode sets the behaviour of channels under concurrent subscribers, see
+// ConcurrencyModeBroadcast, ConcurrencyModeFILO, ConcurrencyModeLIFO and
+// ConcurrencyModeExclusive.
+func WithConcurrencyMode(m int) Option {
+	return func(c *Configuration) {
+		c.ConcurrencyMode = m
+	}
+}
+
+// WithGC sets the interval of the garbage collector (in ns) along with the limits it enforces:
+// the maximum idle time of a channel (in ns) and the maximum amount of channels (0=unlimited).
+// The garbage collector only runs if one of the limits is set.
+func WithGC(interval, idle int64, max int) Option {
+	return func(c *Configuration) {
+		c.GCInterval = interval
+		c.MaxChannelIdleTime = idle
+		c.MaxChannels = max
+	}
+}
+
+// WithChannelCreation allows channels to be created through subscriber locations.
+func WithChannelCreation() Option {
+	return func(c *Configuration) {
+		c.AllowChannelCreation = true
+	}
+}
+
+// WithLogger sets the logging facility of the pusher.
+func WithLogger(l Log) Option {
+	return func(c *Configuration) {
+		c.Logger = l
+	}
+}
+
+// A ConfigurationError lists the problems found by Validate.
+type ConfigurationError []string
+
+func (e ConfigurationError) String() string {
+	return "pusher: invalid configuration: " + strings.Join([]string(e), "; ")
+}
+
+// Validate checks the configuration for out-of-range and contradictory options. It returns a
+// ConfigurationError listing every problem found, or nil if there are none. The rules are:
+//
+// - Amounts, sizes, rates and durations must not be negative.
+// - ConcurrencyMode, PollingMechanism and QueuePolicy must be one of the defined constants.
+// - EmptyResponseStatus must be 200 OK, 204 No Content or 304 Not Modified, if set.
+// - PollingTimeout has no effect with interval-polling, since subscribers are never parked for
+//   long. Neither has HeartbeatInterval, unless IntervalMinWait parks them. IntervalMinWait has
+//   no effect with long-polling.
+// - GCInterval has no effect unless MaxChannelIdleTime, MaxChannels or MessageTTL is set.
+func (c Configuration) Validate() os.Error {
+	var e ConfigurationError
+
+	for _, o := range []struct {
+		name  string
+		value int64
+	}{
+		{"ChannelCapacity", int64(c.ChannelCapacity)},
+		{"CoalesceWindow", c.CoalesceWindow},
+		{"DrainTimeout", c.DrainTimeout},
+		{"GCInterval", c.GCInterval},
+		{"GCRetryAfter", int64(c.GCRetryAfter)},
+		{"GzipMinSize", int64(c.GzipMinSize)},
+		{"HeartbeatInterval", c.HeartbeatInterval},
+		{"IntervalMinWait", c.IntervalMinWait},
+		{"MaxChannels", int64(c.MaxChannels)},
+		{"MaxChannelIdLength", int64(c.MaxChannelIdLength)},
+		{"MaxChannelIdleTime", c.MaxChannelIdleTime},
+		{"MaxConcurrentSubscribers", int64(c.MaxConcurrentSubscribers)},
+		{"MaxMessageSize", c.MaxMessageSize},
+		{"MaxPublishRate", int64(c.MaxPublishRate)},
+		{"MaxSubscribersPerChannel", int64(c.MaxSubscribersPerChannel)},
+		{"MaxTotalQueuedBytes", c.MaxTotalQueuedBytes},
+		{"MessageTTL", c.MessageTTL},
+		{"PollingTimeout", c.PollingTimeout},
+		{"StreamWriteTimeout", c.StreamWriteTimeout},
+	} {
+		if o.value < 0 {
+			e = append(e, fmt.Sprintf("%s is negative (%d)", o.name, o.value))
+		}
+	}
+
+	if c.ConcurrencyMode < ConcurrencyModeBroadcast || c.ConcurrencyMode > ConcurrencyModeExclusive {
+		e = append(e, fmt.Sprintf("unknown ConcurrencyMode %d", c.ConcurrencyMode))
+	}
+	if c.QueuePolicy < QueuePolicyDropOldest || c.QueuePolicy > QueuePolicyRejectWhenFull {
+		e = append(e, fmt.Sprintf("unknown QueuePolicy %d", c.QueuePolicy))
+	}
+	switch c.EmptyResponseStatus {
+	case 0, http.StatusOK, http.StatusNoContent, http.StatusNotModified:
+	default:
+		e = append(e, fmt.Sprintf("unsupported EmptyResponseStatus %d", c.EmptyResponseStatus))
+	}
+	switch c.PollingMechanism {
+	case PollingMechanismLong:
+		if c.IntervalMinWait > 0 {
+			e = append(e, "IntervalMinWait has no effect with long-polling")
+		}
+	case PollingMechanismInterval:
+		if c.PollingTimeout > 0 {
+			e = append(e, "PollingTimeout has no effect with interval-polling")
+		}
+		if c.HeartbeatInterval > 0 && c.IntervalMinWait == 0 {
+			e = append(e, "HeartbeatInterval has no effect with interval-polling without IntervalMinWait")
+		}
+	default:
+		e = append(e, fmt.Sprintf("unknown PollingMechanism %d", c.PollingMechanism))
+	}
+
+	if t := c.SubscriberLocationTemplate; t != "" && !isLocationTemplate(t) {
+		e = append(e, fmt.Sprintf("SubscriberLocationTemplate %q needs a single %%s and no other verbs", t))
+	}
+
+	if c.GCInterval > 0 && c.MaxChannelIdleTime <= 0 && c.MaxChannels <= 0 && c.MessageTTL <= 0 {
+		e = append(e, "GCInterval has no effect without MaxChannelIdleTime, MaxChannels or MessageTTL")
+	}
+
+	if e != nil {
+		return e
+	}
+	return nil
+}
+
+// IsLocationTemplate reports whether t holds a single %s (the channel id) and no other verbs
+// besides %%, as required by the SubscriberLocationTemplate configuration option.
+func isLocationTemplate(t string) bool {
+	t = strings.Replace(t, "%%", "", -1)
+	return strings.Count(t, "%s") == 1 && strings.Count(t, "%") == 1
+}
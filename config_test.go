@@ -0,0 +1,84 @@
+package pusher
+
+import (
+	"http"
+	"testing"
+)
+
+// option tests
+func TestNewConfig(t *testing.T) {
+	d := DefaultConfiguration
+	if c := NewConfig(); c.ChannelCapacity != d.ChannelCapacity || c.GCInterval != d.GCInterval ||
+		c.MaxChannelIdleTime != d.MaxChannelIdleTime || c.PollingTimeout != d.PollingTimeout {
+		t.Errorf("Expected the defaults, got %#v", c)
+	}
+
+	c := NewConfig(WithCapacity(5), WithConcurrencyMode(ConcurrencyModeLIFO), WithChannelCreation())
+	if c.ChannelCapacity != 5 || c.ConcurrencyMode != ConcurrencyModeLIFO || !c.AllowChannelCreation {
+		t.Errorf("Invalid configuration %#v", c)
+	}
+	if c.GCInterval != DefaultConfiguration.GCInterval || c.PollingTimeout != DefaultConfiguration.PollingTimeout {
+		t.Errorf("Defaults were not preserved %#v", c)
+	}
+
+	c = NewConfig(WithLongPolling(5e9))
+	if c.PollingMechanism != PollingMechanismLong || c.PollingTimeout != 5e9 {
+		t.Errorf("Invalid configuration %#v", c)
+	}
+
+	c = NewConfig(WithIntervalPolling())
+	if c.PollingMechanism != PollingMechanismInterval || c.PollingTimeout != 0 {
+		t.Errorf("Invalid configuration %#v", c)
+	}
+
+	c = NewConfig(WithGC(1e9, 2e9, 3))
+	if c.GCInterval != 1e9 || c.MaxChannelIdleTime != 2e9 || c.MaxChannels != 3 {
+		t.Errorf("Invalid configuration %#v", c)
+	}
+
+	c = NewConfig(WithLogger(NopLog))
+	if c.Logger != NopLog || c.ChannelCapacity != DefaultConfiguration.ChannelCapacity {
+		t.Errorf("Invalid configuration %#v", c)
+	}
+}
+
+// validation tests
+func TestValidate(t *testing.T) {
+	if err := DefaultConfiguration.Validate(); err != nil {
+		t.Errorf("Expected a valid configuration, got %s", err)
+	}
+
+	tests := []struct {
+		config   Configuration
+		problems int
+	}{
+		{Configuration{ChannelCapacity: -1, PollingTimeout: -1}, 2},
+		{Configuration{ConcurrencyMode: 7, PollingMechanism: 7}, 2},
+		{Configuration{QueuePolicy: 7}, 1},
+		{Configuration{PollingMechanism: PollingMechanismInterval, PollingTimeout: 20e9}, 1},
+		{Configuration{PollingMechanism: PollingMechanismInterval, HeartbeatInterval: 1e9, IntervalMinWait: 5e8}, 0},
+		{Configuration{PollingMechanism: PollingMechanismInterval, HeartbeatInterval: 1e9}, 1},
+		{Configuration{PollingMechanism: PollingMechanismInterval, IntervalMinWait: 5e8}, 0},
+		{Configuration{IntervalMinWait: 5e8}, 1},
+		{Configuration{GCInterval: 60e9}, 1},
+		{Configuration{GCInterval: 60e9, MessageTTL: 60e9}, 0},
+		{Configuration{EmptyResponseStatus: http.StatusNoContent}, 0},
+		{Configuration{EmptyResponseStatus: http.StatusNotFound}, 1},
+		{Configuration{MaxConcurrentSubscribers: -1}, 1},
+		{Configuration{SubscriberLocationTemplate: "/sub/%s?100%%"}, 0},
+		{Configuration{SubscriberLocationTemplate: "/sub"}, 1},
+		{Configuration{SubscriberLocationTemplate: "/sub/%s/%d"}, 1},
+	}
+	for _, test := range tests {
+		err := test.config.Validate()
+		if test.problems == 0 {
+			if err != nil {
+				t.Errorf("Expected %#v to be valid, got %s", test.config, err)
+			}
+			continue
+		}
+		if e, ok := err.(ConfigurationError); !ok || len(e) != test.problems {
+			t.Errorf("Expected %d problems in %#v, got %v", test.problems, test.config, err)
+		}
+	}
+}
@@ -30,7 +30,7 @@
  * @param {String} [pubLocation] An URL to a publisher location
  */
 function Pusher(subLocation, pubLocation) {
-	var etag = 0, since = 0;
+	var etag = 0, since = 0, served = '';
 
 	/**
 	 * URL to a publisher location.
@@ -199,7 +199,8 @@ function Pusher(subLocation, pubLocation) {
 			request(that.subLocation, 'GET', {
 				headers: {
 					'If-Modified-Since': since,
-					'If-None-Match': etag
+					'If-None-Match': etag,
+					'X-Served-Msg-Ids': served
 				}
 			}, function(xhr) {
 				// opera sends 0 when status is 304
@@ -211,6 +212,7 @@ function Pusher(subLocation, pubLocation) {
 					case 200:
 						etag = xhr.getResponseHeader('Etag');
 						since = xhr.getResponseHeader('Last-Modified');
+						served = xhr.getResponseHeader('X-Served-Msg-Ids') || '';
 						etag = etag !== null ? parseInt(etag) : 0;
 						since = since !== null ? since : 0;
 						that.onmessage((typeof JSON === 'object'
@@ -0,0 +1,106 @@
+package pusher
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// A queueMemory accounts the payload bytes queued by all channels of a pusher and enforces
+// the MaxTotalQueuedBytes configuration option. A nil queueMemory accounts nothing, so the
+// channels need not check whether the option is set.
+type queueMemory struct {
+	lock      sync.Mutex // Protects bytes and scheduled.
+	bytes     int64      // The payload bytes queued by all open channels.
+	max       int64      // The MaxTotalQueuedBytes configuration option.
+	scheduled bool       // Whether a reclaim is pending, see reclaimLater.
+	evicting  sync.Mutex // Serializes the evictions, see reclaim.
+	p         *pusher    // The pusher whose channels are accounted.
+}
+
+// NewQueueMemory creates the queue memory of p, or returns nil if the MaxTotalQueuedBytes
+// configuration option is not set.
+func newQueueMemory(p *pusher) *queueMemory {
+	if p.config.MaxTotalQueuedBytes <= 0 {
+		return nil
+	}
+	return &queueMemory{max: p.config.MaxTotalQueuedBytes, p: p}
+}
+
+// Add accounts a change of delta bytes in the queue of a channel.
+func (m *queueMemory) add(delta int64) {
+	if m == nil || delta == 0 {
+		return
+	}
+	m.lock.Lock()
+	m.bytes += delta
+	m.lock.Unlock()
+}
+
+// Total returns the payload bytes queued by all open channels.
+func (m *queueMemory) total() int64 {
+	if m == nil {
+		return 0
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.bytes
+}
+
+// Reclaim evicts the oldest queued messages of the least recently published channels
+// until no more than MaxTotalQueuedBytes are queued. Channels are visited one at a time
+// and each of them is emptied before moving on to the next one. It must be called
+// without holding any lock of the pusher or its channels, typically right after
+// publishing, see reclaimLater otherwise.
+func (m *queueMemory) reclaim() {
+	if m == nil || m.total() <= m.max {
+		return
+	}
+	m.evicting.Lock()
+	defer m.evicting.Unlock()
+
+	// the time of the last message tells apart the channels published within a second
+	var h channelHeap
+	for _, c := range m.p.snapshot() {
+		c.lock.RLock()
+		var published int64
+		if c.lastMessage != nil {
+			published = c.lastMessage.time
+		}
+		c.lock.RUnlock()
+		h = append(h, stampedChannel{c, published})
+	}
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		excess := m.total() - m.max
+		if excess <= 0 {
+			break
+		}
+		c := heap.Pop(&h).(stampedChannel).c
+		if freed := c.evictOldest(excess); freed > 0 {
+			m.p.config.Logger.Printf("Memory: Evicted %d bytes from channel %q", freed, c.id)
+		}
+	}
+}
+
+// ReclaimLater runs reclaim on a goroutine of its own if more than MaxTotalQueuedBytes are
+// queued. Unlike reclaim, it may be called while holding locks of the pusher, e.g. by
+// channels publishing presence announcements on behalf of a subscriber. At most one such
+// goroutine is pending at a time.
+func (m *queueMemory) reclaimLater() {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.bytes <= m.max || m.scheduled {
+		return
+	}
+	m.scheduled = true
+	go func() {
+		m.lock.Lock()
+		m.scheduled = false
+		m.lock.Unlock()
+		m.reclaim()
+	}()
+}
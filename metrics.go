@@ -0,0 +1,157 @@
+package pusher
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics receives the counters of the channels as they change, see the Metrics configuration
+// option. The methods are called while holding the lock of the channel, so implementations must
+// be quick and must not call back into the channel.
+type Metrics interface {
+	IncPublished(cid string)          // A message was published to the channel.
+	IncDelivered(cid string, n int)   // N messages were delivered (taken back if negative).
+	SetSubscribers(cid string, n int) // The channel has n active subscribers.
+}
+
+// ExpvarMetrics is a Metrics publishing the counters through expvar, i.e. at /debug/vars, as
+// maps keyed by channel id. The entries of deleted channels are kept.
+type ExpvarMetrics struct {
+	Published   *expvar.Map // The amount of messages published.
+	Delivered   *expvar.Map // The amount of messages delivered.
+	Subscribers *expvar.Map // The amount of active subscribers.
+	lock        sync.Mutex  // Serializes adding channels to Subscribers.
+}
+
+// NewExpvarMetrics creates an ExpvarMetrics publishing the maps prefix+"published",
+// prefix+"delivered" and prefix+"subscribers". As expvar names are global, the prefix
+// may be used only once.
+func NewExpvarMetrics(prefix string) *ExpvarMetrics {
+	return &ExpvarMetrics{
+		Published:   expvar.NewMap(prefix + "published"),
+		Delivered:   expvar.NewMap(prefix + "delivered"),
+		Subscribers: expvar.NewMap(prefix + "subscribers"),
+	}
+}
+
+func (m *ExpvarMetrics) IncPublished(cid string) {
+	m.Published.Add(cid, 1)
+}
+
+func (m *ExpvarMetrics) IncDelivered(cid string, n int) {
+	m.Delivered.Add(cid, int64(n))
+}
+
+func (m *ExpvarMetrics) SetSubscribers(cid string, n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v, ok := m.Subscribers.Get(cid).(*expvar.Int)
+	if !ok {
+		v = new(expvar.Int)
+		m.Subscribers.Set(cid, v)
+	}
+	v.Set(int64(n))
+}
+
+// A metric describes a single metric family of the Prometheus text exposition format. The
+// per-channel values form a family of their own, named like the metric with a pusher_channel_
+// prefix instead of pusher_, so that summing up a family never counts a message twice.
+type metric struct {
+	name    string                   // The name of the metric, starting with pusher_.
+	typ     string                   // The type of the metric (counter or gauge).
+	help    string                   // The description of the metric.
+	global  func(*GlobalStats) int64 // Extracts the value from the global stats.
+	channel func(*Stats) int64       // Extracts the value from channel stats (nil=no per-channel metric).
+}
+
+// ChannelName returns the name of the family of the per-channel values of m.
+func (m *metric) channelName() string {
+	return "pusher_channel_" + m.name[len("pusher_"):]
+}
+
+var metrics = []metric{
+	{"pusher_channels", "gauge", "The amount of channels.",
+		func(s *GlobalStats) int64 { return int64(s.Channels) },
+		nil},
+	{"pusher_subscribers", "gauge", "The amount of active subscribers.",
+		func(s *GlobalStats) int64 { return int64(s.Subscribers) },
+		func(s *Stats) int64 { return int64(s.Subscribers) }},
+	{"pusher_messages_queued", "gauge", "The amount of messages queued.",
+		func(s *GlobalStats) int64 { return int64(s.Queued) },
+		func(s *Stats) int64 { return int64(s.Queued) }},
+	{"pusher_messages_published_total", "counter", "The amount of messages published.",
+		func(s *GlobalStats) int64 { return s.Published },
+		func(s *Stats) int64 { return s.Published }},
+	{"pusher_messages_delivered_total", "counter", "The amount of messages delivered.",
+		func(s *GlobalStats) int64 { return s.Delivered },
+		func(s *Stats) int64 { return s.Delivered }},
+	{"pusher_bytes_published_total", "counter", "The amount of payload bytes published.",
+		func(s *GlobalStats) int64 { return s.BytesPublished },
+		func(s *Stats) int64 { return s.BytesPublished }},
+	{"pusher_bytes_delivered_total", "counter", "The amount of payload bytes delivered.",
+		func(s *GlobalStats) int64 { return s.BytesDelivered },
+		func(s *Stats) int64 { return s.BytesDelivered }},
+}
+
+// EscapeLabel escapes a label value of the Prometheus text exposition format.
+func escapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+// HandleMetrics is responsible for answering requests to the metrics locations. It responds to
+// GET requests with the statistics aggregated over all channels in the Prometheus text exposition
+// format. If the PerChannelMetrics configuration option is set, the statistics of every channel are
+// included as well, labeled by the channel id, in families of their own (see metric). Any other
+// request method yields a 405.
+func (p *pusher) handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		p.config.Logger.Printf("Metrics/405: A non GET request [%s]", req.RemoteAddr)
+		rw.Header().Set("Allow", "GET")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	global := p.Stats()
+
+	var ids []string
+	var stats map[string]Stats
+	if p.config.PerChannelMetrics {
+		stats = make(map[string]Stats)
+		for _, c := range p.snapshot() {
+			ids = append(ids, c.id)
+			stats[c.id] = c.Stats()
+		}
+		sort.Strings(ids)
+	}
+
+	var buf bytes.Buffer
+	for i := range metrics {
+		m := &metrics[i]
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		fmt.Fprintf(&buf, "%s %d\n", m.name, m.global(&global))
+		if m.channel == nil || len(ids) == 0 {
+			continue
+		}
+		name := m.channelName()
+		fmt.Fprintf(&buf, "# HELP %s %s (per channel)\n# TYPE %s %s\n", name, m.help, name, m.typ)
+		for _, cid := range ids {
+			s := stats[cid]
+			fmt.Fprintf(&buf, "%s{channel=\"%s\"} %d\n", name, escapeLabel(cid), m.channel(&s))
+		}
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.WriteHeader(http.StatusOK)
+	if _, err := rw.Write(buf.Bytes()); err != nil {
+		p.config.Logger.Print("handleMetrics:", err)
+	}
+
+	p.config.Logger.Printf("Metrics/200: Metrics retrieved [%s]", req.RemoteAddr)
+}
@@ -0,0 +1,139 @@
+package pusher
+
+import (
+	"container/list"
+	"http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// IsPattern reports whether cid is a pattern matching channel ids, i.e. whether it contains
+// any of the special characters of path.Match.
+func isPattern(cid string) bool {
+	return strings.IndexAny(cid, `*?[\`) >= 0
+}
+
+// A patternSubscription is a subscription to every channel matching a pattern. The first
+// message delivered by any of the channels is passed through messages, which is closed if
+// every subscription was released without a message.
+type patternSubscription struct {
+	channels []*channel      // The matching channels, sorted by their ids.
+	subs     []*list.Element // The subscriptions, subs[i] being the one to channels[i].
+	messages chan *Message   // Receives the first message.
+	lock     sync.Mutex      // Protects origin and pending.
+	origin   *channel        // The channel of the first message (nil=none yet).
+	pending  int             // The amount of subscriptions not yet released.
+	listens  sync.WaitGroup  // Waits for the listening goroutines to return, see finish.
+}
+
+// SubscribePattern subscribes to every existing channel whose id matches pattern (see
+// path.Match), as a subscriber of a single channel would with the given arguments. The
+// channels are visited in the order of their ids and the first one having a suitable message
+// immediately available ends the subscription, in which case the message is returned as well.
+// Otherwise the subscriber is parked in every matching channel, unless the interval polling
+// mechanism is used without IntervalMinWait (see parks). If peek is set, only the currently
+// available message is returned (see channel.Available).
+//
+// Presence channels only match patterns ending in PresenceSuffix, so that e.g. "*" does not
+// subscribe to the presence channel of every channel along with the channel itself.
+//
+// A 404 status is returned if no channel matches pattern and a 503 if the pusher has been
+// closed. Invalid patterns match nothing.
+func (p *pusher) subscribePattern(pattern string, since int64, etag int, seq int64, served []int64, peek bool) (ps *patternSubscription, message *Message, status int) {
+	ps = &patternSubscription{messages: make(chan *Message, 1)}
+	presence := isPresence(pattern)
+	for _, c := range p.snapshot() {
+		if isPresence(c.id) && !presence {
+			continue
+		}
+		if ok, _ := path.Match(pattern, c.id); ok {
+			ps.channels = append(ps.channels, c)
+		}
+	}
+	if len(ps.channels) == 0 {
+		return nil, nil, http.StatusNotFound
+	}
+	sort.Sort(channelsById(ps.channels))
+
+	for _, c := range ps.channels {
+		sh := p.shard(c.id)
+		sh.lock.RLock()
+		if p.closed {
+			sh.lock.RUnlock()
+			ps.cancel()
+			return nil, nil, http.StatusServiceUnavailable
+		}
+		var sub *list.Element
+		var m *Message
+		if peek {
+			m = c.available(since, etag, seq, served)
+		} else {
+			sub, m = c.subscribe(since, etag, seq, served, p.parks())
+		}
+		sh.lock.RUnlock()
+
+		if m != nil {
+			ps.cancel()
+			ps.origin = c
+			return ps, m, 0
+		}
+		if sub != nil {
+			ps.subs = append(ps.subs, sub)
+		}
+	}
+
+	ps.pending = len(ps.subs)
+	ps.listens.Add(len(ps.subs))
+	for i, sub := range ps.subs {
+		go ps.listen(ps.channels[i], sub.Value.(chan *Message))
+	}
+	return ps, nil, 0
+}
+
+// Listen waits for the subscription ch to c to be released and passes the message on, unless
+// another channel was first.
+func (ps *patternSubscription) listen(c *channel, ch chan *Message) {
+	defer ps.listens.Done()
+	m := <-ch
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.pending--
+	if m != nil && ps.origin == nil {
+		ps.origin = c
+		ps.messages <- m
+	} else if m != nil {
+		// another channel was first, the message was not handed on
+		c.recall(m)
+	} else if ps.pending == 0 && ps.origin == nil {
+		close(ps.messages)
+	}
+}
+
+// Cancel removes the subscriptions that have not yet been released.
+func (ps *patternSubscription) cancel() {
+	for i, sub := range ps.subs {
+		ps.channels[i].Unsubscribe(sub)
+	}
+}
+
+// Finish cancels the subscriptions and waits for every one of them to be released. It returns
+// the message passed through messages but not yet received, if any, since a channel may have
+// delivered it just before the subscriptions were canceled, e.g. when the wait timed out.
+func (ps *patternSubscription) finish() (m *Message) {
+	ps.cancel()
+	ps.listens.Wait()
+	select {
+	case m = <-ps.messages:
+	default:
+	}
+	return
+}
+
+// Delivered returns the channel whose message was delivered, or nil if there was none.
+func (ps *patternSubscription) delivered() *channel {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return ps.origin
+}
@@ -0,0 +1,164 @@
+package pusher
+
+import (
+	"http"
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+)
+
+// A Persister stores the queues of channels, so that they survive restarts.
+// Channels save their queue after it changes and load it when they are
+// created. The stored queue is deleted along with the channel, i.e. when it
+// is deleted or garbage collected, but not when the pusher is closed. Errors
+// are logged using the Logger configuration option.
+type Persister interface {
+	Save(cid string, msgs []*Message) os.Error // Stores the queue of a channel, oldest first.
+	Load(cid string) ([]*Message, os.Error)    // Returns the stored queue of a channel (nil=none).
+	Delete(cid string) os.Error                // Deletes the stored queue of a channel.
+}
+
+// A persistedMessage is the serializable form of a Message.
+type persistedMessage struct {
+	ContentType string
+	Id          string
+	Payload     []byte
+	Priority    int
+	Status      int
+	Etag        int
+	Seq         int64
+	Time        int64
+}
+
+// PersistMessage returns the serializable form of m.
+func persistMessage(m *Message) persistedMessage {
+	return persistedMessage{m.ContentType, m.Id, m.Payload, m.Priority, m.Status, m.etag, m.seq, m.time}
+}
+
+// Message returns the message pm is the serializable form of.
+func (pm persistedMessage) message() *Message {
+	return &Message{
+		ContentType: pm.ContentType,
+		Id:          pm.Id,
+		Payload:     pm.Payload,
+		Priority:    pm.Priority,
+		Status:      pm.Status,
+		etag:        pm.Etag,
+		seq:         pm.Seq,
+		time:        pm.Time,
+	}
+}
+
+// An exportedChannel is the serializable form of a channel, see Export.
+type exportedChannel struct {
+	Id          string
+	Capacity    int
+	ContentType string
+	Last        *persistedMessage // The most recent message, queued or not (nil=none).
+	Messages    []persistedMessage
+	Stats       Stats
+}
+
+// Export writes the id, capacity, content-type, queue and stats of every channel to w as JSON, so that
+// a new process can take over the backlogs, see Import. Subscribers are not exported, they
+// are expected to reconnect. Neither are presence channels, which are recreated along with
+// their channels.
+func (p *pusher) Export(w io.Writer) os.Error {
+	exported := []exportedChannel{}
+	for _, c := range p.snapshot() {
+		if !c.owned {
+			exported = append(exported, c.export())
+		}
+	}
+	return json.NewEncoder(w).Encode(exported)
+}
+
+// Import creates a pusher like New and restores the channels written by Export from r. The
+// channels are created as usual, so e.g. the OnChannelCreated configuration option is called,
+// but their queues, capacities, content-types and stats are replaced with the exported ones, except that
+// they have no subscribers. Messages keep their Last-Modified times, Etags and sequence
+// numbers, so subscribers can resume where they left off.
+func Import(r io.Reader, acceptor Acceptor, config Configuration) (*pusher, os.Error) {
+	var exported []exportedChannel
+	if err := json.NewDecoder(r).Decode(&exported); err != nil {
+		return nil, err
+	}
+
+	p := New(acceptor, config)
+	for _, e := range exported {
+		c, _ := p.Channel(e.Id)
+		c.load(e)
+	}
+	p.memory.reclaim()
+	return p, nil
+}
+
+// FilePersister is a Persister writing the queue of every channel as JSON into
+// a file of its own within a directory.
+type FilePersister struct {
+	Dir string // The directory holding the files.
+}
+
+// NewFilePersister creates a FilePersister storing the files under dir.
+func NewFilePersister(dir string) *FilePersister {
+	return &FilePersister{Dir: dir}
+}
+
+// Path returns the path of the file holding the queue of the given channel.
+// The channel id is escaped, so it can not point outside of Dir.
+func (fp *FilePersister) path(cid string) string {
+	return filepath.Join(fp.Dir, http.URLEscape(cid)+".json")
+}
+
+// Save writes msgs into the file of the given channel. The file is replaced
+// atomically, so a crash never leaves a partially written queue behind.
+func (fp *FilePersister) Save(cid string, msgs []*Message) os.Error {
+	persisted := make([]persistedMessage, len(msgs))
+	for i, m := range msgs {
+		persisted[i] = persistMessage(m)
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return err
+	}
+
+	path := fp.path(cid)
+	if err = ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Load reads the messages from the file of the given channel. A missing file
+// yields no messages.
+func (fp *FilePersister) Load(cid string) ([]*Message, os.Error) {
+	data, err := ioutil.ReadFile(fp.path(cid))
+	if e, ok := err.(*os.PathError); ok && e.Error == os.ENOENT {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var persisted []persistedMessage
+	if err = json.Unmarshal(data, &persisted); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*Message, len(persisted))
+	for i, pm := range persisted {
+		msgs[i] = pm.message()
+	}
+	return msgs, nil
+}
+
+// Delete removes the file of the given channel. A missing file is not an error.
+func (fp *FilePersister) Delete(cid string) os.Error {
+	err := os.Remove(fp.path(cid))
+	if e, ok := err.(*os.PathError); ok && e.Error == os.ENOENT {
+		return nil
+	}
+	return err
+}
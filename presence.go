@@ -0,0 +1,72 @@
+package pusher
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PresenceSuffix is appended to the id of a channel to name its presence channel. If the
+// PresenceChannels configuration option is set, every channel gets a presence channel, to
+// which a message is published whenever subscribers join or leave the channel (see announce).
+// A presence channel lives and dies along with its channel and is never garbage collected on
+// its own.
+const PresenceSuffix = ":presence"
+
+// The presence events, see the PresenceChannels configuration option.
+const (
+	presenceJoin  = "join"
+	presenceLeave = "leave"
+)
+
+// IsPresence reports whether cid names a presence channel. Presence channels never have
+// presence channels of their own.
+func isPresence(cid string) bool {
+	return strings.HasSuffix(cid, PresenceSuffix)
+}
+
+// AttachPresence creates the presence channel of c (if needed) and attaches it to c. The
+// subscribers that arrived before the presence channel was attached are announced at once.
+// It must be called without holding any lock of the pusher.
+func (p *pusher) attachPresence(c *channel) {
+	pc, _ := p.Channel(c.id + PresenceSuffix)
+	pc.lock.Lock()
+	pc.owned = true
+	pc.lock.Unlock()
+
+	c.lock.Lock()
+	c.presence = pc
+	c.lock.Unlock()
+	c.announce()
+}
+
+// Announce publishes a presence message to the presence channel of c, if the amount of
+// subscribers has changed since the last announcement. The message is a JSON object like
+// {"event":"join","subscribers":3}, where the event is either join or leave.
+//
+// Announcements are made one at a time and each of them reads the current amount of
+// subscribers, so the latest presence message always tells the current amount, even if
+// the changes raced each other. It must be called without holding the lock of c, since
+// publishing to the presence channel may need to lock channels already locked by the caller
+// otherwise (e.g. when broadcasting).
+func (c *channel) announce() {
+	if !c.config.PresenceChannels {
+		return
+	}
+
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+
+	c.lock.RLock()
+	pc, n := c.presence, c.subscribers.Len()
+	c.lock.RUnlock()
+	if pc == nil || n == c.announced {
+		return
+	}
+
+	event := presenceJoin
+	if n < c.announced {
+		event = presenceLeave
+	}
+	c.announced = n
+	pc.Publish(NewMessage("application/json", []byte(fmt.Sprintf(`{"event":%q,"subscribers":%d}`, event, n))), true)
+}
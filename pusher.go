@@ -2,37 +2,117 @@ package pusher
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"container/list"
+	"fmt"
 	"http"
+	"io"
+	"json"
+	"math"
+	"os"
 	"sync"
+	"sync/atomic"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
+// The methods allowed on publisher and subscriber locations.
+const (
+	publisherMethods  = "GET, HEAD, PUT, POST, DELETE, OPTIONS"
+	subscriberMethods = "GET, HEAD, OPTIONS"
+)
+
+// ShardCount is the amount of shards the channels of a pusher are spread over, so that
+// operations on channels in different shards do not contend for the same lock.
+const shardCount = 32
+
+// A shard holds the channels of a pusher whose ids hash to it.
+type shard struct {
+	channels map[string]*channel
+	lock     sync.RWMutex // Protects channels and the closed flag of the pusher.
+}
+
 // Pusher represents a set of channels that share the same
 // behaviour e.g. the same configuration options, acceptor and
 // garbage collector.
 //
 // Once a pusher has been initialized using New(), it can be muxed
-// into any http ServeMux by passing PublisherHandler and/or SubscriberHandler
-// to ServeMux.Handle.
+// into any http ServeMux by passing PublisherHandler and/or any of the subscriber
+// handlers to ServeMux.Handle.
 type pusher struct {
-	acceptor          Acceptor
-	channels          map[string]*channel
-	config            Configuration
-	lock              sync.RWMutex // Protects channels.
-	PublisherHandler  http.Handler // The handler for publisher locations.
-	SubscriberHandler http.Handler // The handler for subscriber locations.
+	acceptor                   Acceptor
+	closed                     bool // Set by Close while holding the locks of all shards.
+	draining                   int32 // Set to 1 by Drain, accessed atomically as it is checked on every request.
+	config                     Configuration
+	done                       chan bool         // Closed by Close to stop the garbage collector.
+	drain                      chan bool         // Closed by Drain to end the streams.
+	drained                    chan bool         // Closed once the pusher is draining and no subscriber is parked.
+	gc                         sync.WaitGroup    // Waits for the garbage collector to stop.
+	memory                     *queueMemory      // Accounts the queued bytes (nil=unlimited).
+	parked                     int32             // The amount of parked subscribers, see MaxConcurrentSubscribers.
+	shards                     [shardCount]shard // The channels, spread by their ids.
+	PublisherHandler           http.Handler      // The handler for publisher locations.
+	SubscriberHandler          http.Handler      // The handler for subscriber locations.
+	SubscriberSSEHandler       http.Handler      // The handler for Server-Sent Events subscriber locations.
+	SubscriberMultipartHandler http.Handler      // The handler for multipart streaming subscriber locations.
+	SubscriberWebSocketHandler http.Handler      // The handler for WebSocket subscriber locations.
+	StatsHandler               http.Handler      // The handler for global statistics locations.
+	MetricsHandler             http.Handler      // The handler for Prometheus metrics locations.
+	HealthHandler              http.Handler      // The handler for liveness probe locations.
+	ReadinessHandler           http.Handler      // The handler for readiness probe locations.
+	started                    int64             // The time the pusher was created in ns.
+}
+
+// GlobalStats holds information aggregated over all channels of a pusher.
+type GlobalStats struct {
+	BytesDelivered int64 // The amount of payload bytes delivered.
+	BytesPublished int64 // The amount of payload bytes published.
+	Channels       int   // The amount of channels.
+	Delivered      int64 // The amount of messages delivered.
+	Published      int64 // The amount of messages published.
+	Queued         int   // The amount of messages queued.
+	QueuedBytes    int64 // The payload bytes of the messages queued.
+	Subscribers    int   // The amount of active subscribers.
+}
+
+// ChannelSnapshot holds information about a channel at a given moment, see Snapshot.
+type ChannelSnapshot struct {
+	Id              string // The id of the channel.
+	Stats           Stats  // The statistics of the channel.
+	LastContentType string // The content-type of the last message ("" if there is none).
+	LastSize        int    // The payload size of the last message in bytes.
 }
 
 // New creates a new pusher that is ready to be muxed into any ServeMux.
 // The new pusher (and any channel in it's context) will behave according
-// to the given configuration options are acceptor logic.
+// to the given configuration options are acceptor logic. Problems found by
+// Configuration.Validate are logged as warnings.
 func New(acceptor Acceptor, config Configuration) (p *pusher) {
 	p = &pusher{
 		acceptor: acceptor,
-		channels: make(map[string]*channel),
 		config:   config,
+		done:     make(chan bool),
+		drain:    make(chan bool),
+		drained:  make(chan bool),
+		started:  time.Nanoseconds(),
+	}
+	for i := range p.shards {
+		p.shards[i].channels = make(map[string]*channel)
+	}
+	if p.config.Logger == nil {
+		p.config.Logger = Logger
+	}
+	if p.config.CaseInsensitiveChannels {
+		// the handlers use the ids given by the acceptor verbatim
+		p.acceptor = NormalizingAcceptor(acceptor, strings.ToLower)
+	}
+	p.memory = newQueueMemory(p)
+	if err := config.Validate(); err != nil {
+		p.config.Logger.Print("Warning: ", err)
 	}
 
 	p.PublisherHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -41,11 +121,41 @@ func New(acceptor Acceptor, config Configuration) (p *pusher) {
 	p.SubscriberHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		p.handleSubscriber(rw, req)
 	})
+	p.SubscriberSSEHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleSSE(rw, req)
+	})
+	p.SubscriberMultipartHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleMultipart(rw, req)
+	})
+	p.SubscriberWebSocketHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleWebSocket(rw, req)
+	})
+	p.StatsHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleStats(rw, req)
+	})
+	p.MetricsHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleMetrics(rw, req)
+	})
+	p.HealthHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleHealth(rw, req, false)
+	})
+	p.ReadinessHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleHealth(rw, req, true)
+	})
 
-	if config.GCInterval > 0 && (config.MaxChannelIdleTime > 0 || config.MaxChannels > 0) {
+	if config.GCInterval > 0 && (config.MaxChannelIdleTime > 0 || config.MaxChannels > 0 || config.MessageTTL > 0) {
+		p.gc.Add(1)
 		go func() {
-			for _ = range time.Tick(config.GCInterval) {
-				p.GC()
+			ticker := time.NewTicker(config.GCInterval)
+			defer ticker.Stop()
+			defer p.gc.Done()
+			for {
+				select {
+				case <-ticker.C:
+					p.GC()
+				case <-p.done:
+					return
+				}
 			}
 		}()
 	}
@@ -53,253 +163,1690 @@ func New(acceptor Acceptor, config Configuration) (p *pusher) {
 	return
 }
 
+// Drain stops the pusher from taking on new work before shutting it down: from now on
+// requests to the publisher and subscriber locations (including the streaming ones) are
+// responded with a 503, as is the readiness probe. Unlike Close, Drain leaves the parked
+// subscribers alone, so they are delivered the messages published through Channel and
+// Publish or run into their polling timeouts as usual. Streams never run out, so they are
+// ended with a 503 instead, see handleStream.
+//
+// The returned channel is closed once no subscriber is parked anymore. Draining the pusher
+// again returns the same channel.
+func (p *pusher) Drain() <-chan bool {
+	if atomic.CompareAndSwapInt32(&p.draining, 0, 1) {
+		p.config.Logger.Print("Pusher draining")
+		close(p.drain)
+		if atomic.LoadInt32(&p.parked) > 0 {
+			go p.awaitDrained()
+		} else {
+			close(p.drained)
+		}
+	}
+	return p.drained
+}
+
+// DrainPollInterval is the interval (in ns) at which awaitDrained looks for parked subscribers.
+const drainPollInterval = 1e8
+
+// AwaitDrained closes the drained channel once no subscriber is parked anymore.
+func (p *pusher) awaitDrained() {
+	for atomic.LoadInt32(&p.parked) > 0 {
+		time.Sleep(drainPollInterval)
+	}
+	close(p.drained)
+}
+
+// IsDraining reports whether Drain has been called.
+func (p *pusher) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// Close shuts the pusher down. It drains the pusher first (see Drain) and waits up to the
+// DrainTimeout configuration option for the parked subscribers to finish. It stops the garbage
+// collector, so a pusher that is replaced, e.g. when reconfiguring, does not leak its
+// goroutine. The subscribers still active are released with a 410. Afterwards new subscribers
+// are responded with a 503. Close returns once the garbage collector has stopped; closing the
+// pusher again does nothing. The queues stored by the Persister configuration option are saved
+// and kept, unlike those of deleted channels.
+func (p *pusher) Close() {
+	drained := p.Drain()
+	if p.config.DrainTimeout > 0 {
+		select {
+		case <-drained:
+		case <-time.After(p.config.DrainTimeout):
+		}
+	}
+
+	p.lockAll()
+	if p.closed {
+		p.unlockAll()
+		return
+	}
+	p.closed = true
+	var closed []*channel
+	for i := range p.shards {
+		for _, c := range p.shards[i].channels {
+			c.close(p.config.synthetic(goneMessage))
+			closed = append(closed, c)
+		}
+	}
+	p.unlockAll()
+
+	// the stored queues are kept for the next pusher, so pending saves are completed
+	if p.config.Persister != nil {
+		for _, c := range closed {
+			c.save()
+		}
+	}
+
+	close(p.done)
+	p.gc.Wait()
+	p.config.Logger.Print("Pusher closed")
+}
+
+// Shard returns the shard holding the channel identified with the given channel id. The
+// ids are hashed using FNV-1a.
+func (p *pusher) shard(cid string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(cid); i++ {
+		h ^= uint32(cid[i])
+		h *= 16777619
+	}
+	return &p.shards[h%shardCount]
+}
+
+// LockAll locks all shards in order, see unlockAll.
+func (p *pusher) lockAll() {
+	for i := range p.shards {
+		p.shards[i].lock.Lock()
+	}
+}
+
+// UnlockAll unlocks all shards locked by lockAll.
+func (p *pusher) unlockAll() {
+	for i := range p.shards {
+		p.shards[i].lock.Unlock()
+	}
+}
+
+// Canonical returns the id cid stands for, i.e. cid in lower case if the
+// CaseInsensitiveChannels configuration option is set and cid itself otherwise.
+func (p *pusher) canonical(cid string) string {
+	if p.config.CaseInsensitiveChannels {
+		return strings.ToLower(cid)
+	}
+	return cid
+}
+
+// Lookup returns the channel identified with the given channel id, if it exists.
+func (p *pusher) lookup(cid string) (*channel, bool) {
+	cid = p.canonical(cid)
+	s := p.shard(cid)
+	s.lock.RLock()
+	c, ok := s.channels[cid]
+	s.lock.RUnlock()
+	return c, ok
+}
+
+// Snapshot returns the current channels in no particular order. The shards are visited
+// one at a time, so the pusher is never locked as a whole.
+func (p *pusher) snapshot() []*channel {
+	var channels []*channel
+	for i := range p.shards {
+		s := &p.shards[i]
+		s.lock.RLock()
+		for _, c := range s.channels {
+			channels = append(channels, c)
+		}
+		s.lock.RUnlock()
+	}
+	return channels
+}
+
 // Channel returns the channel identified with the given channel id. If the channel
 // does not yet exists, it will be created.
 func (p *pusher) Channel(cid string) (c *channel, created bool) {
-	p.lock.Lock()
-	c, ok := p.channels[cid]
+	cid = p.canonical(cid)
+	s := p.shard(cid)
+	s.lock.Lock()
+	c, ok := s.channels[cid]
 	if !ok {
 		created = true
-		c = newChannel(cid, &p.config)
-		p.channels[cid] = c
+		c = p.newChannel(cid)
+		s.channels[cid] = c
+	}
+	s.lock.Unlock()
+
+	if created {
+		p.channelCreated(c)
+	}
+	return
+}
+
+// NewChannel creates a new channel whose queue and parked subscribers are accounted to
+// the pusher, see MaxTotalQueuedBytes and MaxConcurrentSubscribers. The caller must add
+// it to its shard.
+func (p *pusher) newChannel(cid string) *channel {
+	c := newChannel(cid, &p.config)
+	c.memory = p.memory
+	c.parked = &p.parked
+	// the messages restored by the Persister are accounted as well
+	p.memory.add(c.stats.QueuedBytes)
+	return c
+}
+
+// ChannelCreated calls the OnChannelCreated configuration option, if set, and attaches
+// the presence channel of c if the PresenceChannels configuration option is set. It must
+// be called without holding any lock of the pusher.
+func (p *pusher) channelCreated(c *channel) {
+	if p.config.OnChannelCreated != nil {
+		p.config.OnChannelCreated(c.id)
+	}
+	if p.config.PresenceChannels && !isPresence(c.id) {
+		p.attachPresence(c)
+	}
+}
+
+// ChannelDestroyed calls the OnChannelDestroyed configuration option, if set, and deletes
+// the presence channel of the channel if the PresenceChannels configuration option is set.
+// It must be called without holding any lock of the pusher.
+func (p *pusher) channelDestroyed(cid string) {
+	if p.config.OnChannelDestroyed != nil {
+		p.config.OnChannelDestroyed(cid)
+	}
+	if p.config.PresenceChannels && !isPresence(cid) {
+		p.deleteChannel(cid + PresenceSuffix)
+	}
+}
+
+// Publish takes the given message and sends it to all active subscribers of the channel
+// identified with the given channel id, creating the channel if needed. It can also queue the
+// message for future requests. It returns the amount of subscribers the message was delivered to.
+func (p *pusher) Publish(cid string, m *Message, queue bool) int {
+	c, _ := p.Channel(cid)
+	n := c.Publish(m, queue)
+	p.memory.reclaim()
+	return n
+}
+
+// PublishString works like Publish, but sends the given string along with a text/plain
+// content-type and a 200 status.
+func (p *pusher) PublishString(cid, s string, queue bool) int {
+	return p.PublishBytes(cid, "text/plain", []byte(s), queue)
+}
+
+// PublishJSON works like Publish, but sends v marshalled as JSON along with an
+// application/json content-type and a 200 status. The channel is neither created nor
+// published to if v cannot be marshalled, in which case the error is returned.
+func (p *pusher) PublishJSON(cid string, v interface{}, queue bool) (int, os.Error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return p.PublishBytes(cid, "application/json", payload, queue), nil
+}
+
+// PublishBytes works like Publish, but sends the given payload along with the given
+// content-type and a 200 status.
+func (p *pusher) PublishBytes(cid, contentType string, payload []byte, queue bool) int {
+	return p.Publish(cid, NewMessage(contentType, payload), queue)
+}
+
+// PublishMulti works like Publish, but sends the message to all channels identified by the
+// given channel ids at once. All channels are resolved (and created if needed) first and then
+// locked together, so the message is delivered to every channel before any of them can receive
+// another message. The message gets the same time, etag and sequence number in every channel,
+// chosen to be greater than those of any earlier message in the channels. It returns the total
+// amount of subscribers the message was delivered to.
+func (p *pusher) PublishMulti(cids []string, m *Message, queue bool) int {
+	// publishChannels needs distinct channels sorted by their ids
+	sorted := make([]string, len(cids))
+	for i, cid := range cids {
+		sorted[i] = p.canonical(cid)
+	}
+	sort.Strings(sorted)
+
+	var channels []*channel
+	for i, cid := range sorted {
+		if i > 0 && cid == sorted[i-1] {
+			continue
+		}
+		c, _ := p.Channel(cid)
+		channels = append(channels, c)
+	}
+	return publishChannels(channels, m, queue)
+}
+
+// Broadcast works like PublishMulti, but sends the message to every current channel. The set
+// of channels is snapshotted first, so the pusher is not locked while delivering.
+func (p *pusher) Broadcast(m *Message, queue bool) int {
+	channels := p.snapshot()
+	sort.Sort(channelsById(channels))
+	return publishChannels(channels, m, queue)
+}
+
+// ChannelsById provides sort.Interface to sort channels by their ids.
+type channelsById []*channel
+
+func (cs channelsById) Len() int {
+	return len(cs)
+}
+
+func (cs channelsById) Less(i, j int) bool {
+	return cs[i].id < cs[j].id
+}
+
+func (cs channelsById) Swap(i, j int) {
+	cs[i], cs[j] = cs[j], cs[i]
+}
+
+// PublishChannels publishes m to all of the given distinct channels at once, see PublishMulti.
+// The channels must be sorted by their ids, which is the order they are locked in to avoid
+// deadlocks.
+func publishChannels(channels []*channel, m *Message, queue bool) (n int) {
+	now := time.Nanoseconds()
+	for _, c := range channels {
+		c.lock.Lock()
+	}
+
+	// the message is shared, so its time is the latest one any of the channels allows
+	m.time = 0
+	for _, c := range channels {
+		if t := c.publishTime(m.Time, now); t > m.time {
+			m.time = t
+		}
+	}
+	m.seq, m.etag = 0, 0
+	for _, c := range channels {
+		seq, etag := c.next(m.time)
+		if seq > m.seq {
+			m.seq = seq
+		}
+		if etag > m.etag {
+			m.etag = etag
+		}
+	}
+	for _, c := range channels {
+		c.advance(m)
+		n += c.deliver(m, queue, now)
+	}
+
+	for _, c := range channels {
+		c.lock.Unlock()
+	}
+	for _, c := range channels {
+		c.announce()
+	}
+	if len(channels) > 0 {
+		// the channels share the memory of their pusher
+		channels[0].memory.reclaim()
+	}
+	return
+}
+
+// HasChannel reports whether the channel identified with the given channel id exists. Unlike
+// Channel, it never creates the channel.
+func (p *pusher) HasChannel(cid string) bool {
+	_, ok := p.lookup(cid)
+	return ok
+}
+
+// DeleteChannel deletes the channel identified with the given channel id. Active subscribers
+// will receive a 410 along with an X-Gone-Reason header of deleted. It reports whether the
+// channel existed.
+func (p *pusher) DeleteChannel(cid string) bool {
+	return p.deleteChannel(cid) != nil
+}
+
+// DeleteChannel deletes the channel identified with the given channel id and returns it, or nil
+// if it did not exist. The subscribers are released while still holding the lock of the shard,
+// since subscriptions are made under it too, so no one can look the deleted channel up afterwards.
+// Those who looked it up before receive a 410 instead of being parked, see channel.close. Its
+// stored queue is deleted after the lock is released.
+func (p *pusher) deleteChannel(cid string) *channel {
+	cid = p.canonical(cid)
+	s := p.shard(cid)
+	s.lock.Lock()
+	c, ok := s.channels[cid]
+	if !ok {
+		s.lock.Unlock()
+		return nil
+	}
+	s.channels[cid] = nil, false
+	c.close(p.config.synthetic(deletedMessage))
+	s.lock.Unlock()
+	// without the lock of the shard, as it waits for a pending save and does I/O
+	c.unpersist()
+
+	p.channelDestroyed(cid)
+	return c
+}
+
+// Peek returns a copy of the most recent message published to the channel identified with
+// the given channel id, see channel.Peek. It reports whether there was such a message. Unlike
+// Channel, it never creates the channel.
+func (p *pusher) Peek(cid string) (*Message, bool) {
+	c, ok := p.lookup(cid)
+	if !ok {
+		return nil, false
+	}
+	m := c.Peek()
+	return m, m != nil
+}
+
+// ClearChannel drops all queued messages of the channel identified with the given channel id,
+// see channel.Clear. It reports whether the channel existed.
+func (p *pusher) ClearChannel(cid string) bool {
+	c, ok := p.lookup(cid)
+	if ok {
+		c.Clear()
+	}
+	return ok
+}
+
+// Channels returns a snapshot of the ids of the current channels.
+func (p *pusher) Channels() []string {
+	channels := p.snapshot()
+	ids := make([]string, len(channels))
+	for i, c := range channels {
+		ids[i] = c.id
+	}
+	return ids
+}
+
+// ChannelStats returns a snapshot of the statistics of the current channels keyed by
+// their ids.
+func (p *pusher) ChannelStats() map[string]Stats {
+	channels := p.snapshot()
+	stats := make(map[string]Stats, len(channels))
+	for _, c := range channels {
+		stats[c.id] = c.Stats()
+	}
+	return stats
+}
+
+// Snapshot returns the ids of the current channels along with their statistics and
+// information about their last messages, in no particular order. Each channel is copied
+// under a brief read lock and no lock is held once Snapshot returns, so the result may be
+// formatted at leisure, e.g. on an admin page.
+func (p *pusher) Snapshot() []ChannelSnapshot {
+	channels := p.snapshot()
+	snapshots := make([]ChannelSnapshot, len(channels))
+	for i, c := range channels {
+		snapshots[i].Id = c.id
+		snapshots[i].Stats = c.Stats()
+		c.lock.RLock()
+		if m := c.lastMessage; m != nil && m.Status == http.StatusOK {
+			snapshots[i].LastContentType = m.ContentType
+			snapshots[i].LastSize = len(m.Payload)
+		}
+		c.lock.RUnlock()
+	}
+	return snapshots
+}
+
+// Stats returns a snapshot of the statistics aggregated over all channels.
+func (p *pusher) Stats() (stats GlobalStats) {
+	channels := p.snapshot()
+	stats.Channels = len(channels)
+	for _, c := range channels {
+		s := c.Stats()
+		stats.BytesDelivered += s.BytesDelivered
+		stats.BytesPublished += s.BytesPublished
+		stats.Delivered += s.Delivered
+		stats.Published += s.Published
+		stats.Queued += s.Queued
+		stats.QueuedBytes += s.QueuedBytes
+		stats.Subscribers += s.Subscribers
 	}
-	p.lock.Unlock()
 	return
 }
 
 // GC does garbage collection by collecting stale channels (see MaxChannelIdleTime
 // configuration option) and purges them. It also removes as many channels (least
 // active first) as needed until there are no more than MaxChannels (configuration option)
-// channels.
+// channels. Finally the messages that have outlived the MessageTTL configuration option
+// are dropped from the remaining channels.
+//
+// Active subscribers of collected channels receive a 410 along with an X-Gone-Reason header of
+// collected and, if the GCRetryAfter configuration option is set, a Retry-After header.
+//
+// The OnChannelGC configuration option is called for every collected channel along with
+// the stats it had when it was collected. It is called without holding any locks, so it
+// may use the pusher.
+//
+// If MaxChannels is set, the channels are arranged into a heap in linear time and only the
+// collected ones are taken off it, so a run costs O(n + k log n) for n channels of which k
+// are collected. Otherwise the stale channels are collected without copying the others.
 //
-// TODO: This is a really naive implementation and will not scale if there are billions
-// of channels. We could do better.
+// GC runs synchronously on the calling goroutine and returns the amount of collected
+// channels. Besides being run every GCInterval (configuration option), it may be called at
+// any time, e.g. from tests or when the process is short of memory, even if GCInterval is 0.
+// Concurrent runs are safe. See GCChannels for the ids of the collected channels.
+//
+// Every collected channel is logged on a line of its own, followed by a single summary line
+// for the run. Runs that collect nothing are not logged at all, so that an idle pusher does not
+// flood the log every GCInterval.
 func (p *pusher) GC() int {
-	var i int
-	var c *channel
+	return len(p.GCChannels())
+}
 
+// GCChannels works like GC, but returns the ids of the collected channels in the order they
+// were collected, i.e. least active first if MaxChannels is set and in no particular order
+// otherwise.
+func (p *pusher) GCChannels() (ids []string) {
 	start := time.Nanoseconds()
 	limit := (start - p.config.MaxChannelIdleTime) / 1e9
-	count := len(p.channels)
 
-	Logger.Printf("GC: Started with %d channels", count)
+	var gc []*channel
+	var scanned int
+	if p.config.MaxChannels > 0 {
+		gc, scanned = p.collectLeastActive(limit)
+	} else if p.config.MaxChannelIdleTime > 0 {
+		gc, scanned = p.collectIdle(limit)
+	}
 
-	p.lock.Lock()
-	sorted := make(channelSlice, len(p.channels))
-	for _, c = range p.channels {
-		sorted[i] = c
-		i++
+	for _, c := range gc {
+		ids = append(ids, c.id)
+		stats := c.Stats()
+		c.close(p.config.synthetic(collectedMessage))
+		c.unpersist()
+		p.config.Logger.Printf("GC: Channel %q was garbage collected", c.id)
+		if p.config.OnChannelGC != nil {
+			p.config.OnChannelGC(c.id, stats)
+		}
+		p.channelDestroyed(c.id)
 	}
-	sort.Sort(sorted)
-	gc := sorted[:0]
-	for i, c = range sorted {
-		if (p.config.MaxChannels == 0 || count <= p.config.MaxChannels) && c.stamp() >= limit {
+
+	if p.config.MessageTTL > 0 {
+		for _, c := range p.snapshot() {
+			c.Prune()
+		}
+	}
+
+	if len(gc) > 0 {
+		p.config.Logger.Printf("GC: Collected %d of %d channels in %d ns", len(gc), scanned, time.Nanoseconds()-start)
+	}
+	return
+}
+
+// CollectLeastActive removes and returns the channels idle since before limit (in seconds,
+// see MaxChannelIdleTime) and as many of the least active channels as needed until there are
+// no more than MaxChannels (configuration option) channels, along with the amount of channels
+// scanned.
+func (p *pusher) collectLeastActive(limit int64) (gc []*channel, scanned int) {
+	// the amount of channels must not change while collecting
+	p.lockAll()
+	defer p.unlockAll()
+
+	var h channelHeap
+	for i := range p.shards {
+		for _, c := range p.shards[i].channels {
+			// the stamp only takes the stats lock, so publishing channels do not hold up the scan
+			if !c.owned {
+				h = append(h, stampedChannel{c, c.stamp()})
+			}
+		}
+	}
+	// presence channels are neither counted nor collected, they go along with their channels
+	count := len(h)
+	scanned = count
+	heap.Init(&h)
+
+	for h.Len() > 0 {
+		if count <= p.config.MaxChannels && (p.config.MaxChannelIdleTime == 0 || h[0].stamp >= limit) {
 			break
 		}
-		gc = sorted[:i+1]
-		p.channels[c.id] = nil, false
+		c := heap.Pop(&h).(stampedChannel).c
+		gc = append(gc, c)
+		p.shard(c.id).channels[c.id] = nil, false
 		count--
 	}
-	p.lock.Unlock()
+	return
+}
 
-	for _, c := range gc {
-		c.Publish(goneMessage, false)
-		Logger.Printf("GC: Channel %q was garbage collected", c.id)
+// CollectIdle removes and returns the channels idle since before limit (in seconds, see
+// MaxChannelIdleTime) along with the amount of channels scanned. Without MaxChannels there
+// is no need to order the channels, so the shards are scanned one at a time and only the
+// collected channels are copied.
+func (p *pusher) collectIdle(limit int64) (gc []*channel, scanned int) {
+	for i := range p.shards {
+		s := &p.shards[i]
+		s.lock.Lock()
+		scanned += len(s.channels)
+		for cid, c := range s.channels {
+			if !c.owned && c.stamp() < limit {
+				gc = append(gc, c)
+				s.channels[cid] = nil, false
+			}
+		}
+		s.lock.Unlock()
 	}
+	return
+}
 
-	Logger.Printf("GC: Ended in %d ns with %d channels garbage collected", time.Nanoseconds()-start, len(gc))
-	return len(gc)
+// The buffers reading the bodies of published messages are kept in a free list, so that
+// they can be reused instead of allocating new ones on every publish. Buffers that have
+// grown beyond maxPooledBuffer bytes are left to the garbage collector.
+var bufferPool = make(chan *bytes.Buffer, 64)
+
+const maxPooledBuffer = 64 << 10
+
+// GetBuffer returns an empty buffer from the free list or a new one if the list is empty.
+func getBuffer() *bytes.Buffer {
+	select {
+	case buf := <-bufferPool:
+		buf.Reset()
+		return buf
+	default:
+	}
+	return new(bytes.Buffer)
+}
+
+// PutBuffer returns buf to the free list, unless it is full or buf is too large.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Len() > maxPooledBuffer {
+		return
+	}
+	select {
+	case bufferPool <- buf:
+	default:
+	}
 }
 
 // HandlePublisher is responsible for answering requests to the publisher locations. It will use
 // the pusher's acceptor to extract the channel. If acceptor does not provide a non-empty channel id,
-// then a 404 will be returned. Otherwise the handler will take actions based on the http method of
+// then a 404 will be returned. This includes acceptors denying with Redirect, as a login page is
+// of no use to a publisher. A channel id longer than the MaxChannelIdLength configuration option
+// yields a 400. Otherwise the handler will take actions based on the http method of
 // the request. All 200-level responses will be paired with information about the channel requested
 // encoded in a format requested via the Accept-header.
 //
-// - GET     Yields a 404 if the channel does not exists, 200 otherwise
-// - PUT     Tries to create the channel and yield 200
-// - POST    Creates a new message using the request's body and content-type (unless the content-type is
-//           explictly overridden using the ContentType configuration option). It will create the channel
-//           if needed and it yields a 201 if the message was immediately delivered to atleast one
-//           subscriber and 202 otherwise.
-// - DELETE  Deletes the channel. Active subscribers will receive a 410. If the channel existed, a 200
-//           will be responded, 404 otherwise.
-// 
+// - GET     Yields a 404 if the channel does not exists, 200 otherwise. If the Accept-header asks for
+//           none of the stat formats, the payload and content-type of the channel's last message are
+//           responded instead, or a 404 if nothing has been published yet.
+// - PUT     Tries to create the channel and yield 200. The body may hold a JSON object of options for
+//           the channel, see channelOptions, e.g. {"capacity":100,"contentType":"application/json"}.
+//           An invalid body yields a 400. If the SubscriberLocationTemplate configuration option is
+//           set, the response carries a Location header pointing subscribers at the channel.
+// - POST    Creates a new message using the request's body and content-type (unless the
+//           content-type is explicitly overridden for the channel, see SetContentType, or using the
+//           ContentType configuration option). It will create the channel if needed and it yields a
+//           201 if the message was immediately delivered to at least one subscriber and 202
+//           otherwise. If the channel's publish rate exceeds the MaxPublishRate configuration
+//           option, a 429 is yielded instead. A body larger than the MaxMessageSize configuration
+//           option yields a 413. If the X-Message-Id header of the request matches the id of a
+//           recent message, the message is dropped as a duplicate and a 200 is yielded along with
+//           the Etag and X-Msg-Id of the earlier message. The 201 and 202 responses carry the Etag
+//           and X-Msg-Id assigned to the published message, i.e. those its subscribers receive. If
+//           the queue of the channel is full and the QueuePolicy configuration option is
+//           QueuePolicyRejectWhenFull, a 507 is yielded. Likewise a message identical to the last
+//           message of the channel is coalesced into it (see the CoalesceWindow configuration
+//           option) and a 200 is yielded. If the request has an If-Match header, the message is
+//           published only if it matches the Etag of the last message of the channel (or is * and
+//           there is a last message), a 412 is yielded otherwise. A request with an X-Stream header
+//           of true is published as a stream of messages instead, see publishStream.
+// - DELETE  Deletes the channel. Active subscribers will receive a 410 along with an X-Gone-Reason
+//           header of deleted. If the channel existed, a 200 will be responded, 404 otherwise.
+//
+// A HEAD request is answered like a GET request, but without the body. An OPTIONS request yields a 204
+// along with an Allow header, regardless of the channel. Once the pusher is draining (see Drain), any
+// other request yields a 503.
+//
 // Any other request using a method other than those that were described above will be responded with a
 // 405 response.
 func (p *pusher) handlePublisher(rw http.ResponseWriter, req *http.Request) {
+	p.setCORSHeaders(rw, publisherMethods, "Content-Type, Accept")
+	if req.Method == "OPTIONS" {
+		p.config.Logger.Printf("Pub/204: Options retrieved [%s]", req.RemoteAddr)
+		rw.Header().Set("Allow", publisherMethods)
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	} else if p.isDraining() {
+		p.config.Logger.Printf("Pub/503: A %s request to a draining pusher [%s]", req.Method, req.RemoteAddr)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	cid := p.acceptor(req)
-	if cid == "" {
-		Logger.Printf("Pub/404: Acceptor denied access to URL %q [%s]", req.RawURL, req.RemoteAddr)
+	if location := redirectLocation(cid); location != "" {
+		p.config.Logger.Printf("Pub/404: Acceptor denied access to URL %q with a redirect to %q [%s]", req.RawURL, location, req.RemoteAddr)
 		rw.WriteHeader(http.StatusNotFound)
 		return
+	} else if cid == "" {
+		p.config.Logger.Printf("Pub/404: Acceptor denied access to URL %q [%s]", req.RawURL, req.RemoteAddr)
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if p.isTooLong(cid) {
+		p.config.Logger.Printf("Pub/400: A channel id of %d bytes is too long [%s]", len(cid), req.RemoteAddr)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
 	status := http.StatusMethodNotAllowed
 	var c *channel
 	var ok bool
 
+	if req.Method == "HEAD" {
+		rw = headResponseWriter{rw}
+	}
+
 	switch req.Method {
-	case "GET":
-		p.lock.RLock()
-		c, ok = p.channels[cid]
-		p.lock.RUnlock()
+	case "GET", "HEAD":
+		c, ok = p.lookup(cid)
 
-		if ok {
-			Logger.Printf("Pub/200: Channel information retrieved for %q [%s]", cid, req.RemoteAddr)
+		if ok && !acceptsStats(req) {
+			message := c.last()
+			if message == nil {
+				p.config.Logger.Printf("Pub/404: Channel %q has no message to retrieve [%s]", cid, req.RemoteAddr)
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			p.config.Logger.Printf("Pub/200: Last message retrieved from channel %q [%s]", cid, req.RemoteAddr)
+			if message.ContentType != "" {
+				rw.Header().Set("Content-Type", message.ContentType)
+			}
+			rw.WriteHeader(http.StatusOK)
+			if _, err := rw.Write(message.Payload); err != nil {
+				p.config.Logger.Print("handlePublisher:", err)
+			}
+			return
+		} else if ok {
+			p.config.Logger.Printf("Pub/200: Channel information retrieved for %q [%s]", cid, req.RemoteAddr)
 			status = http.StatusOK
 		} else {
-			Logger.Printf("Pub/404: Channel information retrieved for %q [%s]", cid, req.RemoteAddr)
+			p.config.Logger.Printf("Pub/404: Channel information retrieved for %q [%s]", cid, req.RemoteAddr)
 			status = http.StatusNotFound
 		}
 
 	case "PUT":
+		opts, err := parseChannelOptions(req)
+		if err != nil {
+			p.config.Logger.Printf("Pub/400: Invalid options for channel %q: %s [%s]", cid, err, req.RemoteAddr)
+			status = http.StatusBadRequest
+			break
+		}
+
 		c, ok = p.Channel(cid)
 		if ok {
-			Logger.Printf("Pub/200: Channel %q created [%s]", cid, req.RemoteAddr)
+			p.config.Logger.Printf("Pub/200: Channel %q created [%s]", cid, req.RemoteAddr)
 		} else {
-			Logger.Printf("Pub/200: Channel %q was already created [%s]", cid, req.RemoteAddr)
+			p.config.Logger.Printf("Pub/200: Channel %q was already created [%s]", cid, req.RemoteAddr)
+		}
+		if opts.Capacity != nil {
+			c.SetCapacity(*opts.Capacity)
+		}
+		if opts.ContentType != nil {
+			c.SetContentType(*opts.ContentType)
+		}
+		if tmpl := p.config.SubscriberLocationTemplate; tmpl != "" && isLocationTemplate(tmpl) {
+			rw.Header().Set("Location", fmt.Sprintf(tmpl, escapeSegment(cid)))
 		}
 		status = http.StatusOK
 
 	case "POST":
-		var buf bytes.Buffer
-		if _, err := buf.ReadFrom(req.Body); err != nil {
-			Logger.Print("ReadFrom(req.Body):", err)
-			status = http.StatusInternalServerError
+		if req.Header.Get("X-Stream") == "true" {
+			c, status = p.publishStream(req, cid)
+			break
+		}
+
+		max := p.config.MaxMessageSize
+		if max > 0 && req.ContentLength > max {
+			p.config.Logger.Printf("Pub/413: A message of %d bytes was rejected in channel %q [%s]", req.ContentLength, cid, req.RemoteAddr)
+			status = http.StatusRequestEntityTooLarge
 			break
 		}
 
-		ctype := p.config.ContentType
-		if ctype == "" {
-			ctype = req.Header.Get("Content-Type")
+		var body io.Reader = req.Body
+		if max > 0 {
+			// reading a byte past the limit tells whether the body exceeds it
+			body = io.LimitReader(req.Body, max+1)
+		}
+
+		buf := getBuffer()
+		defer putBuffer(buf)
+		if _, err := buf.ReadFrom(body); err != nil {
+			p.config.Logger.Print("ReadFrom(req.Body):", err)
+			status = http.StatusInternalServerError
+			break
+		}
+		if max > 0 && int64(buf.Len()) > max {
+			p.config.Logger.Printf("Pub/413: A message of over %d bytes was rejected in channel %q [%s]", max, cid, req.RemoteAddr)
+			status = http.StatusRequestEntityTooLarge
+			break
 		}
 
 		c, _ = p.Channel(cid)
 
-		if c.Publish(&Message{Status: http.StatusOK, ContentType: ctype, Payload: buf.Bytes()}, true) > 0 {
-			Logger.Printf("Pub/201: A message was published to channel %q and delivered simultaneously to some clients [%s]", cid, req.RemoteAddr)
+		if !c.Allow() {
+			p.config.Logger.Printf("Pub/429: Publish rate exceeded in channel %q [%s]", cid, req.RemoteAddr)
+			status = StatusTooManyRequests
+			break
+		}
+
+		// the buffer is reused, but the payload outlives the request
+		payload := make([]byte, buf.Len())
+		copy(payload, buf.Bytes())
+
+		m := NewMessage(p.contentType(c, req), payload)
+		m.Id = req.Header.Get("X-Message-Id")
+		n, original, err := c.publishIf(m, true, req.Header.Get("If-Match"))
+		p.memory.reclaim()
+		if err == ErrQueueFull {
+			p.config.Logger.Printf("Pub/507: A message was rejected by the full queue of channel %q [%s]", cid, req.RemoteAddr)
+			status = StatusInsufficientStorage
+		} else if err == ErrPreconditionFailed {
+			p.config.Logger.Printf("Pub/412: A message was rejected by a stale If-Match in channel %q [%s]", cid, req.RemoteAddr)
+			status = http.StatusPreconditionFailed
+		} else if original != nil && m.Id != "" && m.Id == original.Id {
+			p.config.Logger.Printf("Pub/200: A duplicate message %q was dropped in channel %q [%s]", m.Id, cid, req.RemoteAddr)
+			setMessageIds(rw, original)
+			status = http.StatusOK
+		} else if original != nil {
+			p.config.Logger.Printf("Pub/200: An identical message was coalesced in channel %q [%s]", cid, req.RemoteAddr)
+			setMessageIds(rw, original)
+			status = http.StatusOK
+		} else if n > 0 {
+			p.config.Logger.Printf("Pub/201: A message was published to channel %q and delivered simultaneously to some clients [%s]", cid, req.RemoteAddr)
+			setMessageIds(rw, m)
 			status = http.StatusCreated
 		} else {
-			Logger.Printf("Pub/202: A message was queued to channel %q [%s]", cid, req.RemoteAddr)
+			p.config.Logger.Printf("Pub/202: A message was queued to channel %q [%s]", cid, req.RemoteAddr)
+			setMessageIds(rw, m)
 			status = http.StatusAccepted
 		}
 
 	case "DELETE":
-		p.lock.Lock()
-		c, ok = p.channels[cid]
-		if ok {
-			p.channels[cid] = nil, false
-			p.lock.Unlock()
-			c.Publish(goneMessage, false)
-			Logger.Printf("Pub/200: Channel %q was deleted [%s]", cid, req.RemoteAddr)
+		if c = p.deleteChannel(cid); c != nil {
+			p.config.Logger.Printf("Pub/200: Channel %q was deleted [%s]", cid, req.RemoteAddr)
 			status = http.StatusOK
 		} else {
-			p.lock.Unlock()
-			Logger.Printf("Pub/404: Trying to delete a non-existent channel %q [%s]", cid, req.RemoteAddr)
+			p.config.Logger.Printf("Pub/404: Trying to delete a non-existent channel %q [%s]", cid, req.RemoteAddr)
 			status = http.StatusNotFound
 		}
 	}
 
+	if status == http.StatusMethodNotAllowed {
+		p.config.Logger.Printf("Pub/405: A %s request to channel %q [%s]", req.Method, cid, req.RemoteAddr)
+		rw.Header().Set("Allow", publisherMethods)
+	}
+
 	rw.WriteHeader(status)
 	if status >= 200 && status < 300 && c != nil {
 		if err := c.writeStats(rw, req); err != nil {
-			Logger.Print("writeStats:", err)
+			p.config.Logger.Print("writeStats:", err)
 		}
 	}
 	return
 }
 
+// The largest chunk of a streamed body published as a single message, see publishStream.
+const maxStreamChunk = 32 << 10
+
+// PublishStream publishes the body of the POST request req to the channel cid as it arrives
+// instead of buffering it first. Every chunk read from the body is published as a message of
+// its own carrying the content-type of the request, so streaming subscribers (SSE, multipart
+// and WebSocket) receive the data incrementally. A chunk is whatever a single read of the body
+// yields, up to maxStreamChunk bytes or the MaxMessageSize configuration option, whichever is
+// smaller. Chunks are never deduplicated nor coalesced.
+//
+// The chunks are queued like any other message, so that a streaming subscriber does not miss
+// the chunks published while it is writing the previous one. Subscribers of channels without a
+// queue only receive the chunks published while they are waiting.
+//
+// It returns the channel along with a 201 if any chunk was delivered immediately to a
+// subscriber, a 202 otherwise. The publish rate is checked once for the whole stream. A
+// failure reading the body yields a 500, but the chunks read so far stay published.
+func (p *pusher) publishStream(req *http.Request, cid string) (c *channel, status int) {
+	c, _ = p.Channel(cid)
+	if !c.Allow() {
+		p.config.Logger.Printf("Pub/429: Publish rate exceeded in channel %q [%s]", cid, req.RemoteAddr)
+		return c, StatusTooManyRequests
+	}
+
+	size := maxStreamChunk
+	if max := p.config.MaxMessageSize; max > 0 && max < int64(size) {
+		size = int(max)
+	}
+	buf := make([]byte, size)
+	ctype := p.contentType(c, req)
+	chunks, delivered := 0, 0
+	for {
+		n, err := req.Body.Read(buf)
+		if n > 0 {
+			// the buffer is reused, but the payload outlives the request
+			payload := make([]byte, n)
+			copy(payload, buf[:n])
+			delivered += c.publishChunk(NewMessage(ctype, payload))
+			p.memory.reclaim()
+			chunks++
+		}
+		if err == os.EOF {
+			break
+		} else if err != nil {
+			p.config.Logger.Printf("Pub/500: A stream broke after %d chunks in channel %q: %s [%s]", chunks, cid, err, req.RemoteAddr)
+			return c, http.StatusInternalServerError
+		}
+	}
+
+	if delivered > 0 {
+		p.config.Logger.Printf("Pub/201: A stream of %d chunks was published to channel %q and delivered simultaneously to some clients [%s]", chunks, cid, req.RemoteAddr)
+		return c, http.StatusCreated
+	}
+	p.config.Logger.Printf("Pub/202: A stream of %d chunks was queued to channel %q [%s]", chunks, cid, req.RemoteAddr)
+	return c, http.StatusAccepted
+}
+
+// ChannelOptions are the per-channel options a publisher may send in the body of a PUT request.
+// Absent options are left untouched.
+type channelOptions struct {
+	Capacity    *int    // Overrides the ChannelCapacity configuration option.
+	ContentType *string // Overrides the ContentType configuration option, see SetContentType.
+}
+
+// ContentType returns the content-type of a message published to c by req: the content-type
+// set for the channel, or else the ContentType configuration option, or else the content-type
+// of the request.
+func (p *pusher) contentType(c *channel, req *http.Request) string {
+	if ctype := c.ContentType(); ctype != "" {
+		return ctype
+	}
+	if p.config.ContentType != "" {
+		return p.config.ContentType
+	}
+	return req.Header.Get("Content-Type")
+}
+
+// ParseChannelOptions decodes the channel options in the body of req. An empty body yields no
+// options, whereas a malformed body or an out-of-range option yields an error.
+func parseChannelOptions(req *http.Request) (opts channelOptions, err os.Error) {
+	if err = json.NewDecoder(req.Body).Decode(&opts); err == os.EOF {
+		return opts, nil
+	} else if err != nil {
+		return
+	}
+	if opts.Capacity != nil && *opts.Capacity < 0 {
+		err = fmt.Errorf("capacity is negative (%d)", *opts.Capacity)
+	}
+	return
+}
+
+// EscapeSegment escapes s for use as a single path segment (or query value) of a URL: every
+// byte except the unreserved characters of RFC 3986 is percent-encoded, so that neither a
+// space turns into a + nor a slash starts another segment.
+func escapeSegment(s string) string {
+	const hex = "0123456789ABCDEF"
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~':
+			buf = append(buf, b)
+		default:
+			buf = append(buf, '%', hex[b>>4], hex[b&15])
+		}
+	}
+	return string(buf)
+}
+
+// SetMessageIds sets the Etag and X-Msg-Id headers of a publisher response to those assigned
+// to message, so that publishers can correlate the message with what subscribers receive.
+func setMessageIds(rw http.ResponseWriter, message *Message) {
+	rw.Header().Set("Etag", strconv.Itoa(message.etag))
+	rw.Header().Set("X-Msg-Id", strconv.Itoa64(message.seq))
+}
+
 // HandleSubscriber is responsible for answering requests to the subscriber locations. It will use
-// the pusher's acceptor to extract the channel. If acceptor does not provide a non-empty channel id,
-// then a 404 will be returned. If the request method is other than GET then a 405 will be returned.
-// If the channel does not exists, the handler will either reject or create the channel depending on
-// the AllowChannelCreation configuration option.
+// the pusher's acceptor to extract the channel. If acceptor does not provide a non-empty channel
+// id, then a 404 will be returned, unless the acceptor denied with Redirect, which yields a 302
+// with the given Location. A channel id longer than the MaxChannelIdLength configuration option
+// yields a 400. If the request method is other than GET or HEAD then a 405 will be returned. A HEAD
+// request is never parked, but answered with the headers of the currently available message (or a
+// 304) without the body. An OPTIONS request yields a 204 along with an Allow header. If the channel
+// does not exists, the handler will either reject or create the channel depending on the
+// AllowChannelCreation configuration option.
 //
 // The handler uses If-Modified-Since and If-None-Match headers to determine which message the client
 // requested. If these are omitted, then the oldest available message is used. All 200-level responses
 // will contain Etag and Last-Modified headers for the client to use during it's next request.
+// Additionally every message carries a per-channel sequence number in the X-Msg-Id header. A client
+// passing it back in the X-Last-Msg-Id header receives the oldest message published after it, which
+// avoids any ambiguity of If-Modified-Since and If-None-Match with messages published within the same
+// second.
+//
+// Of the queued messages following the position of the client, those of a higher priority are
+// delivered first. Their Etag, Last-Modified and X-Msg-Id headers still tell the position before
+// the older messages not yet delivered, and the X-Served-Msg-Ids header lists the sequence numbers
+// of the messages delivered beyond it, e.g. "6,8". A client passes it back in the same request
+// header, so that it receives neither message again, see channel.position. Besides HTTP dates,
+// If-Modified-Since accepts RFC 1123 dates with numeric zones and RFC 3339 timestamps. A malformed
+// value in any of these headers yields a 400.
 //
 // The PollingMechanism and ConcurrencyMode configuration options affect the behavior of this handler.
 // If long-polling is used, the response is delayed until a message has become available or a period
 // defined by the configuration option PollingTimeout has passed. The request will be responded with
-// a 304 if no message was available or with a 200 along with the ContentType and Payload from the
-// message. Additionally a 409 might be responded depending on the used ConcurrencyMode. See the
-// documentation for ConcurrencyModeBroadcast, ConcurrencyModeFILO and ConcurrencyModeLIFO for
-// details.
+// a 304 (or the EmptyResponseStatus configuration option) if no message was available or with a 200
+// along with the ContentType and Payload from the message. Additionally a 409 along with an
+// X-Conflict-Reason header might be responded depending on the used ConcurrencyMode. See the
+// documentation for ConcurrencyModeBroadcast, ConcurrencyModeFILO, ConcurrencyModeLIFO and
+// ConcurrencyModeExclusive for details. The body of a 409 or 410 may be replaced using the
+// ConflictMessage and GoneMessage configuration options. With interval-polling the response is
+// delayed for up to the IntervalMinWait configuration option instead, which is 0 (respond at once)
+// by default.
+//
+// If the channel already has MaxSubscribersPerChannel (configuration option) active subscribers,
+// or the pusher already has MaxConcurrentSubscribers (configuration option) parked subscribers
+// across all channels, a 503 is responded along with a Retry-After header instead of parking
+// another subscriber.
+//
+// Once the pusher has been drained or closed, a 503 is responded.
+//
+// A client accepting multipart/mixed receives every available message newer than the requested
+// one at once, as the parts of a multipart/mixed response. The Etag, Last-Modified and X-Msg-Id
+// headers then identify the newest message of the batch.
+//
+// If the GzipMinSize configuration option is set, payloads of at least GzipMinSize bytes are
+// compressed using gzip for clients accepting it, unless their content-type is compressed already
+// (e.g. images).
+//
+// The time from receiving the request until responding is logged for parked subscribers and
+// passed to the OnSubscribeComplete configuration option (if set) along with the response status.
+//
+// If the HeartbeatInterval configuration option is set, a single space is written to a parked
+// long-polling subscriber every HeartbeatInterval to keep intermediate proxies from closing the
+// connection. Once a heartbeat has been written, the response is committed as a 200 and only the
+// payload of the eventual message will be delivered (or an empty body on timeout), so heartbeats
+// are best suited for payloads where leading whitespace is harmless, e.g. JSON.
+//
+// If the JSONPCallback configuration option is set and the request carries the named query
+// parameter, the response is delivered as JSONP instead. See writeJSONP for details.
+//
+// If the PatternSubscriptions configuration option is set, a channel id containing any of the
+// special characters of path.Match is a pattern subscribing to every existing channel matching it
+// (or yielding a 404 if there is none). The first message of any of the channels is delivered along
+// with an X-Channel header naming the channel. The Etag, Last-Modified and X-Msg-Id headers are
+// those of the channel, but the request headers are compared against every matching channel.
+//
+// A long-polling subscriber may shorten its timeout with an X-Poll-Timeout header (in seconds),
+// e.g. to stay below the idle timeout of a proxy in between. See pollingTimeout for details.
 func (p *pusher) handleSubscriber(rw http.ResponseWriter, req *http.Request) {
+	start := time.Nanoseconds()
 	cid := p.acceptor(req)
 	var status int
-	var since int64
+	var since, seq int64
+	var served []int64
+	var etag int
+	var err os.Error
+	var callback string
+	var parked bool
 
-	rw.Header().Set("Vary", "If-None-Match, If-Modified-Since")
+	defer func() {
+		waited := time.Nanoseconds() - start
+		if parked {
+			p.config.Logger.Printf("Sub/%d: Subscriber of channel %q waited %d ms [%s]", status, cid, waited/1e6, req.RemoteAddr)
+		}
+		if p.config.OnSubscribeComplete != nil {
+			p.config.OnSubscribeComplete(cid, waited, status)
+		}
+	}()
 
-	if req.Method != "GET" {
-		Logger.Printf("Sub/405: A non GET request to channel %q [%s]", cid, req.RemoteAddr)
+	if p.config.GzipMinSize > 0 {
+		rw.Header().Set("Vary", "If-None-Match, If-Modified-Since, X-Last-Msg-Id, Accept-Encoding")
+	} else {
+		rw.Header().Set("Vary", "If-None-Match, If-Modified-Since, X-Last-Msg-Id")
+	}
+
+	if p.config.JSONPCallback != "" {
+		callback = req.FormValue(p.config.JSONPCallback)
+	}
+
+	p.setCORSHeaders(rw, subscriberMethods, "If-Modified-Since, If-None-Match, X-Last-Msg-Id")
+	if req.Method == "OPTIONS" {
+		p.config.Logger.Printf("Sub/204: Options retrieved [%s]", req.RemoteAddr)
+		rw.Header().Set("Allow", subscriberMethods)
+		status = http.StatusNoContent
+		rw.WriteHeader(status)
+		return
+	}
+
+	if req.Method == "HEAD" {
+		rw = headResponseWriter{rw}
+	}
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		p.config.Logger.Printf("Sub/405: A non GET request to channel %q [%s]", cid, req.RemoteAddr)
 		status = http.StatusMethodNotAllowed
+	} else if p.isDraining() {
+		p.config.Logger.Printf("Sub/503: Trying to subscribe to channel %q of a draining pusher [%s]", cid, req.RemoteAddr)
+		status = http.StatusServiceUnavailable
+	} else if location := redirectLocation(cid); location != "" {
+		p.config.Logger.Printf("Sub/302: Acceptor redirected URL %q to %q [%s]", req.RawURL, location, req.RemoteAddr)
+		rw.Header().Set("Location", location)
+		status = http.StatusFound
 	} else if cid == "" {
-		Logger.Printf("Sub/404: Acceptor denied access to URL %q [%s]", req.RawURL, req.RemoteAddr)
+		p.config.Logger.Printf("Sub/404: Acceptor denied access to URL %q [%s]", req.RawURL, req.RemoteAddr)
 		status = http.StatusNotFound
+	} else if p.isTooLong(cid) {
+		p.config.Logger.Printf("Sub/400: A channel id of %d bytes is too long [%s]", len(cid), req.RemoteAddr)
+		status = http.StatusBadRequest
+	} else if callback != "" && !isCallbackName(callback) {
+		p.config.Logger.Printf("Sub/400: Invalid JSONP callback %q for channel %q [%s]", callback, cid, req.RemoteAddr)
+		status = http.StatusBadRequest
+	} else if since, etag, seq, served, err = parseConditions(req); err != nil {
+		p.config.Logger.Printf("Sub/400: %s in a subscription to channel %q [%s]", err, cid, req.RemoteAddr)
+		status = http.StatusBadRequest
 	}
 
 	if status != 0 {
+		if status == http.StatusMethodNotAllowed {
+			rw.Header().Set("Allow", subscriberMethods)
+		}
 		rw.WriteHeader(status)
 		return
 	}
 
-	if ifsince, _ := time.Parse(http.TimeFormat, req.Header.Get("If-Modified-Since")); ifsince != nil {
-		since = ifsince.Seconds()
+	var c *channel
+	var message *Message
+	var beating bool
+	if p.config.PatternSubscriptions && isPattern(cid) {
+		ps, m, st := p.subscribePattern(cid, since, etag, seq, served, req.Method == "HEAD")
+		if st != 0 {
+			if st == http.StatusServiceUnavailable {
+				p.config.Logger.Printf("Sub/503: Trying to subscribe to channels %q of a closed pusher [%s]", cid, req.RemoteAddr)
+			} else {
+				p.config.Logger.Printf("Sub/%d: No channel matches the pattern %q [%s]", st, cid, req.RemoteAddr)
+			}
+			status = st
+			rw.WriteHeader(status)
+			return
+		}
+		p.config.Logger.Printf("Sub: New subscription to %d channels matching %q [%s]", len(ps.channels), cid, req.RemoteAddr)
+		message = m
+		if message == nil && len(ps.subs) > 0 {
+			parked = true
+			message, beating = p.wait(rw, req, ps.messages, func() {
+				ps.cancel()
+			})
+		}
+		// a message that arrived after the wait ended is still delivered rather than lost
+		if m := ps.finish(); m != nil && message == nil {
+			message = m
+		}
+		if c = ps.delivered(); message != nil && !beating {
+			rw.Header().Set("X-Channel", c.id)
+		}
+	} else {
+		sh := p.shard(cid)
+		sh.lock.Lock()
+		if p.closed {
+			sh.lock.Unlock()
+			p.config.Logger.Printf("Sub/503: Trying to subscribe to channel %q of a closed pusher [%s]", cid, req.RemoteAddr)
+			status = http.StatusServiceUnavailable
+			rw.WriteHeader(status)
+			return
+		}
+		var ok bool
+		c, ok = sh.channels[cid]
+		if !ok {
+			if !p.config.AllowChannelCreation {
+				sh.lock.Unlock()
+				p.config.Logger.Printf("Sub/403: Trying to subscribe to a non-existent channel %q [%s]", cid, req.RemoteAddr)
+				status = http.StatusForbidden
+				rw.WriteHeader(status)
+				return
+			} else {
+				p.config.Logger.Printf("Sub: Channel %q created [%s]", cid, req.RemoteAddr)
+				c = p.newChannel(cid)
+				sh.channels[cid] = c
+			}
+		}
+
+		p.config.Logger.Printf("Sub: New subscription to channel %q [%s]", cid, req.RemoteAddr)
+		var sub *list.Element
+		if req.Method == "HEAD" {
+			// only tell what is currently available
+			message = c.available(since, etag, seq, served)
+		} else {
+			sub, message = c.subscribe(since, etag, seq, served, p.parks())
+		}
+		sh.lock.Unlock()
+
+		if !ok {
+			p.channelCreated(c)
+		}
+
+		if sub != nil {
+			parked = true
+			message, beating = p.wait(rw, req, sub.Value.(chan *Message), func() {
+				c.Unsubscribe(sub)
+			})
+		}
 	}
-	etag, _ := strconv.Atoi(req.Header.Get("If-None-Match"))
 
-	p.lock.Lock()
-	c, ok := p.channels[cid]
-	if !ok {
-		if !p.config.AllowChannelCreation {
-			p.lock.Unlock()
-			Logger.Printf("Sub/403: Trying to subscribe to a non-existent channel %q [%s]", cid, req.RemoteAddr)
-			rw.WriteHeader(http.StatusForbidden)
-			return
+	if message == unavailableMessage || message == overloadedMessage {
+		if message == unavailableMessage {
+			p.config.Logger.Printf("Sub/503: Too many subscribers in channel %q [%s]", cid, req.RemoteAddr)
 		} else {
-			Logger.Printf("Sub: Channel %q created [%s]", cid, req.RemoteAddr)
-			c = newChannel(cid, &p.config)
-			p.channels[cid] = c
+			p.config.Logger.Printf("Sub/503: Too many subscribers in the pusher for channel %q [%s]", cid, req.RemoteAddr)
 		}
+		rw.Header().Set("Retry-After", p.retryAfter())
+		status = http.StatusServiceUnavailable
+		rw.WriteHeader(status)
+		return
 	}
 
-	Logger.Printf("Sub: New subscription to channel %q [%s]", cid, req.RemoteAddr)
-	sub, message := c.Subscribe(since, etag)
-	p.lock.Unlock()
+	if callback != "" {
+		status = http.StatusOK
+		writeJSONP(rw, callback, message)
+		p.config.Logger.Printf("Sub/200: Delivered JSONP message in channel %q [%s]", cid, req.RemoteAddr)
+		return
+	}
 
-	if sub != nil {
-		if p.config.PollingTimeout > 0 {
-			select {
-			case message = <-sub.Value.(chan *Message):
-			case <-time.After(p.config.PollingTimeout):
-				c.Unsubscribe(sub)
-			}
+	if beating {
+		// the headers are long gone, only the payload can be delivered
+		status = http.StatusOK
+		if message == nil {
+			p.config.Logger.Printf("Sub/200: Subscription to channel %q timed out after heartbeats [%s]", cid, req.RemoteAddr)
 		} else {
-			message = <-sub.Value.(chan *Message)
+			if message.Payload != nil {
+				if _, err := rw.Write(message.Payload); err != nil {
+					p.deliveryFailed(req, c, cid, []*Message{message}, err)
+					return
+				}
+			}
+			p.config.Logger.Printf("Sub/200: Delivered message in channel %q after heartbeats [%s]", cid, req.RemoteAddr)
 		}
+		return
 	}
+
 	if message == nil {
-		Logger.Printf("Sub/304: Subscription to channel %q timed out (probably) [%s]", cid, req.RemoteAddr)
-		rw.WriteHeader(http.StatusNotModified)
+		status = p.emptyResponseStatus()
+		p.config.Logger.Printf("Sub/%d: Subscription to channel %q timed out (probably) [%s]", status, cid, req.RemoteAddr)
+		if status != http.StatusNoContent {
+			rw.Header().Set("Content-Length", "0")
+		}
+		rw.WriteHeader(status)
 		return
 	}
 
-	rw.Header().Set("Etag", strconv.Itoa(message.etag))
-	rw.Header().Set("Last-Modified", time.SecondsToUTC(message.time).Format(http.TimeFormat))
+	if message.Status == http.StatusOK && acceptsBatch(req) {
+		batch := append([]*Message{message}, c.queuedAfter(since, etag, seq, append(served, message.seq))...)
+		for _, m := range batch {
+			served = append(served, m.seq)
+		}
+		setPosition(rw, c, since, etag, seq, served, batch[len(batch)-1])
+		rw.Header().Set("Content-Type", "multipart/mixed; boundary="+multipartBoundary)
+
+		var buf bytes.Buffer
+		writeBatch(&buf, batch)
+		rw.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+
+		status = http.StatusOK
+		rw.WriteHeader(status)
+		if _, err := rw.Write(buf.Bytes()); err != nil {
+			p.deliveryFailed(req, c, cid, batch, err)
+			return
+		}
+		p.config.Logger.Printf("Sub/200: Delivered %d messages in channel %q [%s]", len(batch), cid, req.RemoteAddr)
+		return
+	}
+
+	if !message.synthetic() {
+		setPosition(rw, c, since, etag, seq, append(served, message.seq), message)
+	}
+	if message.reason != "" {
+		rw.Header().Set(reasonHeaders[message.Status], message.reason)
+	}
+	if message.reason == collectedMessage.reason && p.config.GCRetryAfter > 0 {
+		// spread the reconnects of the subscribers released all at once
+		rw.Header().Set("Retry-After", strconv.Itoa(p.config.GCRetryAfter))
+	}
 
 	if message.ContentType != "" {
 		rw.Header().Set("Content-Type", message.ContentType)
 	}
 
-	rw.WriteHeader(message.Status)
-	if message.Payload != nil {
-		rw.Write(message.Payload)
+	payload := message.Payload
+	if compressed, ok := p.compress(req, message); ok {
+		rw.Header().Set("Content-Encoding", "gzip")
+		payload = compressed
+	}
+	rw.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+
+	status = message.Status
+	rw.WriteHeader(status)
+	if payload != nil {
+		if _, err := rw.Write(payload); err != nil {
+			p.deliveryFailed(req, c, cid, []*Message{message}, err)
+			return
+		}
 	}
 
-	Logger.Printf("Sub/%d: Delivered message in channel %q [%s]", message.Status, cid, req.RemoteAddr)
+	p.config.Logger.Printf("Sub/%d: Delivered message in channel %q [%s]", message.Status, cid, req.RemoteAddr)
+}
+
+// DeliveryFailed handles the failure to write msgs to the subscriber of req, typically
+// because the client has disconnected. The messages of c are taken back from the delivered
+// stats (see recall), since nobody received them, and the OnDeliveryError configuration
+// option is called along with the id of c (or cid if the subscription matched no channel).
+func (p *pusher) deliveryFailed(req *http.Request, c *channel, cid string, msgs []*Message, err os.Error) {
+	p.config.Logger.Printf("Sub: Delivering %d messages in channel %q failed: %s [%s]", len(msgs), cid, err, req.RemoteAddr)
+	if c != nil {
+		cid = c.id
+		for _, m := range msgs {
+			// synthetic messages such as gone are not always counted as delivered
+			if m.Status == http.StatusOK {
+				c.recall(m)
+			}
+		}
+	}
+	if p.config.OnDeliveryError != nil {
+		p.config.OnDeliveryError(cid, err)
+	}
+}
+
+// AcceptsBatch reports whether the request's Accept-header asks for multipart/mixed
+// responses, i.e. the client wants every available message at once.
+func acceptsBatch(req *http.Request) bool {
+	for _, r := range parseAccept(req.Header.Get("Accept")) {
+		if r.typ == "multipart" && r.subtype == "mixed" {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteBatch writes msgs to w as the body of a multipart/mixed response. Every part carries
+// the content-type and the sequence number (X-Msg-Id) of its message.
+func writeBatch(w io.Writer, msgs []*Message) os.Error {
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		buf.WriteString("--" + multipartBoundary + "\r\n")
+		if m.ContentType != "" {
+			fmt.Fprintf(&buf, "Content-Type: %s\r\n", m.ContentType)
+		}
+		fmt.Fprintf(&buf, "X-Msg-Id: %d\r\n\r\n", m.seq)
+		buf.Write(m.Payload)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("--" + multipartBoundary + "--\r\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Compress returns the payload of message compressed using gzip, if the request accepts it,
+// the payload has at least GzipMinSize (configuration option) bytes and its content-type is
+// not compressed already.
+func (p *pusher) compress(req *http.Request, message *Message) ([]byte, bool) {
+	if p.config.GzipMinSize <= 0 || len(message.Payload) < p.config.GzipMinSize ||
+		!acceptsGzip(req) || isCompressedType(message.ContentType) {
+		return nil, false
+	}
+
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriter(&buf)
+	if err != nil {
+		p.config.Logger.Print("gzip.NewWriter:", err)
+		return nil, false
+	}
+	gz.Write(message.Payload)
+	if err = gz.Close(); err != nil {
+		p.config.Logger.Print("gzip.Close:", err)
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// AcceptsGzip reports whether the request's Accept-Encoding header lists gzip (or *) with a
+// non-zero quality value.
+func acceptsGzip(req *http.Request) bool {
+	for _, entry := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(entry, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.Atof64(kv[1]); err == nil && q <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// IsCompressedType reports whether payloads of the given content-type are compressed already,
+// so that compressing them again would be a waste.
+func isCompressedType(ctype string) bool {
+	ctype = strings.ToLower(ctype)
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip"} {
+		if strings.HasPrefix(ctype, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCORSHeaders adds the Cross-Origin Resource Sharing headers allowing the origin of the
+// AllowOrigin configuration option to use the given methods and request headers. The Etag,
+// Last-Modified and X-Msg-Id headers are exposed, so that conditional requests work
+// cross-origin. Nothing is added if the AllowOrigin configuration option is not set.
+func (p *pusher) setCORSHeaders(rw http.ResponseWriter, methods, headers string) {
+	if p.config.AllowOrigin == "" {
+		return
+	}
+	rw.Header().Set("Access-Control-Allow-Origin", p.config.AllowOrigin)
+	rw.Header().Set("Access-Control-Allow-Methods", methods)
+	rw.Header().Set("Access-Control-Allow-Headers", headers)
+	rw.Header().Set("Access-Control-Expose-Headers", "Etag, Last-Modified, X-Msg-Id")
+}
+
+// SinceFormats are the time formats accepted in If-Modified-Since headers, in the order tried.
+var sinceFormats = []string{http.TimeFormat, time.RFC1123Z, time.RFC3339}
+
+// ParseSince parses the value of an If-Modified-Since header using the first of sinceFormats
+// that fits. It returns nil if none of them does.
+func parseSince(value string) *time.Time {
+	for _, format := range sinceFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// SetPosition sets the Etag, Last-Modified and X-Msg-Id headers telling the position of a
+// subscriber of c, which had the position given by since, etag and seq and has now received
+// m along with the messages in served, see channel.position. The messages received beyond the
+// position are listed in the X-Served-Msg-Ids header.
+func setPosition(rw http.ResponseWriter, c *channel, since int64, etag int, seq int64, served []int64, m *Message) {
+	pos, rest := c.position(since, etag, seq, served, m)
+	if pos != nil {
+		rw.Header().Set("Etag", strconv.Itoa(pos.etag))
+		rw.Header().Set("Last-Modified", pos.lastModified())
+		rw.Header().Set("X-Msg-Id", strconv.Itoa64(pos.seq))
+	} else {
+		// an older message is still to be received, so the position stays the same
+		rw.Header().Set("Etag", strconv.Itoa(etag))
+		if since > 0 {
+			rw.Header().Set("Last-Modified", time.SecondsToUTC(since/1e9).Format(http.TimeFormat))
+		}
+		if seq > 0 {
+			rw.Header().Set("X-Msg-Id", strconv.Itoa64(seq))
+		}
+	}
+	if len(rest) > 0 {
+		ids := make([]string, len(rest))
+		for i, s := range rest {
+			ids[i] = strconv.Itoa64(s)
+		}
+		rw.Header().Set("X-Served-Msg-Ids", strings.Join(ids, ","))
+	}
+}
+
+// ParseConditions extracts the If-Modified-Since (in ns), If-None-Match, X-Last-Msg-Id and
+// X-Served-Msg-Ids headers of req, the latter being returned as served. Absent headers yield
+// zero values i.e. the oldest message, whereas malformed ones yield an error, so that a client
+// is not silently given messages it may already have.
+func parseConditions(req *http.Request) (since int64, etag int, seq int64, served []int64, err os.Error) {
+	if h := req.Header.Get("If-Modified-Since"); h != "" {
+		t := parseSince(h)
+		if t == nil {
+			return 0, 0, 0, nil, fmt.Errorf("Malformed If-Modified-Since %q", h)
+		}
+		since = t.Seconds() * 1e9
+	}
+	if h := req.Header.Get("If-None-Match"); h != "" {
+		if etag, err = strconv.Atoi(h); err != nil {
+			return 0, 0, 0, nil, fmt.Errorf("Malformed If-None-Match %q", h)
+		}
+	}
+	if h := req.Header.Get("X-Last-Msg-Id"); h != "" {
+		if seq, err = strconv.Atoi64(h); err != nil {
+			return 0, 0, 0, nil, fmt.Errorf("Malformed X-Last-Msg-Id %q", h)
+		}
+	}
+	if h := req.Header.Get("X-Served-Msg-Ids"); h != "" {
+		for _, s := range strings.Split(h, ",") {
+			n, err := strconv.Atoi64(strings.TrimSpace(s))
+			if err != nil {
+				return 0, 0, 0, nil, fmt.Errorf("Malformed X-Served-Msg-Ids %q", h)
+			}
+			served = append(served, n)
+		}
+	}
+	return
+}
+
+// IsTooLong reports whether the given channel id exceeds the MaxChannelIdLength configuration
+// option.
+func (p *pusher) isTooLong(cid string) bool {
+	return p.config.MaxChannelIdLength > 0 && len(cid) > p.config.MaxChannelIdLength
+}
+
+// A closeNotifier is a http.ResponseWriter telling when its client has gone away. The
+// method matches the CloseNotify method of the http.CloseNotifier interface of later
+// versions of the http package.
+type closeNotifier interface {
+	CloseNotify() <-chan bool
+}
+
+// Wait waits for a message to arrive through messages until the polling timeout of req (see
+// pollingTimeout) has passed, in which case cancel is called and a nil message is returned.
+// Meanwhile heartbeats are written to rw if the HeartbeatInterval configuration option is set,
+// which is reported by beating. If rw is a closeNotifier, the wait is canceled as soon as the
+// client disconnects, so that its subscriber does not linger until the timeout.
+func (p *pusher) wait(rw http.ResponseWriter, req *http.Request, messages <-chan *Message, cancel func()) (message *Message, beating bool) {
+	var timeout, heartbeat <-chan int64
+	if t := p.pollingTimeout(req); t > 0 {
+		timeout = time.After(t)
+	}
+	var closed <-chan bool
+	if notifier, ok := rw.(closeNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	if p.config.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(p.config.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case message = <-messages:
+			return
+		case <-timeout:
+			cancel()
+			return
+		case <-closed:
+			p.config.Logger.Printf("Sub: Client disconnected while waiting [%s]", req.RemoteAddr)
+			cancel()
+			return
+		case <-heartbeat:
+			beating = true
+			rw.Write(heartbeatPayload)
+			if flusher, ok := rw.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+	}
+	panic("unreachable")
+}
+
+// EmptyResponseStatus returns the status responded to subscribers when no message is
+// available, as set by the EmptyResponseStatus configuration option.
+func (p *pusher) emptyResponseStatus() int {
+	if p.config.EmptyResponseStatus == 0 {
+		return http.StatusNotModified
+	}
+	return p.config.EmptyResponseStatus
+}
+
+// Parks reports whether subscribers are parked when no suitable message is available. They
+// are with long-polling and, for up to the IntervalMinWait configuration option, with
+// interval-polling.
+func (p *pusher) parks() bool {
+	return p.config.PollingMechanism == PollingMechanismLong || p.config.IntervalMinWait > 0
+}
+
+// MinPollingTimeout is the shortest timeout a subscriber may request with X-Poll-Timeout.
+const minPollingTimeout = 1e9
+
+// PollingTimeout returns the time (in ns) req may stay parked. It is the timeout requested
+// in the X-Poll-Timeout header (in seconds), unless the header is missing, malformed,
+// shorter than a second or longer than the PollingTimeout configuration option, in which
+// case PollingTimeout is used. With interval-polling it is always the IntervalMinWait
+// configuration option.
+func (p *pusher) pollingTimeout(req *http.Request) int64 {
+	if p.config.PollingMechanism == PollingMechanismInterval {
+		return p.config.IntervalMinWait
+	}
+	if h := req.Header.Get("X-Poll-Timeout"); h != "" {
+		max := p.config.PollingTimeout
+		if max == 0 {
+			max = math.MaxInt64
+		}
+		if seconds, err := strconv.Atoi64(h); err == nil && seconds >= minPollingTimeout/1e9 && seconds <= max/1e9 {
+			return seconds * 1e9
+		}
+	}
+	return p.config.PollingTimeout
+}
+
+// RetryAfter returns the amount of seconds a rejected subscriber should wait before retrying,
+// which is the time active subscribers may stay parked (at least a second).
+func (p *pusher) retryAfter() string {
+	if seconds := p.config.PollingTimeout / 1e9; seconds > 1 {
+		return strconv.Itoa64(seconds)
+	}
+	return "1"
+}
+
+// WriteJSONP writes message to rw wrapped in a call to the JavaScript function callback.
+// The response is always a 200 with an application/javascript content-type, so that the
+// script tag of the client gets executed even if there was no message available. In that
+// case (and for messages without a payload) the callback receives null as its argument.
+//
+// The payload is written verbatim, so JSONP only makes sense for channels whose messages
+// carry JSON payloads.
+func writeJSONP(rw http.ResponseWriter, callback string, message *Message) {
+	payload := []byte("null")
+	if message != nil {
+		if !message.synthetic() {
+			rw.Header().Set("Etag", strconv.Itoa(message.etag))
+			rw.Header().Set("Last-Modified", message.lastModified())
+			rw.Header().Set("X-Msg-Id", strconv.Itoa64(message.seq))
+		}
+		if message.Payload != nil {
+			payload = message.Payload
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/javascript")
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "%s(%s);", callback, payload)
+}
+
+// A headResponseWriter answers HEAD requests by discarding the body written by the handlers,
+// which treat them like GET requests otherwise.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, os.Error) {
+	return len(b), nil
+}
+
+// IsCallbackName reports whether s is a valid JavaScript identifier or a dot separated
+// path of identifiers (e.g. "jQuery.callback").
+func isCallbackName(s string) bool {
+	for _, part := range strings.Split(s, ".") {
+		if part == "" {
+			return false
+		}
+		for i, r := range part {
+			if r != '_' && r != '$' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// HandleStats is responsible for answering requests to the global statistics locations. It
+// responds to GET requests with the statistics aggregated over all channels, encoded in a format
+// requested via the Accept-header (plain, json or xml). Any other request method yields a 405.
+func (p *pusher) handleStats(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		p.config.Logger.Printf("Stats/405: A non GET request [%s]", req.RemoteAddr)
+		rw.Header().Set("Allow", "GET")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	typ, subtype := acceptedStatType(req, func(subtype string) bool {
+		return globalStatFormats[subtype] != ""
+	})
+	format := globalStatFormats[subtype]
+
+	stats := p.Stats()
+
+	rw.Header().Set("Content-Type", typ+"/"+subtype)
+	rw.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(rw, format, stats.Channels, stats.Subscribers, stats.Queued,
+		stats.Published, stats.Delivered, stats.BytesPublished, stats.BytesDelivered); err != nil {
+		p.config.Logger.Print("handleStats:", err)
+	}
+
+	p.config.Logger.Printf("Stats/200: Global statistics retrieved [%s]", req.RemoteAddr)
+}
+
+// HandleHealth is responsible for answering requests to the liveness and readiness probe
+// locations. A GET or HEAD request yields a 200 along with a JSON object telling the amount
+// of channels and the uptime of the pusher in seconds, e.g. {"channels":3,"uptime":120}. If
+// ready is set, a 503 is yielded instead once the pusher has been drained or closed. Other
+// methods yield a 405.
+//
+// The probes neither go through the acceptor nor create channels, and successful probes are
+// not logged, since they are typically made every few seconds.
+func (p *pusher) handleHealth(rw http.ResponseWriter, req *http.Request, ready bool) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		p.config.Logger.Printf("Health/405: A %s request [%s]", req.Method, req.RemoteAddr)
+		rw.Header().Set("Allow", "GET, HEAD")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	channels := 0
+	for i := range p.shards {
+		s := &p.shards[i]
+		s.lock.RLock()
+		channels += len(s.channels)
+		s.lock.RUnlock()
+	}
+	s := &p.shards[0]
+	s.lock.RLock()
+	closed := p.closed
+	s.lock.RUnlock()
+	draining := p.isDraining()
+
+	status := http.StatusOK
+	if ready && closed {
+		p.config.Logger.Printf("Health/503: The pusher is closed [%s]", req.RemoteAddr)
+		status = http.StatusServiceUnavailable
+	} else if ready && draining {
+		p.config.Logger.Printf("Health/503: The pusher is draining [%s]", req.RemoteAddr)
+		status = http.StatusServiceUnavailable
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(status)
+	if req.Method == "GET" {
+		fmt.Fprintf(rw, `{"channels":%d,"uptime":%d}`, channels, (time.Nanoseconds()-p.started)/1e9)
+	}
 }
@@ -1,9 +1,2439 @@
 package pusher
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"http"
+	"http/httptest"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// ServeRequest passes a request with the given method, url and body to handler
+// and returns the recorded response.
+func serveRequest(handler http.Handler, method, url, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://localhost"+url, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	return rw
+}
+
 func TestPusher(t *testing.T) {
 	t.Log("TODO: make tests")
 }
+
+// publish rate tests
+func TestPublishRate(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{MaxPublishRate: 5})
+
+	for i := 0; i < 5; i++ {
+		if rw := serveRequest(p.PublisherHandler, "POST", "/pub", "hello"); rw.Code != http.StatusAccepted {
+			t.Errorf("Expected 202 (%d), got %d", i, rw.Code)
+		}
+	}
+	if rw := serveRequest(p.PublisherHandler, "POST", "/pub", "hello"); rw.Code != StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", rw.Code)
+	}
+
+	// refill a single token
+	time.Sleep(1e9/5 + 1e9/20)
+	if rw := serveRequest(p.PublisherHandler, "POST", "/pub", "hello"); rw.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 after refill, got %d", rw.Code)
+	}
+	if rw := serveRequest(p.PublisherHandler, "POST", "/pub", "hello"); rw.Code != StatusTooManyRequests {
+		t.Errorf("Expected 429 after refill, got %d", rw.Code)
+	}
+
+	c, _ := p.Channel("test")
+	if s := c.Stats(); s.Published != 6 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+}
+
+// jsonp tests
+func TestJSONP(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{
+		AllowChannelCreation: true,
+		ChannelCapacity:      3,
+		JSONPCallback:        "callback",
+		PollingMechanism:     PollingMechanismInterval,
+	})
+
+	rw := serveRequest(p.SubscriberHandler, "GET", "/sub?callback=cb", "")
+	if rw.Code != http.StatusOK || rw.Body.String() != "cb(null);" {
+		t.Errorf("Expected empty JSONP response, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	c, _ := p.Channel("test")
+	c.Publish(&Message{Status: http.StatusOK, ContentType: "application/json", Payload: []byte(`{"a":1}`)}, true)
+
+	rw = serveRequest(p.SubscriberHandler, "GET", "/sub?callback=jQuery.cb_1", "")
+	if rw.Code != http.StatusOK || rw.Body.String() != `jQuery.cb_1({"a":1});` {
+		t.Errorf("Expected JSONP response, got %d %q", rw.Code, rw.Body.String())
+	}
+	if ctype := rw.HeaderMap.Get("Content-Type"); ctype != "application/javascript" {
+		t.Errorf("Invalid content-type %q", ctype)
+	}
+
+	for _, cb := range []string{"alert(1)", "1cb", "cb.", "a;b"} {
+		rw = serveRequest(p.SubscriberHandler, "GET", "/sub?callback="+http.URLEscape(cb), "")
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for callback %q, got %d", cb, rw.Code)
+		}
+	}
+}
+
+// heartbeat tests
+func TestHeartbeat(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{HeartbeatInterval: 1e8})
+	c, _ := p.Channel("test")
+
+	go func() {
+		time.Sleep(35e7)
+		c.PublishString("hello", false)
+	}()
+
+	rw := serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	body := rw.Body.String()
+	if rw.Code != http.StatusOK || !strings.HasPrefix(body, " ") || strings.TrimLeft(body, " ") != "hello" {
+		t.Errorf("Expected heartbeats before the message, got %d %q", rw.Code, body)
+	}
+	if s := c.Stats(); s.Delivered != 1 || s.Published != 1 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+}
+
+// global stats tests
+func TestGlobalStats(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	for _, cid := range []string{"a", "b", "c"} {
+		c, _ := p.Channel(cid)
+		c.PublishString(cid, true)
+		c.PublishString(cid+cid, true)
+	}
+	c, _ := p.Channel("a")
+	c.Subscribe(0, 0, 0)
+
+	s := p.Stats()
+	if s.Channels != 3 || s.Published != 6 || s.Queued != 6 || s.Delivered != 1 || s.BytesPublished != 9 || s.BytesDelivered != 1 {
+		t.Errorf("Invalid global stats %#v", s)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/stats", nil)
+	req.Header.Set("Accept", "application/json")
+	rw := httptest.NewRecorder()
+	p.StatsHandler.ServeHTTP(rw, req)
+	expected := `{"channels":3,"subscribers":0,"queued":6,"published":6,"delivered":1,"bytesPublished":9,"bytesDelivered":1}`
+	if rw.Code != http.StatusOK || rw.Body.String() != expected {
+		t.Errorf("Invalid response %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+// metrics tests
+func TestMetrics(t *testing.T) {
+	sample := regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="([^"\\]|\\.)*"\})? -?[0-9]+$`)
+	comment := regexp.MustCompile(`^# (HELP|TYPE) [a-zA-Z_:][a-zA-Z0-9_:]* .+$`)
+
+	for _, perChannel := range []bool{false, true} {
+		p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PerChannelMetrics: perChannel})
+		for _, cid := range []string{"a", `b"\`} {
+			c, _ := p.Channel(cid)
+			c.PublishString(cid, true)
+		}
+
+		rw := serveRequest(p.MetricsHandler, "GET", "/metrics", "")
+		if rw.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", rw.Code)
+		}
+		body := rw.Body.String()
+		for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+			if !sample.MatchString(line) && !comment.MatchString(line) {
+				t.Errorf("Invalid line %q", line)
+			}
+		}
+		for _, expected := range []string{"pusher_channels 2\n", "pusher_messages_published_total 2\n", "pusher_bytes_published_total 4\n"} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("Expected %q in %q", expected, body)
+			}
+		}
+		labeled := `pusher_channel_messages_published_total{channel="b\"\\"} 1`
+		if strings.Contains(body, labeled) != perChannel {
+			t.Errorf("Unexpected per-channel metrics (%v) in %q", perChannel, body)
+		}
+		// the aggregate and per-channel values never share a family
+		if strings.Contains(body, "pusher_messages_published_total{") {
+			t.Errorf("Expected no labeled aggregate in %q", body)
+		}
+	}
+}
+
+// message ttl gc tests
+func TestMessageTTLGC(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, MessageTTL: 1e8})
+	c, _ := p.Channel("test")
+	c.PublishString("hello", true)
+	time.Sleep(2e8)
+
+	if n := p.GC(); n != 0 {
+		t.Errorf("Expected no channels to be collected, got %d", n)
+	}
+	if s := c.Stats(); s.Queued != 0 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+}
+
+// channel listing tests
+func TestChannels(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	for _, cid := range []string{"c", "a", "b"} {
+		c, _ := p.Channel(cid)
+		c.PublishString(cid, true)
+	}
+
+	ids := p.Channels()
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "a,b,c" {
+		t.Errorf("Invalid channel ids %q", ids)
+	}
+
+	// the snapshot is a copy
+	ids[0] = "x"
+	if p.HasChannel("x") || len(p.Channels()) != 3 {
+		t.Error("Snapshot shares state with the pusher")
+	}
+
+	stats := p.ChannelStats()
+	if len(stats) != 3 || stats["a"].Published != 1 || stats["c"].Queued != 1 {
+		t.Errorf("Invalid channel stats %#v", stats)
+	}
+}
+
+// channel deletion tests
+func TestDeleteChannel(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{})
+	p.Channel("test")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	}()
+	time.Sleep(1e9 / 4)
+
+	if !p.DeleteChannel("test") {
+		t.Error("Expected the channel to exist")
+	}
+	if rw := <-done; rw.Code != http.StatusGone {
+		t.Errorf("Expected 410, got %d", rw.Code)
+	}
+	if p.DeleteChannel("test") {
+		t.Error("Expected the channel to be deleted")
+	}
+	if _, created := p.Channel("test"); !created {
+		t.Error("Expected the channel to be created again")
+	}
+}
+
+// channel existence tests
+func TestHasChannel(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{})
+	if p.HasChannel("test") || p.HasChannel("test") {
+		t.Error("Expected no channel")
+	}
+	if len(p.Channels()) != 0 {
+		t.Error("HasChannel created a channel")
+	}
+	if rw := serveRequest(p.PublisherHandler, "POST", "/pub", "hello"); rw.Code != http.StatusAccepted {
+		t.Errorf("Expected 202, got %d", rw.Code)
+	}
+	if !p.HasChannel("test") {
+		t.Error("Expected the channel to exist")
+	}
+}
+
+// pusher publish tests
+func TestPusherPublish(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	if n := p.PublishString("test", "hello", true); n != 0 {
+		t.Errorf("Expected no deliveries, got %d", n)
+	}
+	if !p.HasChannel("test") {
+		t.Error("Expected the channel to be created")
+	}
+
+	c, _ := p.Channel("test")
+	done := make(chan *Message)
+	for i := 0; i < 2; i++ {
+		e, _ := c.Subscribe(1<<62, 0, 0)
+		go func() {
+			done <- <-e.Value.(chan *Message)
+		}()
+	}
+	time.Sleep(1e9 / 4)
+
+	tm1 := &Message{Status: http.StatusOK, Payload: []byte("tm1")}
+	if n := p.Publish("test", tm1, true); n != 2 {
+		t.Errorf("Expected 2 deliveries, got %d", n)
+	}
+	if <-done != tm1 || <-done != tm1 {
+		t.Error("Expected tm1")
+	}
+	if s := c.Stats(); s.Published != 2 || s.Delivered != 2 || s.Queued != 2 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+}
+
+// multi-channel publish tests
+func TestPublishMulti(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	p.PublishString("b", "first", true)
+	p.PublishString("b", "second", true)
+
+	done := make(chan *Message)
+	for _, cid := range []string{"a", "b", "c"} {
+		c, _ := p.Channel(cid)
+		e, _ := c.Subscribe(1<<62, 0, 0)
+		go func() {
+			done <- <-e.Value.(chan *Message)
+		}()
+	}
+	time.Sleep(1e9 / 4)
+
+	tm1 := &Message{Status: http.StatusOK, Payload: []byte("tm1")}
+	if n := p.PublishMulti([]string{"c", "a", "b", "a"}, tm1, true); n != 3 {
+		t.Errorf("Expected 3 deliveries, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		if <-done != tm1 {
+			t.Error("Expected tm1")
+		}
+	}
+
+	// the message is newer than anything earlier in every channel
+	if tm1.seq != 3 {
+		t.Errorf("Invalid sequence number %d", tm1.seq)
+	}
+	for _, cid := range []string{"a", "b", "c"} {
+		c, _ := p.Channel(cid)
+		if e, m := c.Subscribe(0, 0, tm1.seq-1); e != nil || m != tm1 {
+			t.Errorf("Expected tm1 in %q", cid)
+		}
+		if s := c.Stats(); s.Queued == 0 || c.lastMessage != tm1 {
+			t.Errorf("Invalid state in %q %#v", cid, s)
+		}
+	}
+	if n := p.PublishString("a", "next", true); n != 0 {
+		t.Errorf("Expected no deliveries, got %d", n)
+	}
+	if c, _ := p.Channel("a"); c.lastMessage.seq != tm1.seq+1 {
+		t.Errorf("Invalid sequence number %d", c.lastMessage.seq)
+	}
+}
+
+// broadcast tests
+func TestBroadcast(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{})
+
+	done := make(chan *Message)
+	for _, cid := range []string{"a", "b", "c", "d"} {
+		c, _ := p.Channel(cid)
+		e, _ := c.Subscribe(0, 0, 0)
+		go func() {
+			done <- <-e.Value.(chan *Message)
+		}()
+	}
+	time.Sleep(1e9 / 4)
+
+	tm1 := &Message{Status: http.StatusOK, Payload: []byte("tm1")}
+	if n := p.Broadcast(tm1, false); n != 4 {
+		t.Errorf("Expected 4 deliveries, got %d", n)
+	}
+	for i := 0; i < 4; i++ {
+		if <-done != tm1 {
+			t.Error("Expected tm1")
+		}
+	}
+	if s := p.Stats(); s.Channels != 4 || s.Published != 4 || s.Delivered != 4 {
+		t.Errorf("Invalid global stats %#v", s)
+	}
+}
+
+// max subscribers tests
+func TestMaxSubscribersPerChannel(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{MaxSubscribersPerChannel: 2, PollingTimeout: 30e9})
+	c, _ := p.Channel("test")
+
+	done := make(chan *httptest.ResponseRecorder)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+		}()
+	}
+	time.Sleep(1e9 / 4)
+	if s := c.Stats(); s.Subscribers != 2 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+
+	rw := serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	if rw.Code != http.StatusServiceUnavailable || rw.HeaderMap.Get("Retry-After") != "30" {
+		t.Errorf("Expected 503 with Retry-After, got %d %q", rw.Code, rw.HeaderMap.Get("Retry-After"))
+	}
+	if s := c.Stats(); s.Subscribers != 2 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+
+	c.PublishString("hello", false)
+	for i := 0; i < 2; i++ {
+		if rw := <-done; rw.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", rw.Code)
+		}
+	}
+}
+
+// max concurrent subscribers tests
+func TestMaxConcurrentSubscribers(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{AllowChannelCreation: true,
+		MaxConcurrentSubscribers: 3, PollingTimeout: 30e9})
+
+	done := make(chan *httptest.ResponseRecorder)
+	for i := 0; i < 8; i++ {
+		id := string('a' + i%2)
+		go func() {
+			done <- serveRequest(p.SubscriberHandler, "GET", "/sub?id="+id, "")
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case rw := <-done:
+			if rw.Code != http.StatusServiceUnavailable || rw.HeaderMap.Get("Retry-After") != "30" {
+				t.Errorf("Expected 503 with Retry-After, got %d %q", rw.Code, rw.HeaderMap.Get("Retry-After"))
+			}
+		case <-time.After(2e9):
+			t.Fatal("Expected the subscribers beyond the limit to be refused")
+		}
+	}
+
+	a, _ := p.Channel("a")
+	b, _ := p.Channel("b")
+	if n := a.SubscriberCount() + b.SubscriberCount(); n != 3 {
+		t.Fatalf("Expected 3 parked subscribers, got %d", n)
+	}
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub?id=c", ""); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from a saturated pusher, got %d", rw.Code)
+	}
+
+	// releasing the subscribers of one channel frees their slots
+	full, other := a, b
+	if a.SubscriberCount() == 0 {
+		full, other = b, a
+	}
+	released := full.SubscriberCount()
+	full.PublishString("hello", false)
+	for i := 0; i < released; i++ {
+		if rw := <-done; rw.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", rw.Code)
+		}
+	}
+	go func() {
+		done <- serveRequest(p.SubscriberHandler, "GET", "/sub?id=c", "")
+	}()
+	c, _ := p.Channel("c")
+	for c.SubscriberCount() == 0 {
+		time.Sleep(1e7)
+	}
+	c.PublishString("hello", false)
+	if rw := <-done; rw.Code != http.StatusOK {
+		t.Errorf("Expected the admitted subscriber to get 200, got %d", rw.Code)
+	}
+
+	remaining := other.SubscriberCount()
+	other.PublishString("hello", false)
+	for i := 0; i < remaining; i++ {
+		<-done
+	}
+	if p.parked != 0 {
+		t.Errorf("Expected no parked subscribers, got %d", p.parked)
+	}
+}
+
+// max message size tests
+func TestMaxMessageSize(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, MaxMessageSize: 5})
+	tests := []struct {
+		body          string
+		contentLength int64
+		status        int
+	}{
+		{"12345", 5, http.StatusAccepted},
+		{"123456", 6, http.StatusRequestEntityTooLarge},
+		{"12345", -1, http.StatusAccepted},
+		{"123456", -1, http.StatusRequestEntityTooLarge},
+		{"123456", 3, http.StatusRequestEntityTooLarge}, // lying about the length
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("POST", "http://localhost/pub", strings.NewReader(test.body))
+		req.ContentLength = test.contentLength
+		rw := httptest.NewRecorder()
+		p.PublisherHandler.ServeHTTP(rw, req)
+		if rw.Code != test.status {
+			t.Errorf("Expected %d for %q (%d), got %d", test.status, test.body, test.contentLength, rw.Code)
+		}
+	}
+
+	c, _ := p.Channel("test")
+	if s := c.Stats(); s.Published != 2 || s.BytesPublished != 10 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+}
+
+// last message tests
+func TestPublisherLastMessage(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	c, _ := p.Channel("test")
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/pub", nil)
+		req.Header.Set("Accept", accept)
+		rw := httptest.NewRecorder()
+		p.PublisherHandler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := get("image/png"); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a message, got %d", rw.Code)
+	}
+
+	c.Publish(&Message{Status: http.StatusOK, ContentType: "image/png", Payload: []byte("\x89PNG")}, true)
+
+	rw := get("image/png")
+	if rw.Code != http.StatusOK || rw.Body.String() != "\x89PNG" || rw.HeaderMap.Get("Content-Type") != "image/png" {
+		t.Errorf("Invalid last message %d %q %q", rw.Code, rw.HeaderMap.Get("Content-Type"), rw.Body.String())
+	}
+
+	// stat formats still yield stats
+	for _, accept := range []string{"", "*/*", "application/json", "text/*"} {
+		if rw := get(accept); rw.Code != http.StatusOK || rw.Body.String() == "\x89PNG" {
+			t.Errorf("Expected stats for %q, got %q", accept, rw.Body.String())
+		}
+	}
+}
+
+// close tests
+func TestClose(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{GCInterval: 1e9 / 10, MaxChannelIdleTime: 1e9 / 10, PollingTimeout: 30e9})
+	p.Channel("test")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	}()
+	time.Sleep(1e9 / 20)
+
+	closed := make(chan bool)
+	go func() {
+		p.Close()
+		p.Close()
+		closed <- true
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5e9):
+		t.Fatal("Close did not return")
+	}
+
+	select {
+	case rw := <-done:
+		if rw.Code != http.StatusGone {
+			t.Errorf("Expected 410, got %d", rw.Code)
+		}
+	case <-time.After(5e9):
+		t.Fatal("Subscriber was not released")
+	}
+
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub", ""); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", rw.Code)
+	}
+
+	// the garbage collector has stopped, so idle channels survive
+	time.Sleep(1e9 / 2)
+	if !p.HasChannel("test") {
+		t.Errorf("Channel was garbage collected after Close")
+	}
+}
+
+// persisted pusher tests
+func TestPersistedPusher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := Configuration{ChannelCapacity: 3, Persister: NewFilePersister(dir)}
+	p := New(StaticAcceptor("test"), conf)
+	p.PublishString("test", "deleted", true)
+	p.DeleteChannel("test")
+	p.PublishString("test", "kept", true)
+	p.Close()
+
+	// a deleted channel starts out empty, whereas closing the pusher keeps the queue
+	p = New(StaticAcceptor("test"), conf)
+	defer p.Close()
+	c, _ := p.Channel("test")
+	if s := c.Stats(); s.Queued != 1 {
+		t.Errorf("Expected 1 queued message, got %d", s.Queued)
+	}
+	if m := c.Available(0, 0, 0); m == nil || string(m.Payload) != "kept" {
+		t.Errorf("Expected the kept message, got %v", m)
+	}
+}
+
+// garbage collector leak tests
+func TestCloseStopsGC(t *testing.T) {
+	before := runtime.Goroutines()
+
+	for i := 0; i < 10; i++ {
+		p := New(StaticAcceptor("test"), Configuration{GCInterval: 1e9 / 100, MaxChannels: 1})
+		time.Sleep(1e9 / 50)
+		p.Close()
+	}
+
+	if after := runtime.Goroutines(); after > before {
+		t.Errorf("Leaked %d garbage collector goroutines", after-before)
+	}
+}
+
+// gc eviction order tests
+func TestGCOrder(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{MaxChannels: 3, MaxChannelIdleTime: 60e9})
+	now := time.Seconds()
+	for i, stamp := range []int64{now - 5, now - 120, now - 1, now - 3, now - 2, now - 4} {
+		c, _ := p.Channel(string('a' + i))
+		c.stats.LastPublished = stamp
+	}
+
+	// b is idle, the rest is collected least active first until three channels remain
+	if n := p.GC(); n != 3 {
+		t.Errorf("Expected 3 channels to be collected, got %d", n)
+	}
+	ids := p.Channels()
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "c,d,e" {
+		t.Errorf("Invalid remaining channels %q", ids)
+	}
+}
+
+func BenchmarkGC(b *testing.B) {
+	b.StopTimer()
+	p := New(StaticAcceptor("test"), Configuration{MaxChannels: 100000})
+	for i := 0; i < 100000; i++ {
+		p.Channel(strconv.Itoa(i))
+	}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 10; j++ {
+			p.Channel(strconv.Itoa(100000 + i*10 + j))
+		}
+		b.StartTimer()
+		p.GC()
+	}
+}
+
+// gc hook tests
+func TestOnChannelGC(t *testing.T) {
+	collected := make(map[string]Stats)
+	var p *pusher
+	p = New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, MaxChannels: 1,
+		OnChannelGC: func(cid string, stats Stats) {
+			if p.HasChannel(cid) {
+				t.Errorf("Channel %q still exists", cid)
+			}
+			collected[cid] = stats
+		}})
+
+	old, _ := p.Channel("old")
+	old.PublishString("hello", true)
+	old.stats.LastPublished -= 10
+	p.Channel("new")
+
+	if n := p.GC(); n != 1 {
+		t.Errorf("Expected 1 channel to be collected, got %d", n)
+	}
+	if s, ok := collected["old"]; len(collected) != 1 || !ok || s.Published != 1 || s.Queued != 1 {
+		t.Errorf("Invalid collected channels %#v", collected)
+	}
+}
+
+// lifecycle hook tests
+func TestChannelLifecycleHooks(t *testing.T) {
+	created := make(map[string]int)
+	destroyed := make(map[string]int)
+	var p *pusher
+	p = New(QueryParameterAcceptor("id"), Configuration{
+		AllowChannelCreation: true,
+		MaxChannels:          1,
+		PollingMechanism:     PollingMechanismInterval,
+		OnChannelCreated: func(cid string) {
+			// the pusher is not locked
+			p.HasChannel(cid)
+			created[cid]++
+		},
+		OnChannelDestroyed: func(cid string) {
+			p.HasChannel(cid)
+			destroyed[cid]++
+		},
+	})
+
+	serveRequest(p.PublisherHandler, "PUT", "/pub?id=a", "")
+	serveRequest(p.PublisherHandler, "PUT", "/pub?id=a", "")
+	serveRequest(p.SubscriberHandler, "GET", "/sub?id=b", "")
+	serveRequest(p.SubscriberHandler, "GET", "/sub?id=b", "")
+	if created["a"] != 1 || created["b"] != 1 || len(destroyed) != 0 {
+		t.Errorf("Invalid invocations %v %v", created, destroyed)
+	}
+
+	serveRequest(p.PublisherHandler, "DELETE", "/pub?id=a", "")
+	serveRequest(p.PublisherHandler, "DELETE", "/pub?id=a", "")
+	if destroyed["a"] != 1 || len(destroyed) != 1 {
+		t.Errorf("Invalid invocations %v", destroyed)
+	}
+
+	p.Channel("c")
+	c, _ := p.Channel("b")
+	c.stats.LastRequested -= 10
+	p.GC()
+	if created["c"] != 1 || destroyed["b"] != 1 || destroyed["c"] != 0 {
+		t.Errorf("Invalid invocations %v %v", created, destroyed)
+	}
+}
+
+// CaptureLog is a Log recording every line.
+type captureLog struct {
+	lines []string
+}
+
+func (l *captureLog) Print(v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprint(v...))
+}
+
+func (l *captureLog) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// logger tests
+func TestLogger(t *testing.T) {
+	log := new(captureLog)
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, Logger: log})
+
+	serveRequest(p.PublisherHandler, "POST", "/pub", "hello")
+	if len(log.lines) != 1 || !strings.HasPrefix(log.lines[0], "Pub/202: A message was queued to channel \"test\"") {
+		t.Errorf("Invalid log lines %q", log.lines)
+	}
+}
+
+// disabled logging tests
+func TestNopLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l *log.Logger) { Logger = l }(Logger)
+	Logger = log.New(&buf, "", 0)
+
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingMechanism: PollingMechanismInterval, Logger: NopLog})
+	serveRequest(p.PublisherHandler, "POST", "/pub", "hello")
+	serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	serveRequest(p.PublisherHandler, "DELETE", "/pub", "")
+	if buf.Len() != 0 {
+		t.Errorf("Expected no output, got %q", buf.String())
+	}
+}
+
+func benchmarkSubscribe(b *testing.B, logger Log) {
+	b.StopTimer()
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingMechanism: PollingMechanismInterval, Logger: logger})
+	p.PublishString("test", "hello", true)
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		p.SubscriberHandler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkSubscribeLogging(b *testing.B) {
+	benchmarkSubscribe(b, log.New(ioutil.Discard, "", log.LstdFlags))
+}
+
+func BenchmarkSubscribeNopLog(b *testing.B) {
+	benchmarkSubscribe(b, NopLog)
+}
+
+// subscriber latency tests
+func TestOnSubscribeComplete(t *testing.T) {
+	type completion struct {
+		cid    string
+		waited int64
+		status int
+	}
+	completed := make(chan completion, 1)
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingTimeout: 30e9,
+		OnSubscribeComplete: func(cid string, waited int64, status int) {
+			completed <- completion{cid, waited, status}
+		}})
+	c, _ := p.Channel("test")
+
+	go func() {
+		time.Sleep(1e9 / 4)
+		c.PublishString("hello", false)
+	}()
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub", ""); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", rw.Code)
+	}
+	if got := <-completed; got.cid != "test" || got.waited < 1e9/4 || got.status != http.StatusOK {
+		t.Errorf("Invalid completion %#v", got)
+	}
+
+	serveRequest(p.SubscriberHandler, "POST", "/sub", "")
+	if got := <-completed; got.status != http.StatusMethodNotAllowed {
+		t.Errorf("Invalid completion %#v", got)
+	}
+}
+
+// head tests
+func TestHead(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingTimeout: 30e9})
+	c, _ := p.Channel("test")
+
+	// long-polling subscribers are not parked
+	rw := serveRequest(p.SubscriberHandler, "HEAD", "/sub", "")
+	if rw.Code != http.StatusNotModified || rw.Body.Len() != 0 {
+		t.Errorf("Expected 304 without body, got %d %q", rw.Code, rw.Body.String())
+	}
+	if s := c.Stats(); s.Subscribers != 0 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+
+	c.PublishString("hello", true)
+	rw = serveRequest(p.SubscriberHandler, "HEAD", "/sub", "")
+	if rw.Code != http.StatusOK || rw.HeaderMap.Get("Content-Type") != "text/plain" || rw.HeaderMap.Get("X-Msg-Id") == "" || rw.Body.Len() != 0 {
+		t.Errorf("Invalid response %d %v %q", rw.Code, rw.HeaderMap, rw.Body.String())
+	}
+
+	rw = serveRequest(p.PublisherHandler, "HEAD", "/pub", "")
+	if rw.Code != http.StatusOK || rw.HeaderMap.Get("Content-Type") != "text/plain" || rw.Body.Len() != 0 {
+		t.Errorf("Invalid response %d %v %q", rw.Code, rw.HeaderMap, rw.Body.String())
+	}
+
+	req, _ := http.NewRequest("HEAD", "http://localhost/pub", nil)
+	req.Header.Set("Accept", "image/png")
+	rw = httptest.NewRecorder()
+	p.PublisherHandler.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || rw.HeaderMap.Get("Content-Type") != "text/plain" || rw.Body.Len() != 0 {
+		t.Errorf("Invalid response %d %v %q", rw.Code, rw.HeaderMap, rw.Body.String())
+	}
+}
+
+// cors tests
+func TestCORS(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowOrigin: "http://example.com"})
+	p.PublishString("test", "hello", true)
+
+	rw := serveRequest(p.SubscriberHandler, "OPTIONS", "/sub", "")
+	if rw.Code != http.StatusNoContent || rw.HeaderMap.Get("Access-Control-Allow-Origin") != "http://example.com" ||
+		!strings.Contains(rw.HeaderMap.Get("Access-Control-Allow-Methods"), "GET") ||
+		!strings.Contains(rw.HeaderMap.Get("Access-Control-Allow-Headers"), "If-None-Match") {
+		t.Errorf("Invalid preflight response %d %v", rw.Code, rw.HeaderMap)
+	}
+
+	rw = serveRequest(p.PublisherHandler, "OPTIONS", "/pub", "")
+	if rw.Code != http.StatusNoContent || !strings.Contains(rw.HeaderMap.Get("Access-Control-Allow-Methods"), "POST") {
+		t.Errorf("Invalid preflight response %d %v", rw.Code, rw.HeaderMap)
+	}
+
+	rw = serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	if rw.Code != http.StatusOK || rw.HeaderMap.Get("Access-Control-Allow-Origin") != "http://example.com" ||
+		rw.HeaderMap.Get("Access-Control-Expose-Headers") != "Etag, Last-Modified, X-Msg-Id" {
+		t.Errorf("Invalid response %d %v", rw.Code, rw.HeaderMap)
+	}
+
+	// disabled by default
+	p = New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	if rw := serveRequest(p.SubscriberHandler, "OPTIONS", "/sub", ""); rw.HeaderMap.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Unexpected CORS headers %v", rw.HeaderMap)
+	}
+}
+
+// allow header tests
+func TestAllowHeader(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	tests := []struct {
+		handler http.Handler
+		allow   string
+	}{
+		{p.PublisherHandler, "GET, HEAD, PUT, POST, DELETE, OPTIONS"},
+		{p.SubscriberHandler, "GET, HEAD, OPTIONS"},
+		{p.SubscriberSSEHandler, "GET"},
+		{p.StatsHandler, "GET"},
+		{p.MetricsHandler, "GET"},
+	}
+	for _, test := range tests {
+		rw := serveRequest(test.handler, "PATCH", "/", "")
+		if rw.Code != http.StatusMethodNotAllowed || rw.HeaderMap.Get("Allow") != test.allow {
+			t.Errorf("Expected 405 allowing %q, got %d %q", test.allow, rw.Code, rw.HeaderMap.Get("Allow"))
+		}
+	}
+}
+
+// gzip tests
+func TestGzip(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, GzipMinSize: 10, PollingMechanism: PollingMechanismInterval})
+	c, _ := p.Channel("test")
+	payload := strings.Repeat("{\"hello\":\"world\"}", 10)
+	c.Publish(&Message{Status: http.StatusOK, ContentType: "application/json", Payload: []byte(payload)}, true)
+
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rw := httptest.NewRecorder()
+		p.SubscriberHandler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := get("deflate, gzip")
+	if rw.HeaderMap.Get("Content-Encoding") != "gzip" || !strings.Contains(rw.HeaderMap.Get("Vary"), "Accept-Encoding") {
+		t.Fatalf("Expected a compressed response, got %v", rw.HeaderMap)
+	}
+	gz, err := gzip.NewReader(rw.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := ioutil.ReadAll(gz); err != nil || string(body) != payload {
+		t.Errorf("Invalid payload %q (%v)", body, err)
+	}
+
+	for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0"} {
+		if rw := get(acceptEncoding); rw.HeaderMap.Get("Content-Encoding") != "" || rw.Body.String() != payload {
+			t.Errorf("Expected an uncompressed response for %q, got %v", acceptEncoding, rw.HeaderMap)
+		}
+	}
+
+	// small payloads and compressed content-types are left alone
+	c.PublishString("small", true)
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", rw.HeaderMap.Get("Etag"))
+	req.Header.Set("X-Last-Msg-Id", rw.HeaderMap.Get("X-Msg-Id"))
+	rw = httptest.NewRecorder()
+	p.SubscriberHandler.ServeHTTP(rw, req)
+	if rw.HeaderMap.Get("Content-Encoding") != "" || rw.Body.String() != "small" {
+		t.Errorf("Expected an uncompressed response, got %v %q", rw.HeaderMap, rw.Body.String())
+	}
+	if isCompressedType("application/json") || !isCompressedType("image/png") {
+		t.Errorf("Invalid compressed content-types")
+	}
+}
+
+// content-length tests
+func TestContentLength(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingMechanism: PollingMechanismInterval})
+
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub", ""); rw.Code != http.StatusNotModified || rw.HeaderMap.Get("Content-Length") != "0" {
+		t.Errorf("Expected 304 with Content-Length 0, got %d %q", rw.Code, rw.HeaderMap.Get("Content-Length"))
+	}
+
+	p.PublishString("test", "hello world", true)
+	rw := serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	if rw.Code != http.StatusOK || rw.HeaderMap.Get("Content-Length") != strconv.Itoa(rw.Body.Len()) || rw.Body.Len() != 11 {
+		t.Errorf("Invalid Content-Length %q for %q", rw.HeaderMap.Get("Content-Length"), rw.Body.String())
+	}
+
+	p.Publish("test", goneMessage, true)
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	req.Header.Set("X-Last-Msg-Id", rw.HeaderMap.Get("X-Msg-Id"))
+	rw = httptest.NewRecorder()
+	p.SubscriberHandler.ServeHTTP(rw, req)
+	if rw.Code != http.StatusGone || rw.HeaderMap.Get("Content-Length") != "0" {
+		t.Errorf("Expected 410 with Content-Length 0, got %d %q", rw.Code, rw.HeaderMap.Get("Content-Length"))
+	}
+}
+
+// deduplication tests
+func TestMessageId(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+
+	publish := func(id, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "http://localhost/pub", strings.NewReader(body))
+		req.Header.Set("X-Message-Id", id)
+		rw := httptest.NewRecorder()
+		p.PublisherHandler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := publish("a", "first"); rw.Code != http.StatusAccepted {
+		t.Errorf("Expected 202, got %d", rw.Code)
+	}
+	c, _ := p.Channel("test")
+	etag := strconv.Itoa(c.lastMessage.etag)
+
+	if rw := publish("a", "first"); rw.Code != http.StatusOK || rw.HeaderMap.Get("Etag") != etag {
+		t.Errorf("Expected 200 with Etag %s, got %d %q", etag, rw.Code, rw.HeaderMap.Get("Etag"))
+	}
+	if s := c.Stats(); s.Queued != 1 || s.Published != 1 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+
+	publish("b", "second")
+	publish("", "third")
+	publish("", "third")
+	if s := c.Stats(); s.Queued != 3 || s.Published != 4 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+}
+
+// clear channel tests
+func TestPusherClearChannel(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	p.PublishString("test", "hello", true)
+
+	if !p.ClearChannel("test") || p.ClearChannel("missing") || p.HasChannel("missing") {
+		t.Errorf("Invalid ClearChannel results")
+	}
+	if s := p.ChannelStats()["test"]; s.Queued != 0 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+}
+
+// peek tests
+func TestPeek(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	if m, ok := p.Peek("test"); ok || m != nil || p.HasChannel("test") {
+		t.Errorf("Expected nothing from an unknown channel, got %v", m)
+	}
+
+	c, _ := p.Channel("test")
+	if m, ok := p.Peek("test"); ok || m != nil {
+		t.Errorf("Expected nothing from an empty channel, got %v", m)
+	}
+
+	p.PublishString("test", "first", true)
+	p.PublishString("test", "second", false)
+	before := c.Stats()
+	if m, ok := p.Peek("test"); !ok || string(m.Payload) != "second" || m.ContentType != "text/plain" {
+		t.Errorf("Expected second, got %v", m)
+	}
+	if s := c.Stats(); s != before {
+		t.Errorf("Stats were disturbed %#v", s)
+	}
+}
+
+// subscriber count tests
+func TestSubscriberCount(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{PollingTimeout: 30e9})
+	c, _ := p.Channel("test")
+
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() {
+			serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+			done <- true
+		}()
+	}
+	time.Sleep(1e9 / 4)
+	if n := c.SubscriberCount(); n != 2 {
+		t.Errorf("Expected 2 subscribers, got %d", n)
+	}
+
+	c.PublishString("hello", false)
+	<-done
+	<-done
+	if n := c.SubscriberCount(); n != 0 {
+		t.Errorf("Expected no subscribers, got %d", n)
+	}
+}
+
+// shard tests
+func TestShards(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	for i := 0; i < 100; i++ {
+		p.PublishString(strconv.Itoa(i), "hello", true)
+	}
+
+	used := 0
+	for i := range p.shards {
+		if len(p.shards[i].channels) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("Expected the channels to be spread over the shards, used %d", used)
+	}
+	if s := p.Stats(); s.Channels != 100 || s.Queued != 100 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+	if c, ok := p.lookup("42"); !ok || p.shard("42") != p.shard(c.id) {
+		t.Errorf("Channel was not found in its shard")
+	}
+}
+
+func BenchmarkConcurrentChannels(b *testing.B) {
+	b.StopTimer()
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, Logger: NopLog})
+	const workers = 8
+	done := make(chan bool)
+	b.StartTimer()
+
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			for i := w; i < b.N; i += workers {
+				p.PublishString(strconv.Itoa(i%1000), "hello", true)
+			}
+			done <- true
+		}(w)
+	}
+	for w := 0; w < workers; w++ {
+		<-done
+	}
+}
+
+// idle gc tests
+func TestGCIdle(t *testing.T) {
+	var collected []string
+	p := New(StaticAcceptor("test"), Configuration{MaxChannelIdleTime: 60e9,
+		OnChannelGC: func(cid string, stats Stats) {
+			collected = append(collected, cid)
+		}})
+	for _, cid := range []string{"a", "b", "c"} {
+		p.Channel(cid)
+	}
+	c, _ := p.Channel("b")
+	c.stats.Created -= 120
+
+	if n := p.GC(); n != 1 || len(collected) != 1 || collected[0] != "b" {
+		t.Errorf("Expected b to be collected, got %d %q", n, collected)
+	}
+	ids := p.Channels()
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != "a,c" {
+		t.Errorf("Invalid remaining channels %q", ids)
+	}
+}
+
+func BenchmarkGCIdle(b *testing.B) {
+	b.StopTimer()
+	p := New(StaticAcceptor("test"), Configuration{MaxChannelIdleTime: 600e9, Logger: NopLog})
+	for i := 0; i < 100000; i++ {
+		p.Channel(strconv.Itoa(i))
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		p.GC()
+	}
+}
+
+// buffer reuse tests
+func TestPublishBufferReuse(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 10, Logger: NopLog})
+
+	const workers, publishes = 8, 50
+	done := make(chan bool)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			for i := 0; i < publishes; i++ {
+				body := strings.Repeat(strconv.Itoa(w), 10+i)
+				serveRequest(p.PublisherHandler, "POST", "/pub?id="+strconv.Itoa(w), body)
+				if m, ok := p.Peek(strconv.Itoa(w)); !ok || string(m.Payload) != body {
+					t.Errorf("Corrupted payload in channel %d", w)
+				}
+			}
+			done <- true
+		}(w)
+	}
+	for w := 0; w < workers; w++ {
+		<-done
+	}
+
+	for w := 0; w < workers; w++ {
+		c, _ := p.Channel(strconv.Itoa(w))
+		for i := 0; i < c.queue.Len(); i++ {
+			if payload := string(c.queue.At(i).Payload); payload != strings.Repeat(strconv.Itoa(w), 10+publishes-10+i) {
+				t.Errorf("Corrupted payload %q in channel %d", payload, w)
+			}
+		}
+	}
+}
+
+func BenchmarkPublisherPost(b *testing.B) {
+	b.StopTimer()
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, Logger: NopLog})
+	body := strings.Repeat("x", 1024)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		serveRequest(p.PublisherHandler, "POST", "/pub", body)
+	}
+}
+
+// batch tests
+// priority header tests
+func TestPriorityHeaders(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingMechanism: PollingMechanismInterval})
+	c, _ := p.Channel("test")
+	low := &Message{Status: http.StatusOK, Payload: []byte("low")}
+	high := &Message{Status: http.StatusOK, Payload: []byte("high"), Priority: 1}
+	c.Publish(low, true)
+	c.Publish(high, true)
+
+	// the urgent message comes first, but the position stays before the low one
+	rw := serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	if rw.Code != http.StatusOK || rw.Body.String() != "high" {
+		t.Fatalf("Expected high, got %d %q", rw.Code, rw.Body.String())
+	}
+	served := rw.HeaderMap.Get("X-Served-Msg-Ids")
+	if served != strconv.Itoa64(high.seq) || rw.HeaderMap.Get("X-Msg-Id") != "" || rw.HeaderMap.Get("Etag") != "0" {
+		t.Errorf("Invalid position %v", rw.HeaderMap)
+	}
+
+	// passing the served ids back yields the low one, after which the position is the newest
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	req.Header.Set("X-Served-Msg-Ids", served)
+	rw = httptest.NewRecorder()
+	p.SubscriberHandler.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || rw.Body.String() != "low" {
+		t.Fatalf("Expected low, got %d %q", rw.Code, rw.Body.String())
+	}
+	if rw.HeaderMap.Get("X-Msg-Id") != strconv.Itoa64(high.seq) || rw.HeaderMap.Get("X-Served-Msg-Ids") != "" {
+		t.Errorf("Invalid position %v", rw.HeaderMap)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingMechanism: PollingMechanismInterval})
+	c, _ := p.Channel("test")
+	for _, s := range []string{"first", "second", "third"} {
+		c.PublishString(s, true)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	req.Header.Set("Accept", "multipart/mixed")
+	rw := httptest.NewRecorder()
+	p.SubscriberHandler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK || !strings.HasPrefix(rw.HeaderMap.Get("Content-Type"), "multipart/mixed") {
+		t.Fatalf("Invalid response %d %v", rw.Code, rw.HeaderMap)
+	}
+	if id := rw.HeaderMap.Get("X-Msg-Id"); id != strconv.Itoa64(c.lastMessage.seq) {
+		t.Errorf("Expected the id of the newest message, got %q", id)
+	}
+	parts := strings.Split(rw.Body.String(), "--"+multipartBoundary)
+	if len(parts) != 5 || parts[4] != "--\r\n" {
+		t.Fatalf("Invalid body %q", rw.Body.String())
+	}
+	for i, s := range []string{"first", "second", "third"} {
+		if !strings.HasPrefix(parts[i+1], "\r\nContent-Type: text/plain\r\n") || !strings.HasSuffix(parts[i+1], "\r\n\r\n"+s+"\r\n") {
+			t.Errorf("Invalid part %q", parts[i+1])
+		}
+	}
+	if s := c.Stats(); s.Delivered != 3 {
+		t.Errorf("Invalid counters %#v", s)
+	}
+}
+
+// channel id length tests
+func TestMaxChannelIdLength(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true,
+		MaxChannelIdLength: 5, PollingMechanism: PollingMechanismInterval})
+
+	if rw := serveRequest(p.PublisherHandler, "PUT", "/pub?id=12345", ""); rw.Code != http.StatusOK || !p.HasChannel("12345") {
+		t.Errorf("Expected 200, got %d", rw.Code)
+	}
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub?id=12345", ""); rw.Code != http.StatusNotModified {
+		t.Errorf("Expected 304, got %d", rw.Code)
+	}
+
+	for _, handler := range []http.Handler{p.PublisherHandler, p.SubscriberHandler, p.SubscriberSSEHandler} {
+		if rw := serveRequest(handler, "GET", "/?id=123456", ""); rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", rw.Code)
+		}
+	}
+	if p.HasChannel("123456") {
+		t.Errorf("Channel with a too long id was created")
+	}
+}
+
+// per-request polling timeout tests
+func TestPollTimeoutHeader(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true, PollingTimeout: 30e9})
+
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	req.Header.Set("X-Poll-Timeout", "1")
+	rw := httptest.NewRecorder()
+	start := time.Nanoseconds()
+	p.SubscriberHandler.ServeHTTP(rw, req)
+	if elapsed := time.Nanoseconds() - start; rw.Code != http.StatusNotModified || elapsed < 1e9 || elapsed > 5e9 {
+		t.Errorf("Expected 304 after a second, got %d after %d ns", rw.Code, elapsed)
+	}
+
+	tests := []struct {
+		header  string
+		max     int64
+		timeout int64
+	}{
+		{"", 30e9, 30e9},
+		{"5", 30e9, 5e9},
+		{"30", 30e9, 30e9},
+		{"31", 30e9, 30e9},
+		{"0", 30e9, 30e9},
+		{"-5", 30e9, 30e9},
+		{"5s", 30e9, 30e9},
+		{"99999999999999", 0, 0},
+		{"3600", 0, 3600e9},
+	}
+	for _, test := range tests {
+		p := New(StaticAcceptor("test"), Configuration{PollingTimeout: test.max})
+		req.Header.Set("X-Poll-Timeout", test.header)
+		if timeout := p.pollingTimeout(req); timeout != test.timeout {
+			t.Errorf("Expected timeout %d for %q, got %d", test.timeout, test.header, timeout)
+		}
+	}
+}
+
+func TestPollTimeoutCap(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true, PollingTimeout: 1e9})
+
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	req.Header.Set("X-Poll-Timeout", "60")
+	rw := httptest.NewRecorder()
+	start := time.Nanoseconds()
+	p.SubscriberHandler.ServeHTTP(rw, req)
+	if elapsed := time.Nanoseconds() - start; rw.Code != http.StatusNotModified || elapsed > 5e9 {
+		t.Errorf("Expected 304 after the server timeout, got %d after %d ns", rw.Code, elapsed)
+	}
+}
+
+// empty response status tests
+func TestEmptyResponseStatus(t *testing.T) {
+	for _, status := range []int{0, http.StatusOK, http.StatusNoContent, http.StatusNotModified} {
+		expected := status
+		if status == 0 {
+			expected = http.StatusNotModified
+		}
+
+		// nothing available to an interval-polling subscriber
+		p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true,
+			EmptyResponseStatus: status, PollingMechanism: PollingMechanismInterval})
+		if rw := serveRequest(p.SubscriberHandler, "GET", "/sub", ""); rw.Code != expected || rw.Body.Len() != 0 {
+			t.Errorf("Expected %d without body, got %d %q", expected, rw.Code, rw.Body.String())
+		}
+
+		// a timed out long-polling subscriber
+		p = New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true,
+			EmptyResponseStatus: status, PollingTimeout: 1e8})
+		if rw := serveRequest(p.SubscriberHandler, "GET", "/sub", ""); rw.Code != expected || rw.Body.Len() != 0 {
+			t.Errorf("Expected %d without body, got %d %q", expected, rw.Code, rw.Body.String())
+		}
+	}
+}
+
+// message constructor tests
+func TestNewMessage(t *testing.T) {
+	m := NewMessage("application/json", []byte(`{"a":1}`))
+	if m.Status != http.StatusOK || m.ContentType != "application/json" || string(m.Payload) != `{"a":1}` || m.Id != "" {
+		t.Errorf("Invalid message %#v", m)
+	}
+
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true, PollingMechanism: PollingMechanismInterval})
+	if n := p.PublishBytes("test", "application/json", []byte(`{"b":2}`), true); n != 0 {
+		t.Errorf("Expected no deliveries, got %d", n)
+	}
+	rw := serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	if rw.Code != http.StatusOK || rw.HeaderMap.Get("Content-Type") != "application/json" || rw.Body.String() != `{"b":2}` {
+		t.Errorf("Expected the published message, got %d %q %q", rw.Code, rw.HeaderMap.Get("Content-Type"), rw.Body.String())
+	}
+}
+
+// json publish tests
+func TestPublishJSON(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true, PollingMechanism: PollingMechanismInterval})
+	if n, err := p.PublishJSON("test", map[string]int{"a": 1}, true); n != 0 || err != nil {
+		t.Errorf("Expected no deliveries and no error, got %d, %v", n, err)
+	}
+	rw := serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	if rw.Code != http.StatusOK || rw.HeaderMap.Get("Content-Type") != "application/json" || rw.Body.String() != `{"a":1}` {
+		t.Errorf("Expected the published message, got %d %q %q", rw.Code, rw.HeaderMap.Get("Content-Type"), rw.Body.String())
+	}
+
+	if _, err := p.PublishJSON("unmarshallable", make(chan int), true); err == nil {
+		t.Error("Expected a marshalling error")
+	}
+	if p.HasChannel("unmarshallable") {
+		t.Error("Expected no channel to be created")
+	}
+
+	c, _ := p.Channel("test")
+	if _, err := c.PublishJSON(func() {}, true); err == nil {
+		t.Error("Expected a marshalling error")
+	}
+	if s := c.Stats(); s.Published != 1 {
+		t.Errorf("Expected 1 published message, got %d", s.Published)
+	}
+}
+
+// presence tests
+func TestPresenceChannels(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 10, PresenceChannels: true})
+	c, _ := p.Channel("test")
+	if !p.HasChannel("test" + PresenceSuffix) {
+		t.Fatal("Expected the presence channel to be created")
+	}
+	if p.HasChannel("test" + PresenceSuffix + PresenceSuffix) {
+		t.Error("Expected no presence channel for the presence channel")
+	}
+
+	sub, _ := c.Subscribe(0, 0, 0)
+	c.Unsubscribe(sub)
+
+	pc, _ := p.lookup("test" + PresenceSuffix)
+	var events []string
+	for _, m := range pc.queue.Slice() {
+		if m.ContentType != "application/json" {
+			t.Errorf("Invalid content-type %q", m.ContentType)
+		}
+		events = append(events, string(m.Payload))
+	}
+	expected := []string{`{"event":"join","subscribers":1}`, `{"event":"leave","subscribers":0}`}
+	if len(events) != len(expected) || events[0] != expected[0] || events[1] != expected[1] {
+		t.Errorf("Expected %q, got %q", expected, events)
+	}
+
+	p.DeleteChannel("test")
+	if p.HasChannel("test" + PresenceSuffix) {
+		t.Error("Expected the presence channel to be deleted along with its channel")
+	}
+}
+
+// pattern subscription tests
+func TestPatternSubscription(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3, PatternSubscriptions: true, PollingTimeout: 5e9})
+	notifications, _ := p.Channel("user.123.notifications")
+	messages, _ := p.Channel("user.123.messages")
+	p.Channel("user.456.messages")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveRequest(p.SubscriberHandler, "GET", "/sub?id=user.123.*", "")
+	}()
+	time.Sleep(1e8)
+	if notifications.SubscriberCount() != 1 || messages.SubscriberCount() != 1 {
+		t.Errorf("Expected a subscriber in both matching channels")
+	}
+
+	p.PublishString("user.456.messages", "other", true)
+	p.PublishString("user.123.notifications", "hello", true)
+	rw := <-done
+	if rw.Code != http.StatusOK || rw.Body.String() != "hello" || rw.HeaderMap.Get("X-Channel") != "user.123.notifications" {
+		t.Errorf("Expected hello from user.123.notifications, got %d %q from %q", rw.Code, rw.Body.String(), rw.HeaderMap.Get("X-Channel"))
+	}
+	if n := messages.SubscriberCount(); n != 0 {
+		t.Errorf("Expected the other subscription to be canceled, got %d subscribers", n)
+	}
+
+	// queued messages are delivered immediately
+	p.PublishString("user.123.messages", "world", true)
+	rw = serveRequest(p.SubscriberHandler, "GET", "/sub?id=user.123.*", "")
+	if rw.Code != http.StatusOK || rw.Body.String() != "world" || rw.HeaderMap.Get("X-Channel") != "user.123.messages" {
+		t.Errorf("Expected world from user.123.messages, got %d %q from %q", rw.Code, rw.Body.String(), rw.HeaderMap.Get("X-Channel"))
+	}
+
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub?id=user.789.*", ""); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", rw.Code)
+	}
+}
+
+// pattern presence tests
+func TestPatternPresence(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3, PatternSubscriptions: true,
+		PresenceChannels: true, PollingTimeout: 5e9})
+	c, _ := p.Channel("room.1")
+	sub, _ := c.Subscribe(0, 0, 0)
+	defer c.Unsubscribe(sub)
+	if pc, ok := p.lookup("room.1" + PresenceSuffix); !ok || pc.Stats().Queued == 0 {
+		t.Fatalf("Expected the subscriber to be announced")
+	}
+
+	// the announcement is not what "*" asks for
+	if rw := serveRequest(p.SubscriberHandler, "HEAD", "/sub?id=*", ""); rw.Code == http.StatusOK {
+		t.Errorf("Expected no message, got one from %q", rw.HeaderMap.Get("X-Channel"))
+	}
+	rw := serveRequest(p.SubscriberHandler, "HEAD", "/sub?id=*"+PresenceSuffix, "")
+	if rw.Code != http.StatusOK || rw.HeaderMap.Get("X-Channel") != "room.1"+PresenceSuffix {
+		t.Errorf("Expected a message from the presence channel, got %d from %q", rw.Code, rw.HeaderMap.Get("X-Channel"))
+	}
+}
+
+// malformed conditional header tests
+func TestMalformedConditions(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true, PollingMechanism: PollingMechanismInterval})
+	p.PublishString("test", "hello", true)
+
+	for _, header := range []struct{ name, value string }{
+		{"If-None-Match", "garbage"},
+		{"If-Modified-Since", "yesterday"},
+		{"X-Last-Msg-Id", "1e3"},
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+		req.Header.Set(header.name, header.value)
+		rw := httptest.NewRecorder()
+		p.SubscriberHandler.ServeHTTP(rw, req)
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s %q, got %d", header.name, header.value, rw.Code)
+		}
+	}
+
+	// absent headers still mean the oldest message
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub", ""); rw.Code != http.StatusOK || rw.Body.String() != "hello" {
+		t.Errorf("Expected hello, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+// if-modified-since format tests
+func TestSinceFormats(t *testing.T) {
+	for _, value := range []string{
+		"Sun, 06 Nov 1994 08:49:37 GMT",
+		"Sun, 06 Nov 1994 10:49:37 +0200",
+		"1994-11-06T08:49:37Z",
+		"1994-11-06T03:49:37-05:00",
+	} {
+		req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+		req.Header.Set("If-Modified-Since", value)
+		since, _, _, _, err := parseConditions(req)
+		if err != nil || since != 784111777e9 {
+			t.Errorf("Expected %q to parse to 784111777e9, got %d, %v", value, since, err)
+		}
+	}
+}
+
+// full queue tests
+func TestRejectWhenFull(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 1, QueuePolicy: QueuePolicyRejectWhenFull})
+	if rw := serveRequest(p.PublisherHandler, "POST", "/pub", "m0"); rw.Code != http.StatusAccepted {
+		t.Errorf("Expected 202, got %d", rw.Code)
+	}
+	if rw := serveRequest(p.PublisherHandler, "POST", "/pub", "m1"); rw.Code != StatusInsufficientStorage {
+		t.Errorf("Expected 507, got %d", rw.Code)
+	}
+	if m, _ := p.Peek("test"); m == nil || string(m.Payload) != "m0" {
+		t.Errorf("Expected m0 to remain the last message, got %v", m)
+	}
+}
+
+// pattern delivered count tests
+func TestPatternDeliveredCount(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3, PatternSubscriptions: true, PollingTimeout: 5e9})
+	a, _ := p.Channel("a.1")
+	b, _ := p.Channel("a.2")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveRequest(p.SubscriberHandler, "GET", "/sub?id=a.*", "")
+	}()
+	time.Sleep(1e8)
+	publishChannels([]*channel{a, b}, NewMessage("text/plain", []byte("hello")), true)
+	<-done
+	time.Sleep(1e7)
+
+	if d := a.Stats().Delivered + b.Stats().Delivered; d != 1 {
+		t.Errorf("Expected a single delivery, got %d", d)
+	}
+	if rw := serveRequest(p.SubscriberHandler, "HEAD", "/sub?id=a.*", ""); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", rw.Code)
+	}
+	if d := a.Stats().Delivered + b.Stats().Delivered; d != 1 {
+		t.Errorf("Expected HEAD not to count as a delivery, got %d", d)
+	}
+}
+
+// pattern timeout race tests
+func TestPatternLateMessage(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3, PatternSubscriptions: true, PollingTimeout: 5e9})
+	a, _ := p.Channel("a.1")
+	p.Channel("a.2")
+
+	// the message arrives just as the wait ends, before anyone reads it
+	ps, m, st := p.subscribePattern("a.*", 0, 0, 0, nil, false)
+	if ps == nil || m != nil || st != 0 {
+		t.Fatalf("Expected a parked subscription, got %v %d", m, st)
+	}
+	a.PublishString("late", false)
+	time.Sleep(1e8)
+	if m := ps.finish(); m == nil || string(m.Payload) != "late" || ps.delivered() != a {
+		t.Errorf("Expected the late message from a.1, got %v", m)
+	}
+	if d := a.Stats().Delivered; d != 1 {
+		t.Errorf("Expected a single delivery, got %d", d)
+	}
+
+	// a subscription timing out without a message tells no channel
+	p.config.PollingMechanism, p.config.IntervalMinWait = PollingMechanismInterval, 1e8
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub?id=a.*", ""); rw.Code != http.StatusNotModified || rw.HeaderMap.Get("X-Channel") != "" {
+		t.Errorf("Expected a 304 without X-Channel, got %d %q", rw.Code, rw.HeaderMap.Get("X-Channel"))
+	}
+}
+
+// delete race tests
+func TestDeleteWhileSubscribing(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	before := runtime.Goroutines()
+
+	for i := 0; i < 100; i++ {
+		c, _ := p.Channel("test")
+		done := make(chan int)
+		for j := 0; j < 4; j++ {
+			go func() {
+				m, _ := c.Receive(0, 0, nil)
+				done <- m.Status
+			}()
+		}
+		p.DeleteChannel("test")
+
+		timeout := time.After(5e9)
+		for j := 0; j < 4; j++ {
+			select {
+			case status := <-done:
+				if status != http.StatusGone {
+					t.Errorf("Expected 410, got %d", status)
+				}
+			case <-timeout:
+				t.Fatal("A subscriber was left parked in a deleted channel")
+			}
+		}
+	}
+
+	time.Sleep(1e7)
+	if n := runtime.Goroutines(); n > before {
+		t.Errorf("Expected no goroutines to be left, got %d more", n-before)
+	}
+}
+
+// on-demand gc tests
+func TestGCChannels(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{MaxChannels: 2})
+	for _, cid := range []string{"a", "b", "c", "d"} {
+		c, _ := p.Channel(cid)
+		c.stats.Created -= 100
+	}
+	a, _ := p.Channel("a")
+	a.stats.Created -= 100
+	d, _ := p.Channel("d")
+	d.stats.Created -= 50
+
+	ids := p.GCChannels()
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "d" {
+		t.Errorf("Expected a and d to be collected, got %q", ids)
+	}
+	if p.HasChannel("a") || p.HasChannel("d") || !p.HasChannel("b") || !p.HasChannel("c") {
+		t.Errorf("Invalid remaining channels %q", p.Channels())
+	}
+	if ids := p.GCChannels(); len(ids) != 0 {
+		t.Errorf("Expected nothing to be collected, got %q", ids)
+	}
+}
+
+// gc log tests
+func TestGCLog(t *testing.T) {
+	log := new(captureLog)
+	p := New(StaticAcceptor("test"), Configuration{MaxChannels: 1, MaxChannelIdleTime: 1e12, Logger: log})
+	p.Channel("a")
+
+	if p.GC() != 0 || len(log.lines) != 0 {
+		t.Errorf("Expected no log lines from an empty run, got %q", log.lines)
+	}
+
+	b, _ := p.Channel("b")
+	b.stats.Created -= 100
+	if p.GC() != 1 || len(log.lines) != 2 ||
+		log.lines[0] != "GC: Channel \"b\" was garbage collected" ||
+		!strings.HasPrefix(log.lines[1], "GC: Collected 1 of 2 channels in ") {
+		t.Errorf("Invalid log lines %q", log.lines)
+	}
+}
+
+// conflict reason tests
+func TestConflictReason(t *testing.T) {
+	for _, test := range []struct {
+		mode   int
+		reason string
+	}{
+		{ConcurrencyModeLIFO, "replaced"},
+		{ConcurrencyModeFILO, "already-subscribed"},
+	} {
+		p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true,
+			ConcurrencyMode: test.mode, PollingTimeout: 5e9})
+		first := make(chan *httptest.ResponseRecorder)
+		go func() {
+			first <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+		}()
+		time.Sleep(1e8)
+
+		second := make(chan *httptest.ResponseRecorder)
+		go func() {
+			second <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+		}()
+
+		// the displaced subscriber is the first one in LIFO mode and the second one in FILO mode
+		displaced, other := first, second
+		if test.mode == ConcurrencyModeFILO {
+			displaced, other = second, first
+		}
+		rw := <-displaced
+		if rw.Code != http.StatusConflict || rw.HeaderMap.Get("X-Conflict-Reason") != test.reason || rw.Body.Len() == 0 {
+			t.Errorf("Expected 409 because of %s, got %d %q %q", test.reason, rw.Code, rw.HeaderMap.Get("X-Conflict-Reason"), rw.Body.String())
+		}
+		for _, h := range []string{"Etag", "Last-Modified", "X-Msg-Id"} {
+			if v := rw.HeaderMap.Get(h); v != "" {
+				t.Errorf("Expected no %s header with a conflict, got %q", h, v)
+			}
+		}
+
+		time.Sleep(1e8)
+		p.PublishString("test", "hello", true)
+		if rw := <-other; rw.Code != http.StatusOK || rw.HeaderMap.Get("X-Conflict-Reason") != "" {
+			t.Errorf("Expected 200 without a conflict, got %d %q", rw.Code, rw.HeaderMap.Get("X-Conflict-Reason"))
+		}
+	}
+}
+
+// gone reason tests
+func TestGoneReason(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true,
+		MaxChannelIdleTime: 60e9, PollingTimeout: 5e9, GCRetryAfter: 10})
+
+	for _, reason := range []string{"deleted", "collected"} {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+		}()
+		time.Sleep(1e8)
+
+		c, _ := p.lookup("test")
+		if reason == "deleted" {
+			p.DeleteChannel("test")
+		} else {
+			c.lock.Lock()
+			c.stats.LastRequested -= 120
+			c.lock.Unlock()
+			p.GC()
+		}
+
+		rw := <-done
+		if rw.Code != http.StatusGone || rw.HeaderMap.Get("X-Gone-Reason") != reason || rw.Body.Len() == 0 {
+			t.Errorf("Expected 410 because the channel was %s, got %d %q %q", reason, rw.Code, rw.HeaderMap.Get("X-Gone-Reason"), rw.Body.String())
+		}
+		if retry := rw.HeaderMap.Get("Retry-After"); (reason == "collected") != (retry == "10") {
+			t.Errorf("Unexpected Retry-After %q when the channel was %s", retry, reason)
+		}
+	}
+}
+
+// custom message tests
+func TestCustomMessages(t *testing.T) {
+	gone := NewMessage("application/json", []byte(`{"error":"gone"}`))
+	conflict := NewMessage("application/json", []byte(`{"error":"conflict"}`))
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true,
+		ConcurrencyMode: ConcurrencyModeLIFO, PollingTimeout: 5e9, GoneMessage: gone, ConflictMessage: conflict})
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		first <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	}()
+	time.Sleep(1e8)
+	second := make(chan *httptest.ResponseRecorder)
+	go func() {
+		second <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	}()
+
+	rw := <-first
+	if rw.Code != http.StatusConflict || rw.Body.String() != `{"error":"conflict"}` ||
+		rw.HeaderMap.Get("Content-Type") != "application/json" || rw.HeaderMap.Get("X-Conflict-Reason") != "replaced" {
+		t.Errorf("Expected the custom 409, got %d %q %q", rw.Code, rw.HeaderMap.Get("Content-Type"), rw.Body.String())
+	}
+
+	time.Sleep(1e8)
+	p.DeleteChannel("test")
+	rw = <-second
+	if rw.Code != http.StatusGone || rw.Body.String() != `{"error":"gone"}` ||
+		rw.HeaderMap.Get("Content-Type") != "application/json" || rw.HeaderMap.Get("X-Gone-Reason") != "deleted" {
+		t.Errorf("Expected the custom 410, got %d %q %q", rw.Code, rw.HeaderMap.Get("Content-Type"), rw.Body.String())
+	}
+	for _, h := range []string{"Etag", "Last-Modified", "X-Msg-Id"} {
+		if v := rw.HeaderMap.Get(h); v != "" {
+			t.Errorf("Expected no %s header with the custom 410, got %q", h, v)
+		}
+	}
+
+	if gone.etag != 0 || gone.time != 0 || conflict.etag != 0 || conflict.time != 0 {
+		t.Errorf("Expected the configured messages to be left untouched")
+	}
+}
+
+// conditional publish tests
+func TestIfMatch(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{})
+
+	publish := func(match, body string) int {
+		req, _ := http.NewRequest("POST", "http://localhost/pub", strings.NewReader(body))
+		req.Header.Set("If-Match", match)
+		rw := httptest.NewRecorder()
+		p.PublisherHandler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	if code := publish("*", "first"); code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 from an empty channel, got %d", code)
+	}
+	if code := publish("", "first"); code != http.StatusAccepted {
+		t.Errorf("Expected 202, got %d", code)
+	}
+	c, _ := p.Channel("test")
+	etag := c.lastMessage.etag
+
+	if code := publish(strconv.Itoa(etag), "second"); code != http.StatusAccepted {
+		t.Errorf("Expected 202 with a matching etag, got %d", code)
+	}
+	stale := strconv.Itoa(c.lastMessage.etag + 1)
+	if code := publish(stale, "third"); code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 with a stale etag, got %d", code)
+	}
+	if m := c.Peek(); string(m.Payload) != "second" {
+		t.Errorf("Expected the second message to remain the last, got %q", m.Payload)
+	}
+	if code := publish(`"`+strconv.Itoa(c.lastMessage.etag)+`"`, "fourth"); code != http.StatusAccepted {
+		t.Errorf("Expected 202 with a quoted etag, got %d", code)
+	}
+}
+
+// publish response id tests
+func TestPublishIds(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+
+	serveRequest(p.PublisherHandler, "POST", "/pub", "first")
+	pub := serveRequest(p.PublisherHandler, "POST", "/pub", "second")
+	if pub.Code != http.StatusAccepted || pub.HeaderMap.Get("Etag") == "" || pub.HeaderMap.Get("X-Msg-Id") != "2" {
+		t.Fatalf("Expected 202 with Etag and X-Msg-Id 2, got %d %v", pub.Code, pub.HeaderMap)
+	}
+
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	req.Header.Set("X-Last-Msg-Id", "1")
+	sub := httptest.NewRecorder()
+	p.SubscriberHandler.ServeHTTP(sub, req)
+	if sub.Body.String() != "second" {
+		t.Fatalf("Expected the second message, got %q", sub.Body.String())
+	}
+	for _, h := range []string{"Etag", "X-Msg-Id"} {
+		if sub.HeaderMap.Get(h) != pub.HeaderMap.Get(h) {
+			t.Errorf("Expected the %s %q of the publish, got %q", h, pub.HeaderMap.Get(h), sub.HeaderMap.Get(h))
+		}
+	}
+}
+
+// channel options tests
+func TestPutCapacity(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 5})
+
+	for _, body := range []string{"{", `{"capacity":-1}`, `{"capacity":"2"}`} {
+		if rw := serveRequest(p.PublisherHandler, "PUT", "/pub", body); rw.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %q, got %d", body, rw.Code)
+		}
+	}
+	if p.HasChannel("test") {
+		t.Errorf("Expected invalid options not to create the channel")
+	}
+
+	if rw := serveRequest(p.PublisherHandler, "PUT", "/pub", `{"capacity":2}`); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", rw.Code)
+	}
+	for _, s := range []string{"a", "b", "c"} {
+		serveRequest(p.PublisherHandler, "POST", "/pub", s)
+	}
+	c, _ := p.Channel("test")
+	if msgs := c.queue.Slice(); len(msgs) != 2 || string(msgs[0].Payload) != "b" || string(msgs[1].Payload) != "c" {
+		t.Errorf("Expected the queue to be bounded to b and c, got %d messages", len(msgs))
+	}
+
+	serveRequest(p.PublisherHandler, "PUT", "/pub", "")
+	if c.Stats().Queued != 2 {
+		t.Errorf("Expected a PUT without options to leave the capacity alone")
+	}
+	serveRequest(p.PublisherHandler, "PUT", "/pub", `{"capacity":1}`)
+	if msgs := c.queue.Slice(); len(msgs) != 1 || string(msgs[0].Payload) != "c" {
+		t.Errorf("Expected the queue to shrink to c, got %d messages", len(msgs))
+	}
+}
+
+// snapshot tests
+func TestSnapshot(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	p.Channel("empty")
+	p.PublishBytes("json", "application/json", []byte(`{"a":1}`), true)
+
+	// publishing concurrently must not race with taking snapshots
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			p.PublishString("busy", "x", true)
+		}
+		done <- true
+	}()
+	for i := 0; i < 100; i++ {
+		p.Snapshot()
+	}
+	<-done
+
+	snapshots := make(map[string]ChannelSnapshot)
+	for _, s := range p.Snapshot() {
+		snapshots[s.Id] = s
+	}
+	if len(snapshots) != 3 {
+		t.Fatalf("Expected 3 channels, got %v", snapshots)
+	}
+	if s := snapshots["empty"]; s.Stats.Published != 0 || s.LastContentType != "" || s.LastSize != 0 {
+		t.Errorf("Invalid snapshot %#v", s)
+	}
+	if s := snapshots["json"]; s.Stats.Published != 1 || s.LastContentType != "application/json" || s.LastSize != 7 {
+		t.Errorf("Invalid snapshot %#v", s)
+	}
+	if s := snapshots["busy"]; s.Stats.Published != 100 || s.Stats.Queued != 3 || s.LastSize != 1 {
+		t.Errorf("Invalid snapshot %#v", s)
+	}
+}
+
+// normalizing acceptor tests
+func TestNormalizingAcceptor(t *testing.T) {
+	p := New(NormalizingAcceptor(QueryParameterAcceptor("id"), strings.ToLower), Configuration{ChannelCapacity: 3})
+	serveRequest(p.PublisherHandler, "POST", "/pub?id=Room42", "hello")
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub?id=ROOM42", ""); rw.Code != http.StatusOK || rw.Body.String() != "hello" {
+		t.Errorf("Expected the message from the same channel, got %d %q", rw.Code, rw.Body.String())
+	}
+	if ids := p.Channels(); len(ids) != 1 || ids[0] != "room42" {
+		t.Errorf("Invalid channels %q", ids)
+	}
+
+	deny := NormalizingAcceptor(StaticAcceptor("test"), func(string) string { return "" })
+	p = New(deny, Configuration{})
+	if rw := serveRequest(p.PublisherHandler, "POST", "/pub", "hello"); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 when the id is normalized away, got %d", rw.Code)
+	}
+}
+
+// channel content-type tests
+func TestChannelContentType(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3, ContentType: "text/plain"})
+	serveRequest(p.PublisherHandler, "PUT", "/pub?id=events", `{"contentType":"application/json"}`)
+	serveRequest(p.PublisherHandler, "PUT", "/pub?id=logs", "")
+
+	for _, id := range []string{"events", "logs", "other"} {
+		req, _ := http.NewRequest("POST", "http://localhost/pub?id="+id, strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		p.PublisherHandler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for id, expected := range map[string]string{"events": "application/json", "logs": "text/plain", "other": "text/plain"} {
+		rw := serveRequest(p.SubscriberHandler, "GET", "/sub?id="+id, "")
+		if ctype := rw.Header().Get("Content-Type"); ctype != expected {
+			t.Errorf("Expected %q in channel %q, got %q", expected, id, ctype)
+		}
+	}
+
+	c, _ := p.Channel("events")
+	c.SetContentType("")
+	serveRequest(p.PublisherHandler, "POST", "/pub?id=events", "next")
+	if m := c.Available(0, 0, 0); m == nil || m.ContentType != "application/json" {
+		t.Errorf("Expected the queued message to keep its content-type, got %v", m)
+	}
+	if m := c.lastMessage; m.ContentType != "text/plain" {
+		t.Errorf("Expected the cleared override to fall back to text/plain, got %q", m.ContentType)
+	}
+}
+
+// redirect tests
+func TestRedirect(t *testing.T) {
+	acceptor := func(req *http.Request) string {
+		if req.FormValue("token") == "" {
+			return Redirect("/login?next=" + http.URLEscape(req.URL.Path))
+		}
+		return "test"
+	}
+	p := New(NormalizingAcceptor(acceptor, strings.ToUpper), Configuration{ChannelCapacity: 3})
+
+	rw := serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "/login?next=%2Fsub" {
+		t.Errorf("Expected a 302 to the login page, got %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+	rw = serveRequest(p.SubscriberSSEHandler, "GET", "/sse", "")
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "/login?next=%2Fsse" {
+		t.Errorf("Expected a streaming subscriber to be redirected, got %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+	rw = serveRequest(p.PublisherHandler, "POST", "/pub", "hello")
+	if rw.Code != http.StatusNotFound || rw.Header().Get("Location") != "" {
+		t.Errorf("Expected a publisher to be denied with a 404, got %d %q", rw.Code, rw.Header().Get("Location"))
+	}
+	if ids := p.Channels(); len(ids) != 0 {
+		t.Errorf("Expected no channels, got %q", ids)
+	}
+
+	serveRequest(p.PublisherHandler, "POST", "/pub?token=x", "hello")
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub?token=x", ""); rw.Code != http.StatusOK || rw.Body.String() != "hello" {
+		t.Errorf("Expected the message once accepted, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+// export tests
+func TestExportImport(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3})
+	a, _ := p.Channel("a")
+	a.PublishString("first", true)
+	a.PublishString("second", true)
+	a.SetCapacity(5)
+	b, _ := p.Channel("b")
+	b.PublishString("unqueued", false)
+	exported := a.Stats()
+
+	var buf bytes.Buffer
+	if err := p.Export(&buf); err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	q, err := Import(&buf, QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3})
+	if err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	ids := q.Channels()
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Fatalf("Invalid channels %q", ids)
+	}
+
+	a, _ = q.Channel("a")
+	if s := a.Stats(); s.Published != 2 || s.Queued != 2 || s.Created != exported.Created || s.Subscribers != 0 {
+		t.Errorf("Invalid stats %+v", s)
+	}
+	if a.capacity != 5 {
+		t.Errorf("Expected the capacity to survive, got %d", a.capacity)
+	}
+	first := a.queue.At(0)
+	rw := serveRequest(q.SubscriberHandler, "GET", "/sub?id=a", "")
+	if rw.Code != http.StatusOK || rw.Body.String() != "first" || rw.Header().Get("Etag") != strconv.Itoa(first.etag) {
+		t.Errorf("Expected the first message, got %d %q", rw.Code, rw.Body.String())
+	}
+	req, _ := http.NewRequest("GET", "http://localhost/sub?id=a", nil)
+	req.Header.Set("If-Modified-Since", rw.Header().Get("Last-Modified"))
+	req.Header.Set("If-None-Match", rw.Header().Get("Etag"))
+	rw = httptest.NewRecorder()
+	q.SubscriberHandler.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK || rw.Body.String() != "second" {
+		t.Errorf("Expected to resume with the second message, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	b, _ = q.Channel("b")
+	b.PublishString("next", true)
+	if m := b.Available(0, 0, 0); m == nil || m.seq != 2 {
+		t.Errorf("Expected the sequence to continue after the unqueued message, got %v", m)
+	}
+}
+
+// drain tests
+func TestDrain(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingTimeout: 5e9})
+	c, _ := p.Channel("test")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	}()
+	for c.SubscriberCount() == 0 {
+		time.Sleep(1e7)
+	}
+	rw, _ := newPipeResponseWriter()
+	req, _ := http.NewRequest("GET", "http://localhost/sse", nil)
+	streamed := make(chan bool)
+	go func() {
+		p.SubscriberSSEHandler.ServeHTTP(rw, req)
+		streamed <- true
+	}()
+	for c.SubscriberCount() < 2 {
+		time.Sleep(1e7)
+	}
+
+	drained := p.Drain()
+	if p.Drain() != drained {
+		t.Errorf("Expected draining again to return the same channel")
+	}
+	select {
+	case <-streamed:
+	case <-time.After(2e9):
+		t.Fatal("Expected the stream to end")
+	}
+	select {
+	case <-drained:
+		t.Errorf("Expected the pusher not to be drained while a subscriber is parked")
+	default:
+	}
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub", ""); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a new subscriber to be refused with 503, got %d", rw.Code)
+	}
+	if rw := serveRequest(p.SubscriberSSEHandler, "GET", "/sse", ""); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a new streaming subscriber to be refused with 503, got %d", rw.Code)
+	}
+	if rw := serveRequest(p.PublisherHandler, "POST", "/pub", "refused"); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a publisher to be refused with 503, got %d", rw.Code)
+	}
+	if rw := serveRequest(p.ReadinessHandler, "GET", "/ready", ""); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the readiness probe to fail, got %d", rw.Code)
+	}
+	if rw := serveRequest(p.HealthHandler, "GET", "/health", ""); rw.Code != http.StatusOK {
+		t.Errorf("Expected the liveness probe to pass, got %d", rw.Code)
+	}
+
+	c.PublishString("in-flight", true)
+	select {
+	case rw := <-done:
+		if rw.Code != http.StatusOK || rw.Body.String() != "in-flight" {
+			t.Errorf("Expected the parked subscriber to get its message, got %d %q", rw.Code, rw.Body.String())
+		}
+	case <-time.After(2e9):
+		t.Fatal("Expected the parked subscriber to complete")
+	}
+	select {
+	case <-drained:
+	case <-time.After(2e9):
+		t.Fatal("Expected the pusher to be drained")
+	}
+	p.Close()
+}
+
+// close drain tests
+func TestCloseDrains(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingTimeout: 30e9, DrainTimeout: 5e9})
+	c, _ := p.Channel("test")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	}()
+	for c.SubscriberCount() == 0 {
+		time.Sleep(1e7)
+	}
+
+	closed := make(chan bool)
+	go func() {
+		p.Close()
+		closed <- true
+	}()
+	time.Sleep(1e8)
+	c.PublishString("last", true)
+	if rw := <-done; rw.Code != http.StatusOK || rw.Body.String() != "last" {
+		t.Errorf("Expected the parked subscriber to finish before closing, got %d %q", rw.Code, rw.Body.String())
+	}
+	select {
+	case <-closed:
+	case <-time.After(2e9):
+		t.Fatal("Expected Close to return once drained")
+	}
+}
+
+// health tests
+func TestHealth(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{})
+	p.Channel("a")
+
+	for _, handler := range []http.Handler{p.HealthHandler, p.ReadinessHandler} {
+		rw := serveRequest(handler, "GET", "/health", "")
+		if rw.Code != http.StatusOK || !strings.HasPrefix(rw.Body.String(), `{"channels":1,"uptime":`) {
+			t.Errorf("Expected 200 before closing, got %d %q", rw.Code, rw.Body.String())
+		}
+	}
+	if ids := p.Channels(); len(ids) != 1 {
+		t.Errorf("Expected the probes not to create channels, got %q", ids)
+	}
+
+	p.Close()
+	if rw := serveRequest(p.HealthHandler, "GET", "/health", ""); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 from the liveness probe after closing, got %d", rw.Code)
+	}
+	if rw := serveRequest(p.ReadinessHandler, "GET", "/ready", ""); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from the readiness probe after closing, got %d", rw.Code)
+	}
+}
+
+// FailingResponseWriter is a ResponseWriter whose client has disconnected.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingResponseWriter) Write(b []byte) (int, os.Error) {
+	return 0, os.EPIPE
+}
+
+// delivery error tests
+func TestOnDeliveryError(t *testing.T) {
+	var failed []string
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3,
+		OnDeliveryError: func(cid string, err os.Error) {
+			failed = append(failed, cid+": "+err.String())
+		},
+	})
+	p.PublishString("test", "hello", true)
+
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	p.SubscriberHandler.ServeHTTP(failingResponseWriter{httptest.NewRecorder()}, req)
+	if len(failed) != 1 || failed[0] != "test: "+os.EPIPE.String() {
+		t.Errorf("Expected the hook to be called once, got %q", failed)
+	}
+	c, _ := p.Channel("test")
+	if s := c.Stats(); s.Delivered != 0 || s.BytesDelivered != 0 {
+		t.Errorf("Expected nothing to be counted as delivered, got %#v", s)
+	}
+
+	serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	if s := c.Stats(); len(failed) != 1 || s.Delivered != 1 || s.BytesDelivered != 5 {
+		t.Errorf("Expected a successful delivery to be counted once, got %#v", s)
+	}
+}
+
+// queue memory tests
+func TestMaxTotalQueuedBytes(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 10, MaxTotalQueuedBytes: 10})
+	publish := func(cid, s string) {
+		p.PublishString(cid, s, true)
+		// tell the channels apart by the time of their last messages
+		time.Sleep(1e6)
+	}
+	queued := func(cid string) (s string) {
+		c, _ := p.Channel(cid)
+		for _, m := range c.queue.Slice() {
+			s += string(m.Payload) + " "
+		}
+		return
+	}
+
+	publish("a", "aaaa")
+	publish("b", "bbbb")
+	publish("c", "cccc")
+	if q := queued("a"); q != "" {
+		t.Errorf("Expected the least recently published channel to be evicted, got %q", q)
+	}
+	publish("b", "dd")
+	publish("c", "e")
+	if a, b, c := queued("a"), queued("b"), queued("c"); a != "" || b != "dd " || c != "cccc e " {
+		t.Errorf("Expected the oldest message of b to be evicted, got %q %q %q", a, b, c)
+	}
+	if total, s := p.memory.total(), p.Stats(); total != 7 || s.QueuedBytes != 7 {
+		t.Errorf("Expected 7 queued bytes, got %d and %d", total, s.QueuedBytes)
+	}
+
+	p.DeleteChannel("c")
+	p.ClearChannel("b")
+	p.PublishMulti([]string{"a", "b"}, NewMessage("text/plain", []byte("fff")), true)
+	if total := p.memory.total(); total != 6 {
+		t.Errorf("Expected 6 queued bytes, got %d", total)
+	}
+}
+
+// presence memory tests
+func TestPresenceMaxTotalQueuedBytes(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 10, PresenceChannels: true,
+		MaxTotalQueuedBytes: 10, PollingTimeout: 5e9})
+	c, _ := p.Channel("test")
+
+	// the announcements exceed the limit while the shard of the channel is locked
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	}()
+	deadline := time.Nanoseconds() + 2e9
+	for c.SubscriberCount() == 0 || p.memory.total() > 10 {
+		if time.Nanoseconds() > deadline {
+			t.Fatalf("Expected the announcement to be evicted, %d bytes queued", p.memory.total())
+		}
+		time.Sleep(1e7)
+	}
+
+	deleted := make(chan bool)
+	go func() {
+		p.DeleteChannel("test")
+		deleted <- true
+	}()
+	select {
+	case <-deleted:
+	case <-time.After(2e9):
+		t.Fatal("Expected the channel to be deleted")
+	}
+	if rw := <-done; rw.Code != http.StatusGone {
+		t.Errorf("Expected 410, got %d", rw.Code)
+	}
+}
+
+// NotifyingResponseWriter is a ResponseWriter whose client disconnects once closed is closed.
+type notifyingResponseWriter struct {
+	*httptest.ResponseRecorder
+	closed chan bool
+}
+
+func (w notifyingResponseWriter) CloseNotify() <-chan bool {
+	return w.closed
+}
+
+// disconnect tests
+func TestDisconnect(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true, PollingTimeout: 60e9})
+	rw := notifyingResponseWriter{httptest.NewRecorder(), make(chan bool)}
+	req, _ := http.NewRequest("GET", "http://localhost/sub", nil)
+	done := make(chan bool)
+	go func() {
+		p.SubscriberHandler.ServeHTTP(rw, req)
+		done <- true
+	}()
+	time.Sleep(1e8)
+
+	c, _ := p.Channel("test")
+	if n := c.SubscriberCount(); n != 1 {
+		t.Fatalf("Expected a parked subscriber, got %d", n)
+	}
+	close(rw.closed)
+	select {
+	case <-done:
+	case <-time.After(1e9):
+		t.Fatal("Expected the subscription to end once the client disconnected")
+	}
+	if n := c.SubscriberCount(); n != 0 {
+		t.Errorf("Expected the subscriber to be gone, got %d", n)
+	}
+}
+
+// interval min wait tests
+func TestIntervalMinWait(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, AllowChannelCreation: true,
+		PollingMechanism: PollingMechanismInterval, IntervalMinWait: 5e8})
+
+	start := time.Nanoseconds()
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub", ""); rw.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 once the wait is over, got %d", rw.Code)
+	}
+	if waited := time.Nanoseconds() - start; waited < 5e8 || waited > 2e9 {
+		t.Errorf("Expected to wait for about 500 ms, waited %d ns", waited)
+	}
+
+	go func() {
+		time.Sleep(1e8)
+		p.PublishString("test", "hello", true)
+	}()
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub", ""); rw.Code != http.StatusOK || rw.Body.String() != "hello" {
+		t.Errorf("Expected the message published within the wait, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+// subscriber location tests
+func TestSubscriberLocation(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{SubscriberLocationTemplate: "/sub?id=%s"})
+	if rw := serveRequest(p.PublisherHandler, "PUT", "/pub?id=room%2042", ""); rw.HeaderMap.Get("Location") != "/sub?id=room%2042" {
+		t.Errorf("Expected the subscriber location, got %q", rw.HeaderMap.Get("Location"))
+	}
+
+	p = New(QueryParameterAcceptor("id"), Configuration{SubscriberLocationTemplate: "/sub/%s", Logger: NopLog})
+	if rw := serveRequest(p.PublisherHandler, "PUT", "/pub?id=a/b%20c", ""); rw.HeaderMap.Get("Location") != "/sub/a%2Fb%20c" {
+		t.Errorf("Expected the id escaped as a path segment, got %q", rw.HeaderMap.Get("Location"))
+	}
+
+	p = New(StaticAcceptor("test"), Configuration{SubscriberLocationTemplate: "/sub", Logger: NopLog})
+	if rw := serveRequest(p.PublisherHandler, "PUT", "/pub", ""); rw.HeaderMap.Get("Location") != "" {
+		t.Errorf("Expected no location with an invalid template, got %q", rw.HeaderMap.Get("Location"))
+	}
+
+	p = New(StaticAcceptor("test"), Configuration{})
+	if rw := serveRequest(p.PublisherHandler, "PUT", "/pub", ""); rw.HeaderMap.Get("Location") != "" {
+		t.Errorf("Expected no location without a template, got %q", rw.HeaderMap.Get("Location"))
+	}
+}
+
+// case insensitive channel tests
+func TestCaseInsensitiveChannels(t *testing.T) {
+	p := New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3, CaseInsensitiveChannels: true})
+	serveRequest(p.PublisherHandler, "POST", "/pub?id=News", "hello")
+	if rw := serveRequest(p.SubscriberHandler, "GET", "/sub?id=news", ""); rw.Code != http.StatusOK || rw.Body.String() != "hello" {
+		t.Errorf("Expected the message published to News, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	p.PublishMulti([]string{"NEWS", "news", "Other"}, NewMessage("text/plain", []byte("multi")), true)
+	if ids := p.ChannelStats(); len(ids) != 2 || ids["news"].Published != 2 || ids["other"].Published != 1 {
+		t.Errorf("Invalid channels %v", ids)
+	}
+	if !p.HasChannel("NeWs") || !p.DeleteChannel("NEWS") || p.HasChannel("news") {
+		t.Errorf("Expected news to be found and deleted regardless of case")
+	}
+
+	p = New(QueryParameterAcceptor("id"), Configuration{ChannelCapacity: 3})
+	serveRequest(p.PublisherHandler, "POST", "/pub?id=News", "hello")
+	if p.HasChannel("news") {
+		t.Errorf("Expected channel ids to be case sensitive by default")
+	}
+}
+
+// RecordingMetrics is a Metrics recording every call as a line.
+type recordingMetrics struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (m *recordingMetrics) record(format string, v ...interface{}) {
+	m.lock.Lock()
+	m.calls = append(m.calls, fmt.Sprintf(format, v...))
+	m.lock.Unlock()
+}
+
+func (m *recordingMetrics) IncPublished(cid string) {
+	m.record("published %s", cid)
+}
+
+func (m *recordingMetrics) IncDelivered(cid string, n int) {
+	m.record("delivered %s %d", cid, n)
+}
+
+func (m *recordingMetrics) SetSubscribers(cid string, n int) {
+	m.record("subscribers %s %d", cid, n)
+}
+
+// metrics interface tests
+func TestMetricsInterface(t *testing.T) {
+	metrics := new(recordingMetrics)
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, PollingTimeout: 5e9, Metrics: metrics})
+	c, _ := p.Channel("test")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+	}()
+	for c.SubscriberCount() == 0 {
+		time.Sleep(1e7)
+	}
+	serveRequest(p.PublisherHandler, "POST", "/pub", "hello")
+	if rw := <-done; rw.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rw.Code)
+	}
+	serveRequest(p.SubscriberHandler, "GET", "/sub", "")
+
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	expected := []string{"subscribers test 1", "published test", "delivered test 1", "subscribers test 0", "delivered test 1"}
+	if strings.Join(metrics.calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected %q, got %q", expected, metrics.calls)
+	}
+}
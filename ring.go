@@ -0,0 +1,80 @@
+package pusher
+
+// A ring is a queue of messages with a fixed capacity. Once it is full, pushing a
+// message evicts the oldest one, so both operations take constant time.
+type ring struct {
+	buf   []*Message // The messages, allocated on the first push.
+	cap   int        // The capacity of the ring.
+	start int        // The index of the oldest message in buf.
+	n     int        // The amount of messages.
+	bytes int64      // The total payload size of the messages.
+}
+
+// NewRing creates an empty ring holding at most capacity messages.
+func newRing(capacity int) ring {
+	return ring{cap: capacity}
+}
+
+// Len returns the amount of messages in the ring.
+func (r *ring) Len() int {
+	return r.n
+}
+
+// Bytes returns the total payload size of the messages in the ring.
+func (r *ring) Bytes() int64 {
+	return r.bytes
+}
+
+// At returns the i'th message of the ring, oldest first.
+func (r *ring) At(i int) *Message {
+	return r.buf[(r.start+i)%r.cap]
+}
+
+// Push appends m to the ring, evicting the oldest message if the ring is full. It
+// reports whether a message was evicted.
+func (r *ring) Push(m *Message) (evicted bool) {
+	if r.cap <= 0 {
+		return false
+	}
+	if r.buf == nil {
+		r.buf = make([]*Message, r.cap)
+	}
+	r.bytes += int64(len(m.Payload))
+	if r.n == r.cap {
+		r.bytes -= int64(len(r.buf[r.start].Payload))
+		r.buf[r.start] = m
+		r.start = (r.start + 1) % r.cap
+		return true
+	}
+	r.buf[(r.start+r.n)%r.cap] = m
+	r.n++
+	return false
+}
+
+// Drop removes the k oldest messages from the ring.
+func (r *ring) Drop(k int) {
+	if k > r.n {
+		k = r.n
+	}
+	for ; k > 0; k-- {
+		r.bytes -= int64(len(r.buf[r.start].Payload))
+		r.buf[r.start] = nil
+		r.start = (r.start + 1) % r.cap
+		r.n--
+	}
+}
+
+// Clear removes all messages from the ring.
+func (r *ring) Clear() {
+	r.Drop(r.n)
+	r.start = 0
+}
+
+// Slice returns a copy of the messages in the ring, oldest first.
+func (r *ring) Slice() []*Message {
+	msgs := make([]*Message, r.n)
+	for i := range msgs {
+		msgs[i] = r.At(i)
+	}
+	return msgs
+}
@@ -0,0 +1,374 @@
+package pusher
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MultipartBoundary separates the parts of multipart/x-mixed-replace streams.
+const multipartBoundary = "pusher-message-boundary"
+
+// A streamFormat describes how messages are framed in a streaming response.
+type streamFormat struct {
+	name        string                                                              // The prefix of log lines.
+	contentType string                                                              // The content-type of the stream.
+	preamble    []byte                                                              // Written once before any message.
+	heartbeat   []byte                                                              // Keeps the connection alive (nil=disable).
+	upgrade     func(http.ResponseWriter, *http.Request) (io.WriteCloser, os.Error) // Takes over the connection instead of responding (nil=disable).
+	write       func(io.Writer, *Message, int) os.Error                             // Writes a single message along with its count.
+	end         func(io.Writer, *Message) os.Error                                  // Writes the message ending the stream (nil=disable).
+}
+
+var (
+	sseFormat = &streamFormat{
+		name:        "SSE",
+		contentType: "text/event-stream",
+		heartbeat:   []byte(":\n"),
+		write:       writeEvent,
+	}
+	multipartFormat = &streamFormat{
+		name:        "Multipart",
+		contentType: "multipart/x-mixed-replace; boundary=" + multipartBoundary,
+		preamble:    []byte("--" + multipartBoundary + "\r\n"),
+		write:       writePart,
+	}
+)
+
+// HandleSSE is responsible for answering requests to the Server-Sent Events subscriber
+// locations. Every message is streamed to the client as an event, see handleStream.
+//
+// Every event carries an id of the form "<time>:<etag>:<count>", where count tells how many
+// messages the stream has delivered so far (including this one), so that clients can detect
+// gaps, e.g. using the lastEventId of EventSource. A reconnecting client that sends the id
+// back using the Last-Event-ID header resumes right after the message it identifies. Without
+// it, streaming starts from the oldest available message.
+//
+// If the HeartbeatInterval configuration option is set, an empty comment line is written
+// every HeartbeatInterval while waiting for messages to keep the connection alive.
+func (p *pusher) handleSSE(rw http.ResponseWriter, req *http.Request) {
+	since, etag := parseEventId(req.Header.Get("Last-Event-ID"))
+	p.handleStream(rw, req, sseFormat, since, etag)
+}
+
+// HandleMultipart is responsible for answering requests to the multipart subscriber
+// locations. Every message is streamed to the client as a part of a
+// multipart/x-mixed-replace response carrying the message's content-type and payload,
+// see handleStream. Every part carries an X-Delivered-Count header telling how many
+// messages the stream has delivered so far (including this one). Streaming starts from
+// the oldest available message.
+func (p *pusher) handleMultipart(rw http.ResponseWriter, req *http.Request) {
+	p.handleStream(rw, req, multipartFormat, 0, 0)
+}
+
+// HandleStream answers requests to streaming subscriber locations. Channel lookup,
+// acceptor logic and the AllowChannelCreation configuration option behave as in
+// handleSubscriber. Instead of delivering a single message, the connection is kept open
+// and every message newer than since and etag is written to the client using format,
+// regardless of the PollingMechanism configuration option.
+//
+// Streams are never compressed regardless of the GzipMinSize configuration option, since a
+// gzip stream can not be flushed message by message.
+//
+// The stream ends once the channel delivers a message with a non-200 status, e.g. when
+// the channel is deleted, the pusher is closed or a concurrency conflict occurs, or with a
+// 503 once the pusher is draining. The message is written using the end function of format,
+// if it has one.
+//
+// Messages are written on the goroutine of the request without holding any lock, so a slow
+// client can only hold up its own stream. If the StreamWriteTimeout configuration option is
+// set, a client whose write takes longer is evicted, i.e. its stream ends, see timeoutWriter.
+// To this end the connection is hijacked and the response is written to it directly, so the
+// timeout only applies to connections that can be hijacked. A message that can not be written
+// or flushed ends the stream and is handled by deliveryFailed.
+//
+// If format has an upgrade function, the connection is taken over by it instead of responding
+// with a 200 and the stream is written to the upgraded connection.
+func (p *pusher) handleStream(rw http.ResponseWriter, req *http.Request, format *streamFormat, since int64, etag int) {
+	cid := p.acceptor(req)
+
+	if req.Method != "GET" {
+		p.config.Logger.Printf("%s/405: A non GET request to channel %q [%s]", format.name, cid, req.RemoteAddr)
+		rw.Header().Set("Allow", "GET")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if p.isDraining() {
+		p.config.Logger.Printf("%s/503: Trying to subscribe to channel %q of a draining pusher [%s]", format.name, cid, req.RemoteAddr)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if location := redirectLocation(cid); location != "" {
+		p.config.Logger.Printf("%s/302: Acceptor redirected URL %q to %q [%s]", format.name, req.RawURL, location, req.RemoteAddr)
+		rw.Header().Set("Location", location)
+		rw.WriteHeader(http.StatusFound)
+		return
+	} else if cid == "" {
+		p.config.Logger.Printf("%s/404: Acceptor denied access to URL %q [%s]", format.name, req.RawURL, req.RemoteAddr)
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	} else if p.isTooLong(cid) {
+		p.config.Logger.Printf("%s/400: A channel id of %d bytes is too long [%s]", format.name, len(cid), req.RemoteAddr)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sh := p.shard(cid)
+	sh.lock.Lock()
+	if p.closed {
+		sh.lock.Unlock()
+		p.config.Logger.Printf("%s/503: Trying to subscribe to channel %q of a closed pusher [%s]", format.name, cid, req.RemoteAddr)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	c, ok := sh.channels[cid]
+	if !ok {
+		if !p.config.AllowChannelCreation {
+			sh.lock.Unlock()
+			p.config.Logger.Printf("%s/403: Trying to subscribe to a non-existent channel %q [%s]", format.name, cid, req.RemoteAddr)
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		p.config.Logger.Printf("%s: Channel %q created [%s]", format.name, cid, req.RemoteAddr)
+		c = p.newChannel(cid)
+		sh.channels[cid] = c
+	}
+	sh.lock.Unlock()
+
+	if !ok {
+		p.channelCreated(c)
+	}
+
+	var w io.Writer = rw
+	if format.upgrade != nil {
+		conn, err := format.upgrade(rw, req)
+		if err != nil {
+			p.config.Logger.Printf("%s/500: Upgrading a stream to channel %q failed: %s [%s]", format.name, cid, err, req.RemoteAddr)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		p.config.Logger.Printf("%s/101: New stream to channel %q [%s]", format.name, cid, req.RemoteAddr)
+		w = conn
+	} else if hijacker, ok := rw.(http.Hijacker); ok && p.config.StreamWriteTimeout > 0 {
+		conn, err := hijackStream(hijacker, format.contentType)
+		if err != nil {
+			p.config.Logger.Printf("%s: Stream to channel %q closed: %s [%s]", format.name, cid, err, req.RemoteAddr)
+			return
+		}
+		defer conn.Close()
+		p.config.Logger.Printf("%s/200: New stream to channel %q [%s]", format.name, cid, req.RemoteAddr)
+		w = conn
+	} else {
+		p.config.Logger.Printf("%s/200: New stream to channel %q [%s]", format.name, cid, req.RemoteAddr)
+		rw.Header().Set("Content-Type", format.contentType)
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	if conn, ok := w.(writeTimeouter); ok && p.config.StreamWriteTimeout > 0 {
+		conn.SetWriteTimeout(p.config.StreamWriteTimeout)
+		w = &timeoutWriter{conn}
+	}
+
+	if format.preamble != nil {
+		w.Write(format.preamble)
+	}
+	flush(w)
+
+	var heartbeat <-chan int64
+	if p.config.HeartbeatInterval > 0 && format.heartbeat != nil {
+		ticker := time.NewTicker(p.config.HeartbeatInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	delivered := 0     // The amount of messages written to the stream.
+	var served []int64 // The messages written beyond the position, see channel.position.
+	for {
+		// subscribing under the lock of the shard makes sure that Close can not miss the stream
+		sh.lock.RLock()
+		if p.closed {
+			sh.lock.RUnlock()
+			p.config.Logger.Printf("%s/410: Stream to channel %q ended by a closed pusher [%s]", format.name, cid, req.RemoteAddr)
+			return
+		}
+		sub, message := c.subscribe(since, etag, 0, served, true)
+		sh.lock.RUnlock()
+		for sub != nil {
+			select {
+			case message = <-sub.Value.(chan *Message):
+				sub = nil
+			case <-p.drain:
+				// a stream never finishes on its own, so a draining pusher ends it
+				c.Unsubscribe(sub)
+				message = p.config.synthetic(unavailableMessage)
+				sub = nil
+			case <-heartbeat:
+				if _, err := w.Write(format.heartbeat); err == nil {
+					err = flush(w)
+				}
+				if err != nil {
+					c.Unsubscribe(sub)
+					p.config.Logger.Printf("%s: Stream to channel %q closed: %s [%s]", format.name, cid, err, req.RemoteAddr)
+					return
+				}
+			}
+		}
+		if message == nil {
+			// the subscriber was not ready when the message was published, try again
+			continue
+		}
+		if message.Status != http.StatusOK {
+			p.config.Logger.Printf("%s/%d: Stream to channel %q ended [%s]", format.name, message.Status, cid, req.RemoteAddr)
+			if format.end != nil {
+				format.end(w, message)
+			}
+			return
+		}
+
+		delivered++
+		err := format.write(w, message, delivered)
+		if err == nil {
+			err = flush(w)
+		}
+		if err != nil {
+			p.config.Logger.Printf("%s: Stream to channel %q closed [%s]", format.name, cid, req.RemoteAddr)
+			p.deliveryFailed(req, c, cid, []*Message{message}, err)
+			return
+		}
+		var pos *Message
+		if pos, served = c.position(since, etag, 0, append(served, message.seq), message); pos != nil {
+			since, etag = pos.time, pos.etag
+		}
+	}
+}
+
+// ErrWriteTimeout is returned by writes to streaming subscribers exceeding the
+// StreamWriteTimeout configuration option.
+var ErrWriteTimeout = os.NewError("pusher: write timeout")
+
+// A writeTimeouter is a connection whose writes can be given a timeout, e.g. a net.Conn.
+type writeTimeouter interface {
+	io.Writer
+	SetWriteTimeout(nsec int64) os.Error
+}
+
+// A timeoutWriter writes to a connection whose writes have been given a timeout, reporting
+// writes that timed out as ErrWriteTimeout.
+type timeoutWriter struct {
+	w writeTimeouter // The underlying connection.
+}
+
+func (t *timeoutWriter) Write(b []byte) (int, os.Error) {
+	n, err := t.w.Write(b)
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		err = ErrWriteTimeout
+	}
+	return n, err
+}
+
+// Flush flushes the underlying connection, see flush, reporting a flush that timed out as
+// ErrWriteTimeout.
+func (t *timeoutWriter) Flush() os.Error {
+	err := flush(t.w)
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		err = ErrWriteTimeout
+	}
+	return err
+}
+
+// An errorFlusher buffers its writes, so the failure to write them is reported by Flush,
+// e.g. a webSocketConn.
+type errorFlusher interface {
+	Flush() os.Error
+}
+
+// Flush flushes w if it is an errorFlusher or a http.Flusher. It returns the error of writing
+// the buffered data, if w reports it.
+func flush(w io.Writer) os.Error {
+	switch f := w.(type) {
+	case errorFlusher:
+		return f.Flush()
+	case http.Flusher:
+		f.Flush()
+	}
+	return nil
+}
+
+// HijackStream takes over the connection of a streaming response and writes a 200 response
+// with the given content-type to it. The stream is ended by closing the connection.
+func hijackStream(hijacker http.Hijacker, contentType string) (net.Conn, os.Error) {
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: " + contentType + "\r\n")
+	buf.WriteString("Cache-Control: no-cache\r\nConnection: close\r\n\r\n")
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// WriteEvent writes message to w as a single Server-Sent Event whose id carries count, the
+// amount of messages written to the stream so far. Every line of the payload becomes a
+// data field of the event.
+func writeEvent(w io.Writer, message *Message, count int) os.Error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %d:%d:%d\n", message.time, message.etag, count)
+	for _, line := range bytes.Split(message.Payload, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WritePart writes message to w as a single part of a multipart/x-mixed-replace stream,
+// followed by the boundary that terminates the part. The part carries count, the amount
+// of messages written to the stream so far, in its X-Delivered-Count header.
+func writePart(w io.Writer, message *Message, count int) os.Error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "X-Delivered-Count: %d\r\n", count)
+	if message.ContentType != "" {
+		fmt.Fprintf(&buf, "Content-Type: %s\r\n", message.ContentType)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(message.Payload)
+	buf.WriteString("\r\n--" + multipartBoundary + "\r\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ParseEventId parses an event id written by writeEvent. The count is optional and
+// ignored, since it starts over with every stream. Malformed ids are treated as absent.
+func parseEventId(id string) (since int64, etag int) {
+	parts := strings.SplitN(id, ":", 3)
+	if len(parts) < 2 {
+		return 0, 0
+	}
+	if len(parts) == 3 {
+		if _, err := strconv.Atoi(parts[2]); err != nil {
+			return 0, 0
+		}
+	}
+	since, err := strconv.Atoi64(parts[0])
+	if err != nil {
+		return 0, 0
+	}
+	if etag, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0
+	}
+	return
+}
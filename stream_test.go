@@ -0,0 +1,408 @@
+package pusher
+
+import (
+	"bufio"
+	"fmt"
+	"http"
+	"http/httptest"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// PipeResponseWriter is a http.ResponseWriter (and http.Flusher) that passes the body
+// through a pipe, so that streamed responses can be read while they are written.
+type pipeResponseWriter struct {
+	*io.PipeWriter
+	header http.Header
+	status int
+}
+
+func newPipeResponseWriter() (*pipeResponseWriter, *bufio.Reader) {
+	r, w := io.Pipe()
+	return &pipeResponseWriter{PipeWriter: w, header: make(http.Header)}, bufio.NewReader(r)
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *pipeResponseWriter) Flush() {
+}
+
+// ReadEvent reads lines from r until an empty line terminating an event.
+func readEvent(r *bufio.Reader) (lines []string) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || line == "\n" {
+			return
+		}
+		lines = append(lines, line[:len(line)-1])
+	}
+	return
+}
+
+// sse tests
+func TestSSE(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	c, _ := p.Channel("test")
+
+	rw, body := newPipeResponseWriter()
+	req, _ := http.NewRequest("GET", "http://localhost/sse", nil)
+	done := make(chan bool)
+	go func() {
+		p.SubscriberSSEHandler.ServeHTTP(rw, req)
+		rw.Close()
+		done <- true
+	}()
+
+	go func() {
+		time.Sleep(1e9 / 4)
+		c.PublishString("first", true)
+		time.Sleep(1e9 / 4)
+		c.PublishString("second\nline", true)
+	}()
+
+	lines := readEvent(body)
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "id: ") || !strings.HasSuffix(lines[0], ":1") || lines[1] != "data: first" {
+		t.Errorf("Invalid first event %q", lines)
+	}
+	lines = readEvent(body)
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "id: ") || !strings.HasSuffix(lines[0], ":2") || lines[1] != "data: second" || lines[2] != "data: line" {
+		t.Errorf("Invalid second event %q", lines)
+	}
+	if ctype := rw.header.Get("Content-Type"); rw.status != http.StatusOK || ctype != "text/event-stream" {
+		t.Errorf("Invalid response %d %q", rw.status, ctype)
+	}
+
+	// the stream ends when the channel is gone
+	for {
+		c.Publish(goneMessage, false)
+		select {
+		case <-done:
+			return
+		case <-time.After(1e9 / 10):
+		}
+	}
+}
+
+// sse resume tests
+func TestSSELastEventId(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	c, _ := p.Channel("test")
+	tm1 := &Message{Status: http.StatusOK, Payload: []byte("tm1")}
+	tm2 := &Message{Status: http.StatusOK, Payload: []byte("tm2")}
+	c.Publish(tm1, true)
+	c.Publish(tm2, true)
+
+	id := fmt.Sprintf("%d:%d:1", tm1.time, tm1.etag)
+	if since, etag := parseEventId(id); since != tm1.time || etag != tm1.etag {
+		t.Errorf("Invalid event id %q", id)
+	}
+	if since, etag := parseEventId(fmt.Sprintf("%d:%d", tm1.time, tm1.etag)); since != tm1.time || etag != tm1.etag {
+		t.Errorf("Invalid event id without a count")
+	}
+
+	rw, body := newPipeResponseWriter()
+	req, _ := http.NewRequest("GET", "http://localhost/sse", nil)
+	req.Header.Set("Last-Event-ID", id)
+	go p.SubscriberSSEHandler.ServeHTTP(rw, req)
+
+	if lines := readEvent(body); len(lines) != 2 || lines[1] != "data: tm2" {
+		t.Errorf("Expected tm2, got %q", lines)
+	}
+	c.Publish(goneMessage, false)
+}
+
+// ReadPart reads lines from r until a multipart boundary terminating a part.
+func readPart(r *bufio.Reader) (lines []string) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || line == "--"+multipartBoundary+"\r\n" {
+			return
+		}
+		lines = append(lines, line[:len(line)-2])
+	}
+	return
+}
+
+// multipart tests
+func TestMultipart(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	c, _ := p.Channel("test")
+
+	rw, body := newPipeResponseWriter()
+	req, _ := http.NewRequest("GET", "http://localhost/multipart", nil)
+	done := make(chan bool)
+	go func() {
+		p.SubscriberMultipartHandler.ServeHTTP(rw, req)
+		rw.Close()
+		done <- true
+	}()
+
+	go func() {
+		time.Sleep(1e9 / 4)
+		c.PublishString("first", true)
+		time.Sleep(1e9 / 4)
+		c.Publish(&Message{Status: http.StatusOK, ContentType: "application/json", Payload: []byte("{}")}, true)
+	}()
+
+	if lines := readPart(body); len(lines) != 0 {
+		t.Errorf("Expected initial boundary, got %q", lines)
+	}
+	if lines := readPart(body); len(lines) != 4 || lines[0] != "X-Delivered-Count: 1" || lines[1] != "Content-Type: text/plain" || lines[2] != "" || lines[3] != "first" {
+		t.Errorf("Invalid first part %q", lines)
+	}
+	if lines := readPart(body); len(lines) != 4 || lines[0] != "X-Delivered-Count: 2" || lines[1] != "Content-Type: application/json" || lines[2] != "" || lines[3] != "{}" {
+		t.Errorf("Invalid second part %q", lines)
+	}
+	if ctype := rw.header.Get("Content-Type"); !strings.HasPrefix(ctype, "multipart/x-mixed-replace") {
+		t.Errorf("Invalid content-type %q", ctype)
+	}
+
+	// the stream is closed when the channel is gone
+	for {
+		c.Publish(goneMessage, false)
+		select {
+		case <-done:
+			return
+		case <-time.After(1e9 / 10):
+		}
+	}
+}
+
+// HijackResponseWriter is a http.ResponseWriter (and http.Hijacker) handing out one end of
+// an in-memory connection, so that upgraded connections can be driven by the other end.
+type hijackResponseWriter struct {
+	pipeResponseWriter
+	conn net.Conn
+}
+
+func (w *hijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, os.Error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// ReadFrame reads a single unmasked WebSocket frame with a short payload from r.
+func readFrame(r *bufio.Reader) (opcode byte, payload []byte, err os.Error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	payload = make([]byte, header[1])
+	_, err = io.ReadFull(r, payload)
+	return header[0] & 0xf, payload, err
+}
+
+// websocket tests
+func TestWebSocket(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	c, _ := p.Channel("test")
+
+	server, client := net.Pipe()
+	rw := &hijackResponseWriter{pipeResponseWriter{header: make(http.Header)}, server}
+	req, _ := http.NewRequest("GET", "http://localhost/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	go p.SubscriberWebSocketHandler.ServeHTTP(rw, req)
+
+	body := bufio.NewReader(client)
+	var handshake []string
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading the handshake failed: %s", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		handshake = append(handshake, strings.TrimSpace(line))
+	}
+	if len(handshake) == 0 || handshake[0] != "HTTP/1.1 101 Switching Protocols" {
+		t.Errorf("Invalid handshake %q", handshake)
+	}
+	if accept := "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; handshake[len(handshake)-1] != accept {
+		t.Errorf("Expected %q, got %q", accept, handshake)
+	}
+
+	go func() {
+		time.Sleep(1e9 / 4)
+		c.PublishString("first", true)
+		time.Sleep(1e9 / 4)
+		c.Publish(&Message{Status: http.StatusOK, ContentType: "image/png", Payload: []byte{0x89, 'P', 'N', 'G'}}, true)
+	}()
+
+	if opcode, payload, err := readFrame(body); err != nil || opcode != opText || string(payload) != "first" {
+		t.Errorf("Expected a text frame, got %d %q %v", opcode, payload, err)
+	}
+	if opcode, payload, err := readFrame(body); err != nil || opcode != opBinary || string(payload) != "\x89PNG" {
+		t.Errorf("Expected a binary frame, got %d %q %v", opcode, payload, err)
+	}
+
+	p.DeleteChannel("test")
+	opcode, payload, err := readFrame(body)
+	if err != nil || opcode != opClose || len(payload) < 2 || int(payload[0])<<8|int(payload[1]) != closeGoingAway {
+		t.Errorf("Expected a going away close frame, got %d %q %v", opcode, payload, err)
+	}
+
+	// plain requests are rejected
+	if rw := serveRequest(p.SubscriberWebSocketHandler, "GET", "/ws", ""); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", rw.Code)
+	}
+}
+
+// websocket delivery error tests
+func TestWebSocketDeliveryError(t *testing.T) {
+	failed := make(chan string, 1)
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, Logger: NopLog,
+		OnDeliveryError: func(cid string, err os.Error) {
+			failed <- cid
+		},
+	})
+	c, _ := p.Channel("test")
+
+	server, client := net.Pipe()
+	rw := &hijackResponseWriter{pipeResponseWriter{header: make(http.Header)}, server}
+	req, _ := http.NewRequest("GET", "http://localhost/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	done := make(chan bool)
+	go func() {
+		p.SubscriberWebSocketHandler.ServeHTTP(rw, req)
+		done <- true
+	}()
+
+	body := bufio.NewReader(client)
+	for {
+		if line, err := body.ReadString('\n'); err != nil || line == "\r\n" {
+			break
+		}
+	}
+	for c.SubscriberCount() == 0 {
+		time.Sleep(1e7)
+	}
+
+	// the frame is buffered, so the failure only surfaces once it is flushed
+	client.Close()
+	c.PublishString("lost", true)
+	select {
+	case cid := <-failed:
+		if cid != "test" {
+			t.Errorf("Expected the error for channel test, got %q", cid)
+		}
+	case <-time.After(2e9):
+		t.Fatal("Expected the delivery error to be reported")
+	}
+	<-done
+	if s := c.Stats(); s.Delivered != 0 {
+		t.Errorf("Expected the lost message to be recalled, got %#v", s)
+	}
+}
+
+// stuck writer tests
+func TestStreamWriteTimeout(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3, StreamWriteTimeout: 1e8})
+	c, _ := p.Channel("test")
+
+	evicted := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.SubscriberSSEHandler.ServeHTTP(rw, req)
+		evicted <- true
+	}))
+	defer server.Close()
+
+	// nobody reads from the stuck subscriber, so its socket buffers fill up
+	stuck, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	io.WriteString(stuck, "GET /sse HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	// the live subscriber can not be hijacked, so its writes have no timeout
+	live, body := newPipeResponseWriter()
+	go func() {
+		req, _ := http.NewRequest("GET", "http://localhost/sse", nil)
+		p.SubscriberSSEHandler.ServeHTTP(live, req)
+		live.Close()
+	}()
+	time.Sleep(1e8)
+
+	payload := strings.Repeat("x", 1<<20)
+	go func() {
+		for i := 0; i < 64; i++ {
+			c.PublishString(payload, true)
+			time.Sleep(1e7)
+		}
+		c.PublishString("last", true)
+	}()
+
+	select {
+	case <-evicted:
+	case <-time.After(10e9):
+		t.Fatal("Expected the stuck subscriber to be evicted")
+	}
+	for {
+		lines := readEvent(body)
+		if len(lines) != 2 {
+			t.Fatalf("Invalid event %q", lines)
+		} else if lines[1] == "data: last" {
+			break
+		}
+	}
+	time.Sleep(1e8)
+	if n := c.SubscriberCount(); n != 1 {
+		t.Errorf("Expected only the live subscriber to be left, got %d", n)
+	}
+	p.DeleteChannel("test")
+}
+
+// streamed publish tests
+func TestStreamedPublish(t *testing.T) {
+	p := New(StaticAcceptor("test"), Configuration{ChannelCapacity: 3})
+	p.Channel("test")
+
+	rw, events := newPipeResponseWriter()
+	sub, _ := http.NewRequest("GET", "http://localhost/sse", nil)
+	go p.SubscriberSSEHandler.ServeHTTP(rw, sub)
+	time.Sleep(1e8)
+
+	body, chunks := io.Pipe()
+	pub, _ := http.NewRequest("POST", "http://localhost/pub", body)
+	pub.Header.Set("X-Stream", "true")
+	pub.Header.Set("Content-Type", "text/plain")
+	published := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		p.PublisherHandler.ServeHTTP(w, pub)
+		published <- w.Code
+	}()
+
+	// every chunk reaches the subscriber before the body ends
+	for _, chunk := range []string{"first", "second"} {
+		io.WriteString(chunks, chunk)
+		if lines := readEvent(events); len(lines) != 2 || lines[1] != "data: "+chunk {
+			t.Errorf("Expected the chunk %q, got %q", chunk, lines)
+		}
+	}
+	chunks.Close()
+
+	if code := <-published; code != http.StatusCreated {
+		t.Errorf("Expected 201, got %d", code)
+	}
+	c, _ := p.Channel("test")
+	if s := c.Stats(); s.Published != 2 || s.Queued != 2 {
+		t.Errorf("Expected 2 chunks to be published, got %#v", s)
+	}
+	p.Close()
+}
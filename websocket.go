@@ -0,0 +1,174 @@
+package pusher
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"http"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// WebSocketGUID is appended to the key of a WebSocket handshake to compute the accept key.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The WebSocket opcodes written by the pusher.
+const (
+	opText   = 0x1
+	opBinary = 0x2
+	opClose  = 0x8
+	opPing   = 0x9
+)
+
+// The WebSocket close codes written by the pusher.
+const (
+	closeNormal    = 1000
+	closeGoingAway = 1001
+)
+
+var webSocketFormat = &streamFormat{
+	name:      "WebSocket",
+	heartbeat: []byte{0x80 | opPing, 0},
+	upgrade:   upgradeWebSocket,
+	write:     writeWebSocketMessage,
+	end:       writeWebSocketClose,
+}
+
+// HandleWebSocket is responsible for answering requests to the WebSocket subscriber locations.
+// The connection is upgraded to a WebSocket (RFC 6455) and every message is written to it as a
+// frame of its own, see handleStream. Messages of textual content-types are written as text
+// frames and the others as binary frames. Streaming starts from the oldest available message.
+//
+// Once the stream ends, a close frame is written before closing the connection. Its code is 1001
+// (going away) if the channel was deleted or the pusher closed or drained, 1000 otherwise. If the
+// HeartbeatInterval configuration option is set, a ping frame is written every HeartbeatInterval
+// while waiting for messages. Frames sent by the client are never read.
+//
+// A GET request that is not a version 13 WebSocket handshake yields a 400.
+func (p *pusher) handleWebSocket(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" && !isWebSocketHandshake(req) {
+		p.config.Logger.Printf("WebSocket/400: Not a WebSocket handshake [%s]", req.RemoteAddr)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p.handleStream(rw, req, webSocketFormat, 0, 0)
+}
+
+// IsWebSocketHandshake reports whether req asks for an upgrade to a version 13 WebSocket.
+func isWebSocketHandshake(req *http.Request) bool {
+	return strings.ToLower(req.Header.Get("Upgrade")) == "websocket" &&
+		strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade") &&
+		req.Header.Get("Sec-WebSocket-Version") == "13" &&
+		req.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+// A webSocketConn is a hijacked connection speaking the WebSocket protocol. Writes are
+// buffered until flushed.
+type webSocketConn struct {
+	conn net.Conn          // The hijacked connection.
+	buf  *bufio.ReadWriter // Buffers the connection.
+}
+
+func (c *webSocketConn) Write(b []byte) (int, os.Error) {
+	return c.buf.Write(b)
+}
+
+// SetWriteTimeout sets the time a write to the connection may take in ns, see timeoutWriter.
+func (c *webSocketConn) SetWriteTimeout(nsec int64) os.Error {
+	return c.conn.SetWriteTimeout(nsec)
+}
+
+// Flush writes the buffered data to the connection. As the frames are buffered, the failure
+// to write them is only reported here.
+func (c *webSocketConn) Flush() os.Error {
+	return c.buf.Flush()
+}
+
+// Close flushes the buffered data and closes the connection.
+func (c *webSocketConn) Close() os.Error {
+	c.buf.Flush()
+	return c.conn.Close()
+}
+
+// UpgradeWebSocket hijacks the connection of rw and completes the WebSocket handshake of req.
+func upgradeWebSocket(rw http.ResponseWriter, req *http.Request) (io.WriteCloser, os.Error) {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		return nil, os.NewError("the connection can not be hijacked")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.New()
+	io.WriteString(h, req.Header.Get("Sec-WebSocket-Key")+webSocketGUID)
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(h.Sum()) + "\r\n\r\n")
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &webSocketConn{conn, buf}, nil
+}
+
+// WriteFrame writes payload to w as a single unmasked WebSocket frame with the given opcode.
+func writeFrame(w io.Writer, opcode byte, payload []byte) os.Error {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, byte(n>>8), byte(n))
+	default:
+		header[1] = 127
+		for shift := uint(56); ; shift -= 8 {
+			header = append(header, byte(uint64(n)>>shift))
+			if shift == 0 {
+				break
+			}
+		}
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// WriteWebSocketMessage writes message to w as a text frame if its content-type is textual
+// and as a binary frame otherwise. Frames carry nothing but the payload, so the count of
+// messages written to the stream is left out.
+func writeWebSocketMessage(w io.Writer, message *Message, count int) os.Error {
+	if isTextType(message.ContentType) {
+		return writeFrame(w, opText, message.Payload)
+	}
+	return writeFrame(w, opBinary, message.Payload)
+}
+
+// WriteWebSocketClose writes a close frame to w telling why the stream was ended by message.
+func writeWebSocketClose(w io.Writer, message *Message) os.Error {
+	code := closeNormal
+	if message.Status == http.StatusGone || message.Status == http.StatusServiceUnavailable {
+		code = closeGoingAway
+	}
+	payload := append([]byte{byte(code >> 8), byte(code)}, http.StatusText(message.Status)...)
+	return writeFrame(w, opClose, payload)
+}
+
+// IsTextType reports whether ctype is a textual content-type.
+func isTextType(ctype string) bool {
+	ctype = strings.ToLower(ctype)
+	if i := strings.Index(ctype, ";"); i >= 0 {
+		ctype = strings.TrimSpace(ctype[:i])
+	}
+	switch ctype {
+	case "application/json", "application/javascript", "application/xml":
+		return true
+	}
+	return strings.HasPrefix(ctype, "text/") || strings.HasSuffix(ctype, "+json") || strings.HasSuffix(ctype, "+xml")
+}